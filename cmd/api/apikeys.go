@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/snirkop89/go-movies/internal/models"
+)
+
+const (
+	// apiKeyPrefix starts every API key, so that leaked keys are easy to spot
+	apiKeyPrefix = "gm_"
+	// apiKeyTouchInterval limits how often the last use of a key is written
+	apiKeyTouchInterval = time.Minute
+)
+
+var errAPIKeyNotAllowed = errors.New("this route can't be used with an API key")
+
+// hashAPIKey returns the stored form of an API key.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// authenticateAPIKey verifies the key of an "Authorization: ApiKey <key>"
+// header, and returns claims equivalent to those of an access token of its
+// user, limited to the scopes of the key.
+func (app *application) authenticateAPIKey(r *http.Request, key string) (*claims, error) {
+	k, err := app.DB.APIKeyByHash(r.Context(), hashAPIKey(key))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errors.New("invalid api key")
+		}
+		return nil, err
+	}
+	if k.RevokedAt != nil {
+		return nil, errors.New("revoked api key")
+	}
+
+	user, err := app.DB.UserByID(r.Context(), k.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if k.LastUsedAt == nil || now.Sub(*k.LastUsedAt) > apiKeyTouchInterval {
+		if err := app.DB.TouchAPIKey(r.Context(), k.ID, now); err != nil {
+			app.logger.WithFields("api_key_id", strconv.Itoa(k.ID), "error", err.Error()).Warn("touch api key")
+		}
+	}
+
+	c := &claims{
+		Name:     fmt.Sprintf("%s %s", user.FirstName, user.LastName),
+		Role:     user.Role,
+		APIKeyID: k.ID,
+		Scopes:   k.Scopes,
+	}
+	c.Subject = strconv.Itoa(user.ID)
+
+	return c, nil
+}
+
+// ListAPIKeys lists the API keys of the caller.
+func (app *application) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	id, err := app.currentUserID(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	keys, err := app.DB.UserAPIKeys(r.Context(), id)
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	var payload = struct {
+		Keys []*models.APIKey `json:"api_keys"`
+	}{
+		keys,
+	}
+
+	app.writeJSON(w, http.StatusOK, payload)
+}
+
+// CreateAPIKey creates an API key for the caller. The key itself is only
+// ever returned in this response.
+func (app *application) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	userID, err := app.currentUserID(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	name := strings.TrimSpace(payload.Name)
+	switch {
+	case name == "":
+		app.errorJSON(w, errors.New("name must be provided"), http.StatusUnprocessableEntity)
+		return
+	case len(name) > 100:
+		app.errorJSON(w, errors.New("name must not be more than 100 bytes long"), http.StatusUnprocessableEntity)
+		return
+	case len(payload.Scopes) == 0:
+		app.errorJSON(w, errors.New("at least one scope must be provided"), http.StatusUnprocessableEntity)
+		return
+	}
+
+	var scopes []string
+	for _, s := range payload.Scopes {
+		if !models.ValidScope(s) {
+			app.errorJSON(w, fmt.Errorf("invalid scope %q", s), http.StatusUnprocessableEntity)
+			return
+		}
+		if !containsString(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+
+	secret, err := randomToken(32)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	key := apiKeyPrefix + secret
+
+	k := models.APIKey{
+		UserID:    userID,
+		Name:      name,
+		Prefix:    key[:len(apiKeyPrefix)+8],
+		Hash:      hashAPIKey(key),
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+	}
+	k.ID, err = app.DB.InsertAPIKey(r.Context(), k)
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	app.auditLog(r, auditEvent{Action: "create", Entity: "api_key", EntityID: strconv.Itoa(k.ID), After: k})
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "api key created, store it now as it won't be shown again",
+		Data: struct {
+			*models.APIKey
+			Key string `json:"key"`
+		}{&k, key},
+	}
+	app.writeJSON(w, http.StatusCreated, resp)
+}
+
+// RevokeAPIKey revokes an API key of the caller.
+func (app *application) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	userID, err := app.currentUserID(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	err = app.DB.RevokeAPIKey(r.Context(), userID, id)
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	app.auditLog(r, auditEvent{Action: "revoke", Entity: "api_key", EntityID: strconv.Itoa(id)})
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "api key revoked",
+	}
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
+// containsString reports whether s is in list.
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
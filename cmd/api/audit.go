@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/snirkop89/go-movies/internal/models"
+	"github.com/snirkop89/go-movies/internal/repository"
+)
+
+// auditEvent is an entry of the audit log, as recorded by the handlers.
+type auditEvent struct {
+	Action   string
+	Entity   string
+	EntityID string
+	UserID   int // acting user, the caller of the request when 0
+	Before   any // entity before the change, nil when it was created
+	After    any // entity after the change, nil when it was deleted
+}
+
+// auditChange is the change of one field in a diff built by auditDiff.
+type auditChange struct {
+	From json.RawMessage `json:"from,omitempty"`
+	To   json.RawMessage `json:"to,omitempty"`
+}
+
+// auditFields returns the top level fields of the JSON encoding of v.
+func auditFields(v any) (map[string]json.RawMessage, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, fmt.Errorf("audit diff of %T: %w", v, err)
+	}
+	return fields, nil
+}
+
+// auditDiff compares the JSON encodings of before and after and returns the
+// fields that differ, as {"field": {"from": old, "to": new}}, or nil when
+// nothing changed. Either can be nil, for created and deleted entities.
+func auditDiff(before, after any) (json.RawMessage, error) {
+	from, err := auditFields(before)
+	if err != nil {
+		return nil, err
+	}
+	to, err := auditFields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := make(map[string]auditChange)
+	for k, old := range from {
+		if v, ok := to[k]; !ok || !bytes.Equal(old, v) {
+			diff[k] = auditChange{From: old, To: v}
+		}
+	}
+	for k, v := range to {
+		if _, ok := from[k]; !ok {
+			diff[k] = auditChange{To: v}
+		}
+	}
+
+	if len(diff) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(diff)
+}
+
+// audit records e through repo, so that handlers can write it in the
+// transaction of the change it describes.
+func (app *application) audit(r *http.Request, repo repository.DatabaseRepo, e auditEvent) error {
+	changes, err := auditDiff(e.Before, e.After)
+	if err != nil {
+		return err
+	}
+
+	entry := models.AuditEntry{
+		Action:    e.Action,
+		Entity:    e.Entity,
+		EntityID:  e.EntityID,
+		Changes:   changes,
+		IP:        clientIP(r),
+		CreatedAt: time.Now(),
+	}
+
+	userID := e.UserID
+	if userID == 0 {
+		userID, _ = app.currentUserID(r)
+	}
+	if userID > 0 {
+		entry.UserID = &userID
+	}
+
+	return repo.InsertAuditEntry(r.Context(), entry)
+}
+
+// auditLog records e on its own, for events with nothing else to write or
+// whose change is already committed. A failure is logged but doesn't fail
+// the request.
+func (app *application) auditLog(r *http.Request, e auditEvent) {
+	if err := app.audit(r, app.DB, e); err != nil {
+		app.logger.WithFields("action", e.Action, "entity", e.Entity, "entity_id", e.EntityID, "error", err.Error()).Error("audit")
+	}
+}
+
+// readAuditFilter builds an audit log filter from the query string. Times
+// are RFC 3339.
+func (app *application) readAuditFilter(r *http.Request) (repository.AuditFilter, error) {
+	qs := r.URL.Query()
+
+	var filter repository.AuditFilter
+	var err error
+
+	filter.Page, err = app.readInt(qs, "page", 1)
+	if err != nil {
+		return filter, err
+	}
+	filter.PerPage, err = app.readInt(qs, "per_page", defaultPerPage)
+	if err != nil {
+		return filter, err
+	}
+	if filter.Page < 1 {
+		return filter, errors.New("page must be greater than zero")
+	}
+	if filter.PerPage < 1 || filter.PerPage > maxPerPage {
+		return filter, fmt.Errorf("per_page must be between 1 and %d", maxPerPage)
+	}
+
+	filter.UserID, err = app.readInt(qs, "user_id", 0)
+	if err != nil {
+		return filter, err
+	}
+	filter.Entity = qs.Get("entity")
+	filter.EntityID = qs.Get("entity_id")
+	filter.Action = qs.Get("action")
+
+	for _, t := range []struct {
+		key  string
+		dest *time.Time
+	}{
+		{"from", &filter.From},
+		{"to", &filter.To},
+	} {
+		if v := qs.Get(t.key); v != "" {
+			*t.dest, err = time.Parse(time.RFC3339, v)
+			if err != nil {
+				return filter, fmt.Errorf("%s must be an RFC 3339 time", t.key)
+			}
+		}
+	}
+
+	return filter, filter.Validate()
+}
+
+// auditList is the envelope returned by AuditLog.
+type auditList struct {
+	Entries  []*models.AuditEntry `json:"entries"`
+	Metadata repository.Metadata  `json:"metadata"`
+}
+
+// AuditLog lists the audit log, newest entries first, filtered by user_id,
+// entity, entity_id, action and the from/to time range.
+func (app *application) AuditLog(w http.ResponseWriter, r *http.Request) {
+	filter, err := app.readAuditFilter(r)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	entries, meta, err := app.DB.AuditEntries(r.Context(), filter)
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, auditList{Entries: entries, Metadata: meta})
+}
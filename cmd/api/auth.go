@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"log"
@@ -9,14 +11,17 @@ import (
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/snirkop89/go-movies/internal/models"
 )
 
 type auth struct {
 	Issuer        string `json:"issuer"`
 	Audience      string `json:"audience"`
-	Secret        string
+	Keys          *keySet
+	Leeway        time.Duration // clock skew tolerated on exp, nbf and iat
 	TokenExpiry   time.Duration
 	RefreshExpiry time.Duration
+	MFAExpiry     time.Duration
 	CookieDomain  string
 	CookiePath    string
 	CookieName    string
@@ -26,51 +31,110 @@ type jwtUser struct {
 	ID        int    `json:"id"`
 	FirstName string `json:"first_name"`
 	LastName  string `json:"last_name"`
+	Role      string `json:"role"`
 }
 
 type tokenPairs struct {
 	Token       string `json:"access_token"` // The actual JWT token
 	RefresToken string `json:"refresh_token"`
+
+	// Server side record of the refresh token, never sent to the client
+	refresh models.RefreshToken
 }
 
 type claims struct {
+	Name   string `json:"name,omitempty"`
+	Role   string `json:"role,omitempty"`
+	Type   string `json:"typ,omitempty"` // one of the tokenType constants
+	Family string `json:"fam,omitempty"` // Refresh token family
 	jwt.RegisteredClaims
+
+	// Set when the caller authenticated with an API key instead of a token
+	APIKeyID int      `json:"-"`
+	Scopes   []string `json:"-"`
 }
 
-func (a *auth) GenerateTokenPair(user *jwtUser) (tokenPairs, error) {
-	// Create a token
-	token := jwt.New(jwt.SigningMethodHS256)
+// Values of the typ claim, so that a refresh token can't be used as an
+// access token and the other way around.
+const (
+	tokenTypeAccess  = "access"
+	tokenTypeRefresh = "refresh"
+	tokenTypeMFA     = "mfa"  // proves the password was checked, see GenerateMFAToken
+	tokenTypeOIDC    = "oidc" // state of a single sign-on login, see OIDCLogin
+)
 
+var (
+	errTokenExpired     = errors.New("expired token")
+	errTokenNotValidYet = errors.New("token not valid yet")
+	errInvalidIssuer    = errors.New("invalid issuer")
+	errInvalidAudience  = errors.New("invalid audience")
+	errInvalidTokenType = errors.New("invalid token type")
+	errMissingSubject   = errors.New("token without subject")
+)
+
+// randomToken returns a URL safe random string built from n random bytes.
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// GenerateTokenPair creates an access token and a refresh token for user.
+// The refresh token joins the given family, or starts a new one if familyID
+// is empty.
+func (a *auth) GenerateTokenPair(user *jwtUser, familyID string) (tokenPairs, error) {
 	// Set the claims
-	claims := token.Claims.(jwt.MapClaims)
+	claims := jwt.MapClaims{}
 	claims["name"] = fmt.Sprintf("%s %s", user.FirstName, user.LastName)
 	claims["sub"] = fmt.Sprint(user.ID)
+	claims["role"] = user.Role
 	claims["aud"] = a.Audience
 	claims["iss"] = a.Issuer
 	claims["iat"] = time.Now().UTC().Unix()
-	claims["typ"] = "JWT"
+	claims["typ"] = tokenTypeAccess
 
 	// Set the expiry for JWT
 	claims["exp"] = time.Now().UTC().Add(a.TokenExpiry).Unix()
 
 	// Create a signed token
-	signedAccessToken, err := token.SignedString([]byte(a.Secret))
+	signedAccessToken, err := a.Keys.sign(claims)
 	if err != nil {
 		log.Println("signing access token: ", err)
 		return tokenPairs{}, err
 	}
 
+	// Identify the refresh token so it can be rotated and revoked
+	refreshID, err := randomToken(16)
+	if err != nil {
+		return tokenPairs{}, err
+	}
+	if familyID == "" {
+		familyID, err = randomToken(16)
+		if err != nil {
+			return tokenPairs{}, err
+		}
+	}
+
 	// Create a refresh token and set claims
-	refreshToken := jwt.New(jwt.SigningMethodHS256)
-	refreshTokenClaims := refreshToken.Claims.(jwt.MapClaims)
+	now := time.Now().UTC()
+	refreshExpiresAt := now.Add(a.RefreshExpiry)
+
+	refreshTokenClaims := jwt.MapClaims{}
 	refreshTokenClaims["sub"] = fmt.Sprint(user.ID)
-	refreshTokenClaims["iat"] = time.Now().UTC().Unix()
+	refreshTokenClaims["aud"] = a.Audience
+	refreshTokenClaims["iss"] = a.Issuer
+	refreshTokenClaims["jti"] = refreshID
+	refreshTokenClaims["fam"] = familyID
+	refreshTokenClaims["iat"] = now.Unix()
+	refreshTokenClaims["typ"] = tokenTypeRefresh
 
 	// Set the expiry for the refresh token
-	refreshTokenClaims["exp"] = time.Now().UTC().Add(a.RefreshExpiry).Unix()
+	refreshTokenClaims["exp"] = refreshExpiresAt.Unix()
 
 	// Create signed refresh token
-	signedRefreshToken, err := refreshToken.SignedString([]byte(a.Secret))
+	signedRefreshToken, err := a.Keys.sign(refreshTokenClaims)
 	if err != nil {
 		log.Println("signing refresh token: ", err)
 		return tokenPairs{}, err
@@ -80,12 +144,110 @@ func (a *auth) GenerateTokenPair(user *jwtUser) (tokenPairs, error) {
 	pair := tokenPairs{
 		Token:       signedAccessToken,
 		RefresToken: signedRefreshToken,
+		refresh: models.RefreshToken{
+			ID:        refreshID,
+			FamilyID:  familyID,
+			UserID:    user.ID,
+			ExpiresAt: refreshExpiresAt,
+			CreatedAt: now,
+		},
 	}
 
 	// Return TokenPairs
 	return pair, nil
 }
 
+// GenerateMFAToken creates the short lived token returned after the password
+// of a user with two-factor authentication was checked, to be exchanged with
+// a code for a token pair.
+func (a *auth) GenerateMFAToken(userID int) (string, error) {
+	now := time.Now().UTC()
+
+	claims := jwt.MapClaims{}
+	claims["sub"] = fmt.Sprint(userID)
+	claims["aud"] = a.Audience
+	claims["iss"] = a.Issuer
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(a.MFAExpiry).Unix()
+	claims["typ"] = tokenTypeMFA
+
+	return a.Keys.sign(claims)
+}
+
+// ValidateToken verifies the signature of token and checks that its
+// algorithm is one of the keys', that it was issued by and for us, that it is
+// within its validity window give or take the leeway, and that it is of the
+// expected type.
+func (a *auth) ValidateToken(token, tokenType string) (*claims, error) {
+	claims := &claims{}
+
+	err := a.validateInto(token, tokenType, claims)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Subject == "" {
+		return nil, errMissingSubject
+	}
+
+	return claims, nil
+}
+
+// tokenClaims is implemented by the claims types embedding claims.
+type tokenClaims interface {
+	jwt.Claims
+	base() *claims
+}
+
+func (c *claims) base() *claims {
+	return c
+}
+
+// validateInto is ValidateToken for tokens carrying claims of their own,
+// decoded into dst. It doesn't require a subject.
+func (a *auth) validateInto(token, tokenType string, dst tokenClaims) error {
+	// Time based claims are checked below, with the leeway
+	parser := jwt.NewParser(
+		jwt.WithValidMethods(a.Keys.algorithms()),
+		jwt.WithoutClaimsValidation(),
+	)
+	_, err := parser.ParseWithClaims(token, dst, a.Keys.keyFunc)
+	if err != nil {
+		return err
+	}
+
+	claims := dst.base()
+	now := time.Now()
+	switch {
+	case !claims.VerifyExpiresAt(now.Add(-a.Leeway), true):
+		return errTokenExpired
+	case !claims.VerifyNotBefore(now.Add(a.Leeway), false),
+		!claims.VerifyIssuedAt(now.Add(a.Leeway), false):
+		return errTokenNotValidYet
+	case !claims.VerifyIssuer(a.Issuer, true):
+		return errInvalidIssuer
+	case !claims.VerifyAudience(a.Audience, true):
+		return errInvalidAudience
+	case claims.Type != tokenType:
+		return errInvalidTokenType
+	}
+
+	return nil
+}
+
+// ParseRefreshToken verifies a refresh token and returns its claims.
+func (a *auth) ParseRefreshToken(token string) (*claims, error) {
+	claims, err := a.ValidateToken(token, tokenTypeRefresh)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.ID == "" || claims.Family == "" {
+		return nil, errors.New("refresh token without id")
+	}
+
+	return claims, nil
+}
+
 func (a *auth) GetRefreshCookie(refreshToken string) *http.Cookie {
 	return &http.Cookie{
 		Name:     a.CookieName,
@@ -137,25 +299,11 @@ func (a *auth) GetTokenFromHeaderAndVerify(w http.ResponseWriter, r *http.Reques
 	}
 
 	token := headerParts[1]
-	claims := &claims{}
 
-	// Parse the token
-	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
-		}
-		return []byte(a.Secret), nil
-	})
+	claims, err := a.ValidateToken(token, tokenTypeAccess)
 	if err != nil {
-		if errors.Is(err, jwt.ErrTokenExpired) {
-			return "", nil, errors.New("expired token")
-		}
 		return "", nil, err
 	}
 
-	if claims.Issuer != a.Issuer {
-		return "", nil, errors.New("invalid issuer")
-	}
-
 	return token, claims, nil
 }
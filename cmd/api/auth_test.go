@@ -0,0 +1,363 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func testAuth(keys *keySet) *auth {
+	return &auth{
+		Issuer:        "example.com",
+		Audience:      "example.com",
+		Keys:          keys,
+		Leeway:        30 * time.Second,
+		TokenExpiry:   15 * time.Minute,
+		RefreshExpiry: 24 * time.Hour,
+	}
+}
+
+// validClaims returns claims of an access token that passes validation.
+func validClaims() jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"sub": "1",
+		"iss": "example.com",
+		"aud": "example.com",
+		"typ": tokenTypeAccess,
+		"iat": now.Unix(),
+		"exp": now.Add(15 * time.Minute).Unix(),
+	}
+}
+
+func signWith(t *testing.T, method jwt.SigningMethod, key any, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestValidateToken(t *testing.T) {
+	hmacKeys := newHMACKeySet("verysecret")
+	secret := []byte("verysecret")
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edKey := &signingKey{ID: "ed", Method: jwt.SigningMethodEdDSA, Private: priv, Public: pub}
+	edKeys := &keySet{signing: edKey, keys: map[string]*signingKey{"ed": edKey}}
+
+	_, otherPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	with := func(k string, v any) jwt.MapClaims {
+		c := validClaims()
+		if v == nil {
+			delete(c, k)
+		} else {
+			c[k] = v
+		}
+		return c
+	}
+
+	tests := []struct {
+		name      string
+		keys      *keySet
+		token     func(t *testing.T) string
+		tokenType string
+		wantErr   bool
+	}{
+		{
+			name: "valid HS256 access token",
+			keys: hmacKeys,
+			token: func(t *testing.T) string {
+				return signWith(t, jwt.SigningMethodHS256, secret, "hs256", validClaims())
+			},
+			tokenType: tokenTypeAccess,
+		},
+		{
+			name: "valid EdDSA access token",
+			keys: edKeys,
+			token: func(t *testing.T) string {
+				return signWith(t, jwt.SigningMethodEdDSA, priv, "ed", validClaims())
+			},
+			tokenType: tokenTypeAccess,
+		},
+		{
+			name: "token without kid uses the signing key",
+			keys: hmacKeys,
+			token: func(t *testing.T) string {
+				return signWith(t, jwt.SigningMethodHS256, secret, "", validClaims())
+			},
+			tokenType: tokenTypeAccess,
+		},
+		{
+			name: "refresh token used as access token",
+			keys: hmacKeys,
+			token: func(t *testing.T) string {
+				return signWith(t, jwt.SigningMethodHS256, secret, "hs256", with("typ", tokenTypeRefresh))
+			},
+			tokenType: tokenTypeAccess,
+			wantErr:   true,
+		},
+		{
+			name: "access token used as refresh token",
+			keys: hmacKeys,
+			token: func(t *testing.T) string {
+				return signWith(t, jwt.SigningMethodHS256, secret, "hs256", validClaims())
+			},
+			tokenType: tokenTypeRefresh,
+			wantErr:   true,
+		},
+		{
+			name: "missing type",
+			keys: hmacKeys,
+			token: func(t *testing.T) string {
+				return signWith(t, jwt.SigningMethodHS256, secret, "hs256", with("typ", nil))
+			},
+			tokenType: tokenTypeAccess,
+			wantErr:   true,
+		},
+		{
+			name: "wrong issuer",
+			keys: hmacKeys,
+			token: func(t *testing.T) string {
+				return signWith(t, jwt.SigningMethodHS256, secret, "hs256", with("iss", "evil.com"))
+			},
+			tokenType: tokenTypeAccess,
+			wantErr:   true,
+		},
+		{
+			name: "missing issuer",
+			keys: hmacKeys,
+			token: func(t *testing.T) string {
+				return signWith(t, jwt.SigningMethodHS256, secret, "hs256", with("iss", nil))
+			},
+			tokenType: tokenTypeAccess,
+			wantErr:   true,
+		},
+		{
+			name: "wrong audience",
+			keys: hmacKeys,
+			token: func(t *testing.T) string {
+				return signWith(t, jwt.SigningMethodHS256, secret, "hs256", with("aud", "other.com"))
+			},
+			tokenType: tokenTypeAccess,
+			wantErr:   true,
+		},
+		{
+			name: "audience list containing us",
+			keys: hmacKeys,
+			token: func(t *testing.T) string {
+				return signWith(t, jwt.SigningMethodHS256, secret, "hs256", with("aud", []string{"other.com", "example.com"}))
+			},
+			tokenType: tokenTypeAccess,
+		},
+		{
+			name: "missing audience",
+			keys: hmacKeys,
+			token: func(t *testing.T) string {
+				return signWith(t, jwt.SigningMethodHS256, secret, "hs256", with("aud", nil))
+			},
+			tokenType: tokenTypeAccess,
+			wantErr:   true,
+		},
+		{
+			name: "missing subject",
+			keys: hmacKeys,
+			token: func(t *testing.T) string {
+				return signWith(t, jwt.SigningMethodHS256, secret, "hs256", with("sub", nil))
+			},
+			tokenType: tokenTypeAccess,
+			wantErr:   true,
+		},
+		{
+			name: "expired",
+			keys: hmacKeys,
+			token: func(t *testing.T) string {
+				return signWith(t, jwt.SigningMethodHS256, secret, "hs256", with("exp", time.Now().Add(-time.Minute).Unix()))
+			},
+			tokenType: tokenTypeAccess,
+			wantErr:   true,
+		},
+		{
+			name: "expired within the leeway",
+			keys: hmacKeys,
+			token: func(t *testing.T) string {
+				return signWith(t, jwt.SigningMethodHS256, secret, "hs256", with("exp", time.Now().Add(-10*time.Second).Unix()))
+			},
+			tokenType: tokenTypeAccess,
+		},
+		{
+			name: "missing expiry",
+			keys: hmacKeys,
+			token: func(t *testing.T) string {
+				return signWith(t, jwt.SigningMethodHS256, secret, "hs256", with("exp", nil))
+			},
+			tokenType: tokenTypeAccess,
+			wantErr:   true,
+		},
+		{
+			name: "not valid yet",
+			keys: hmacKeys,
+			token: func(t *testing.T) string {
+				return signWith(t, jwt.SigningMethodHS256, secret, "hs256", with("nbf", time.Now().Add(time.Minute).Unix()))
+			},
+			tokenType: tokenTypeAccess,
+			wantErr:   true,
+		},
+		{
+			name: "issued in the future",
+			keys: hmacKeys,
+			token: func(t *testing.T) string {
+				return signWith(t, jwt.SigningMethodHS256, secret, "hs256", with("iat", time.Now().Add(time.Minute).Unix()))
+			},
+			tokenType: tokenTypeAccess,
+			wantErr:   true,
+		},
+		{
+			name: "issued in the future within the leeway",
+			keys: hmacKeys,
+			token: func(t *testing.T) string {
+				return signWith(t, jwt.SigningMethodHS256, secret, "hs256", with("iat", time.Now().Add(10*time.Second).Unix()))
+			},
+			tokenType: tokenTypeAccess,
+		},
+		{
+			name: "wrong secret",
+			keys: hmacKeys,
+			token: func(t *testing.T) string {
+				return signWith(t, jwt.SigningMethodHS256, []byte("guessed"), "hs256", validClaims())
+			},
+			tokenType: tokenTypeAccess,
+			wantErr:   true,
+		},
+		{
+			name: "signed by another key",
+			keys: edKeys,
+			token: func(t *testing.T) string {
+				return signWith(t, jwt.SigningMethodEdDSA, otherPriv, "ed", validClaims())
+			},
+			tokenType: tokenTypeAccess,
+			wantErr:   true,
+		},
+		{
+			name: "unknown kid",
+			keys: edKeys,
+			token: func(t *testing.T) string {
+				return signWith(t, jwt.SigningMethodEdDSA, priv, "nope", validClaims())
+			},
+			tokenType: tokenTypeAccess,
+			wantErr:   true,
+		},
+		{
+			name: "HS256 signed with the public key",
+			keys: edKeys,
+			token: func(t *testing.T) string {
+				return signWith(t, jwt.SigningMethodHS256, []byte(pub), "ed", validClaims())
+			},
+			tokenType: tokenTypeAccess,
+			wantErr:   true,
+		},
+		{
+			name: "algorithm not allowed",
+			keys: hmacKeys,
+			token: func(t *testing.T) string {
+				return signWith(t, jwt.SigningMethodHS512, secret, "hs256", validClaims())
+			},
+			tokenType: tokenTypeAccess,
+			wantErr:   true,
+		},
+		{
+			name: "alg none",
+			keys: hmacKeys,
+			token: func(t *testing.T) string {
+				return signWith(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "hs256", validClaims())
+			},
+			tokenType: tokenTypeAccess,
+			wantErr:   true,
+		},
+		{
+			name: "tampered payload",
+			keys: hmacKeys,
+			token: func(t *testing.T) string {
+				good := signWith(t, jwt.SigningMethodHS256, secret, "hs256", validClaims())
+				forged := signWith(t, jwt.SigningMethodHS256, []byte("guessed"), "hs256", with("sub", "2"))
+				return forged[:len(forged)-43] + good[len(good)-43:]
+			},
+			tokenType: tokenTypeAccess,
+			wantErr:   true,
+		},
+		{
+			name: "malformed",
+			keys: hmacKeys,
+			token: func(t *testing.T) string {
+				return "not.a.token"
+			},
+			tokenType: tokenTypeAccess,
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := testAuth(tt.keys)
+
+			claims, err := a.ValidateToken(tt.token(t), tt.tokenType)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if claims.Subject != "1" {
+				t.Errorf("expected subject 1, got %q", claims.Subject)
+			}
+		})
+	}
+}
+
+func TestGeneratedTokenPair(t *testing.T) {
+	a := testAuth(newHMACKeySet("verysecret"))
+
+	pair, err := a.GenerateTokenPair(&jwtUser{ID: 1, FirstName: "Admin", LastName: "User", Role: "admin"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.ValidateToken(pair.Token, tokenTypeAccess); err != nil {
+		t.Errorf("access token: %v", err)
+	}
+	if _, err := a.ParseRefreshToken(pair.RefresToken); err != nil {
+		t.Errorf("refresh token: %v", err)
+	}
+
+	if _, err := a.ValidateToken(pair.RefresToken, tokenTypeAccess); err == nil {
+		t.Error("refresh token accepted as an access token")
+	}
+	if _, err := a.ParseRefreshToken(pair.Token); err == nil {
+		t.Error("access token accepted as a refresh token")
+	}
+
+	other := testAuth(newHMACKeySet("verysecret"))
+	other.Audience = "other.com"
+	if _, err := other.ValidateToken(pair.Token, tokenTypeAccess); err == nil {
+		t.Error("access token accepted by another audience")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/snirkop89/go-movies/internal/graph"
+	"github.com/snirkop89/go-movies/internal/models"
+	"github.com/snirkop89/go-movies/internal/repository"
+)
+
+// graphQLRequest is the JSON envelope of GraphQL-over-HTTP requests.
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+	Extensions    map[string]interface{} `json:"extensions"`
+}
+
+// moviesGraphQL serves GraphQL over HTTP. Queries can be sent with GET and
+// the query, variables and operationName parameters, or with POST as the JSON
+// envelope. A bare query with the application/graphql content type is still
+// accepted, as older clients send it.
+func (app *application) moviesGraphQL(w http.ResponseWriter, r *http.Request) {
+	gr, status, err := app.readGraphQLRequest(w, r)
+	if err != nil {
+		app.graphQLErrorJSON(w, err, status)
+		return
+	}
+
+	req := graph.Request{
+		Query:         gr.Query,
+		Variables:     gr.Variables,
+		OperationName: gr.OperationName,
+		Caller:        app.graphCaller(r),
+		Record: func(tx repository.DatabaseRepo, c graph.Change) error {
+			return app.recordGraphChange(r, tx, c)
+		},
+	}
+
+	// GET must be safe, mutations have to be posted
+	if r.Method == http.MethodGet && req.IsMutation() {
+		w.Header().Set("Allow", http.MethodPost)
+		app.graphQLErrorJSON(w, errors.New("mutations must be sent with POST"), http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Errors of the query and of its fields are part of the result
+	resp := app.Graph.Query(r.Context(), req)
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// readGraphQLRequest reads the request from the query string or the body. On
+// error it returns the status to answer with.
+func (app *application) readGraphQLRequest(w http.ResponseWriter, r *http.Request) (*graphQLRequest, int, error) {
+	var gr graphQLRequest
+
+	if r.Method == http.MethodGet {
+		qs := r.URL.Query()
+		gr.Query = qs.Get("query")
+		gr.OperationName = qs.Get("operationName")
+		if v := qs.Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &gr.Variables); err != nil {
+				return nil, http.StatusBadRequest, errors.New("variables must be a JSON object")
+			}
+		}
+	} else {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch mediaType {
+		case "application/json":
+			if err := app.readJSON(w, r, &gr); err != nil {
+				return nil, http.StatusBadRequest, err
+			}
+		case "application/graphql":
+			r.Body = http.MaxBytesReader(w, r.Body, 1024*1024)
+			q, err := io.ReadAll(r.Body)
+			if err != nil {
+				return nil, http.StatusBadRequest, err
+			}
+			gr.Query = string(q)
+		default:
+			return nil, http.StatusUnsupportedMediaType, errors.New("content type must be application/json")
+		}
+	}
+
+	if strings.TrimSpace(gr.Query) == "" {
+		return nil, http.StatusBadRequest, errors.New("query is required")
+	}
+
+	return &gr, 0, nil
+}
+
+// graphQLErrorJSON writes an error that kept the request from running, in
+// the errors array of a GraphQL response.
+func (app *application) graphQLErrorJSON(w http.ResponseWriter, err error, status int) error {
+	payload := map[string]any{
+		"errors": []map[string]string{{"message": err.Error()}},
+	}
+	return app.writeJSON(w, status, payload)
+}
+
+// graphCaller returns the caller authenticated by authOptional, or nil.
+func (app *application) graphCaller(r *http.Request) *graph.Caller {
+	claims := app.claimsFromContext(r)
+	if claims == nil {
+		return nil
+	}
+
+	id, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return nil
+	}
+
+	return &graph.Caller{
+		UserID: id,
+		Role:   claims.Role,
+		APIKey: claims.APIKeyID != 0,
+		Scopes: claims.Scopes,
+	}
+}
+
+// recordGraphChange keeps the audit log and the movie revisions of the
+// GraphQL mutations, as the REST handlers do.
+func (app *application) recordGraphChange(r *http.Request, tx repository.DatabaseRepo, c graph.Change) error {
+	if after, ok := c.After.(*models.Movie); ok {
+		if before, ok := c.Before.(*models.Movie); ok {
+			if err := app.saveBaseRevision(r.Context(), tx, before); err != nil {
+				return err
+			}
+		}
+		if _, err := app.saveRevision(r, tx, after, 0); err != nil {
+			return err
+		}
+	}
+
+	return app.audit(r, tx, auditEvent{
+		Action:   c.Action,
+		Entity:   c.Entity,
+		EntityID: strconv.Itoa(c.EntityID),
+		Before:   c.Before,
+		After:    c.After,
+	})
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,12 +11,12 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/golang-jwt/jwt/v4"
-	"github.com/snirkop89/go-movies/internal/graph"
 	"github.com/snirkop89/go-movies/internal/models"
+	"github.com/snirkop89/go-movies/internal/repository"
 )
 
 func (app *application) Home(w http.ResponseWriter, r *http.Request) {
@@ -31,15 +33,93 @@ func (app *application) Home(w http.ResponseWriter, r *http.Request) {
 	app.writeJSON(w, http.StatusOK, payload)
 }
 
-func (app *application) AllMovies(w http.ResponseWriter, r *http.Request) {
-	movies, err := app.DB.AllMovies()
+const (
+	defaultPerPage = 20
+	maxPerPage     = 100
+)
+
+// movieList is the envelope returned by the movie listing endpoints.
+type movieList struct {
+	Movies   []*models.Movie     `json:"movies"`
+	Metadata repository.Metadata `json:"metadata"`
+}
+
+// readMovieFilter builds a movie filter from the query string.
+func (app *application) readMovieFilter(r *http.Request) (repository.MovieFilter, error) {
+	qs := r.URL.Query()
+
+	var filter repository.MovieFilter
+	var err error
+
+	ints := []struct {
+		key  string
+		dest *int
+		def  int
+	}{
+		{"page", &filter.Page, 1},
+		{"per_page", &filter.PerPage, defaultPerPage},
+		{"year_from", &filter.YearFrom, 0},
+		{"year_to", &filter.YearTo, 0},
+		{"runtime_min", &filter.RuntimeMin, 0},
+		{"runtime_max", &filter.RuntimeMax, 0},
+	}
+	for _, i := range ints {
+		*i.dest, err = app.readInt(qs, i.key, i.def)
+		if err != nil {
+			return filter, err
+		}
+	}
+
+	if filter.Page < 1 {
+		return filter, errors.New("page must be greater than zero")
+	}
+	if filter.PerPage < 1 || filter.PerPage > maxPerPage {
+		return filter, fmt.Errorf("per_page must be between 1 and %d", maxPerPage)
+	}
+
+	filter.After = qs.Get("after")
+	filter.Sort = qs.Get("sort")
+	filter.MPAARatings = app.readCSV(qs, "mpaa_rating")
+
+	for _, g := range app.readCSV(qs, "genres") {
+		id, err := strconv.Atoi(g)
+		if err != nil {
+			return filter, errors.New("genres must be a list of genre ids")
+		}
+		filter.Genres = append(filter.Genres, id)
+	}
+
+	return filter, filter.Validate()
+}
+
+// listMovies writes the page of movies matching filter.
+func (app *application) listMovies(w http.ResponseWriter, r *http.Request, filter repository.MovieFilter) {
+	movies, meta, err := app.DB.AllMovies(r.Context(), filter)
 	if err != nil {
+		if errors.Is(err, repository.ErrInvalidCursor) {
+			app.errorJSON(w, err)
+			return
+		}
 		log.Println(err)
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if movies == nil {
+		movies = []*models.Movie{}
+	}
+
+	app.writeJSON(w, http.StatusOK, movieList{Movies: movies, Metadata: meta})
+}
+
+func (app *application) AllMovies(w http.ResponseWriter, r *http.Request) {
+	filter, err := app.readMovieFilter(r)
+	if err != nil {
 		app.errorJSON(w, err)
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, movies)
+	app.listMovies(w, r, filter)
 }
 
 func (app *application) AllMoviesByGenre(w http.ResponseWriter, r *http.Request) {
@@ -49,13 +129,53 @@ func (app *application) AllMoviesByGenre(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	movies, err := app.DB.AllMovies(id)
+	filter, err := app.readMovieFilter(r)
 	if err != nil {
 		app.errorJSON(w, err)
 		return
 	}
+	filter.Genre = id
 
-	app.writeJSON(w, http.StatusOK, movies)
+	app.listMovies(w, r, filter)
+}
+
+// SearchMovies runs a full-text search over the movies titles and descriptions.
+func (app *application) SearchMovies(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	query := qs.Get("q")
+	if query == "" {
+		app.errorJSON(w, errors.New("missing search query"))
+		return
+	}
+
+	limit, err := app.readInt(qs, "limit", defaultPerPage)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+	if limit < 1 || limit > maxPerPage {
+		app.errorJSON(w, fmt.Errorf("limit must be between 1 and %d", maxPerPage))
+		return
+	}
+
+	results, err := app.DB.SearchMovies(r.Context(), query, limit)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if results == nil {
+		results = []*models.MovieSearchResult{}
+	}
+
+	var payload = struct {
+		Results []*models.MovieSearchResult `json:"results"`
+	}{
+		results,
+	}
+
+	app.writeJSON(w, http.StatusOK, payload)
 }
 
 func (app *application) authenticate(w http.ResponseWriter, r *http.Request) {
@@ -70,102 +190,216 @@ func (app *application) authenticate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Validate user against database
-	user, err := app.DB.UserByEmail(requestPayload.Email)
-	if err != nil {
-		app.errorJSON(w, errors.New("invalid credentials"), http.StatusUnauthorized)
+	email := models.NormalizeEmail(requestPayload.Email)
+	ip := clientIP(r)
+
+	// Refuse attempts while the account or the client is throttled
+	if app.loginBlocked(w, r, email, ip) {
 		return
 	}
 
+	// Validate user against database. Unknown emails are checked against a
+	// dummy user, so that they can't be told apart by the response time.
+	user, err := app.DB.UserByEmail(r.Context(), email)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			app.dbErrorJSON(w, err)
+			return
+		}
+		user = &dummyUser
+	}
+
 	// Validate password
 	valid, err := user.PasswordMatches(requestPayload.Password)
-	if err != nil || !valid {
+	if err != nil || !valid || user == &dummyUser {
+		app.loginFailed(r, email, ip)
 		app.errorJSON(w, errors.New("invalid credentials"), http.StatusUnauthorized)
 		return
 	}
 
+	err = app.DB.ClearLoginAttempts(r.Context(), accountLoginKey(email))
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	// The plaintext is only known now, upgrade the hash if needed
+	if user.PasswordNeedsRehash() {
+		app.rehashPassword(r, user, requestPayload.Password)
+	}
+
+	// A code is still required, see authenticateMFA
+	if user.TOTPEnabled {
+		token, err := app.auth.GenerateMFAToken(user.ID)
+		if err != nil {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		app.writeJSON(w, http.StatusAccepted, mfaChallenge{MFARequired: true, Token: token})
+		return
+	}
+
+	app.auditLog(r, auditEvent{Action: "login", Entity: "user", EntityID: strconv.Itoa(user.ID), UserID: user.ID})
+
+	app.startSession(w, r, user)
+}
+
+// startSession issues a token pair to an authenticated user, setting the
+// refresh token cookie.
+func (app *application) startSession(w http.ResponseWriter, r *http.Request, user *models.User) {
+	tokens, err := app.newSession(r.Context(), user)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	refreshCookie := app.auth.GetRefreshCookie(tokens.RefresToken)
+	http.SetCookie(w, refreshCookie)
+
+	app.writeJSON(w, http.StatusAccepted, tokens)
+}
+
+// newSession generates a token pair for user, starting a new refresh token
+// family, and records the refresh token.
+func (app *application) newSession(ctx context.Context, user *models.User) (tokenPairs, error) {
 	// Create a jwt user
 	u := jwtUser{
 		ID:        user.ID,
 		FirstName: user.FirstName,
 		LastName:  user.LastName,
+		Role:      user.Role,
 	}
 
-	// Generate tokens
-	tokens, err := app.auth.GenerateTokenPair(&u)
+	tokens, err := app.auth.GenerateTokenPair(&u, "")
 	if err != nil {
-		app.errorJSON(w, err)
-		return
+		return tokenPairs{}, err
 	}
 
-	refreshCookie := app.auth.GetRefreshCookie(tokens.RefresToken)
-	http.SetCookie(w, refreshCookie)
+	err = app.DB.InsertRefreshToken(ctx, tokens.refresh)
+	if err != nil {
+		return tokenPairs{}, err
+	}
 
-	app.writeJSON(w, http.StatusAccepted, tokens)
+	return tokens, nil
 }
 
+// refreshToken exchanges the refresh token cookie for a new token pair.
+// Refresh tokens are single use: the presented token is rotated, and
+// presenting a token that was already rotated or revoked revokes its whole
+// family, logging out whoever holds the current token of that family.
 func (app *application) refreshToken(w http.ResponseWriter, r *http.Request) {
-	for _, c := range r.Cookies() {
-		if c.Name == app.auth.CookieName {
-			claims := &claims{}
-			refreshToken := c.Value
-
-			// Parse the token to get the claims
-			_, err := jwt.ParseWithClaims(refreshToken, claims, func(toekn *jwt.Token) (any, error) {
-				return []byte(app.JWTSecret), nil
-			})
-			if err != nil {
-				app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
-				return
-			}
+	cookie, err := r.Cookie(app.auth.CookieName)
+	if err != nil {
+		app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
 
-			// Get the user id from the token claims
-			userID, err := strconv.Atoi(claims.Subject)
-			if err != nil {
-				app.errorJSON(w, errors.New("unknown user"), http.StatusUnauthorized)
-				return
-			}
+	// Parse the token to get the claims
+	claims, err := app.auth.ParseRefreshToken(cookie.Value)
+	if err != nil {
+		app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
 
-			user, err := app.DB.UserByID(userID)
-			if err != nil {
-				app.errorJSON(w, errors.New("unknown user"), http.StatusUnauthorized)
-				return
-			}
+	stored, err := app.DB.RefreshTokenByID(r.Context(), claims.ID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+			return
+		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
 
-			u := jwtUser{
-				ID:        user.ID,
-				FirstName: user.FirstName,
-				LastName:  user.LastName,
-			}
+	if stored.RevokedAt != nil {
+		app.refreshTokenReused(w, r, stored)
+		return
+	}
 
-			pair, err := app.auth.GenerateTokenPair(&u)
-			if err != nil {
-				app.errorJSON(w, errors.New("error generating tokens"), http.StatusInternalServerError)
-				return
-			}
+	user, err := app.DB.UserByID(r.Context(), stored.UserID)
+	if err != nil {
+		app.errorJSON(w, errors.New("unknown user"), http.StatusUnauthorized)
+		return
+	}
 
-			http.SetCookie(w, app.auth.GetRefreshCookie(pair.RefresToken))
+	u := jwtUser{
+		ID:        user.ID,
+		FirstName: user.FirstName,
+		LastName:  user.LastName,
+		Role:      user.Role,
+	}
 
-			app.writeJSON(w, http.StatusOK, pair)
+	pair, err := app.auth.GenerateTokenPair(&u, stored.FamilyID)
+	if err != nil {
+		app.errorJSON(w, errors.New("error generating tokens"), http.StatusInternalServerError)
+		return
+	}
 
+	err = app.DB.RotateRefreshToken(r.Context(), stored.ID, pair.refresh)
+	if err != nil {
+		if errors.Is(err, repository.ErrTokenReused) {
+			// Someone else used the same token at the same time
+			app.refreshTokenReused(w, r, stored)
+			return
 		}
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, app.auth.GetRefreshCookie(pair.RefresToken))
+
+	app.writeJSON(w, http.StatusOK, pair)
+}
+
+// refreshTokenReused revokes the family of a refresh token that was used
+// more than once, as it has most likely been stolen.
+func (app *application) refreshTokenReused(w http.ResponseWriter, r *http.Request, token *models.RefreshToken) {
+	app.auditLog(r, auditEvent{
+		Action:   "refresh_token.reuse",
+		Entity:   "user",
+		EntityID: strconv.Itoa(token.UserID),
+		UserID:   token.UserID,
+	})
+
+	err := app.DB.RevokeRefreshTokenFamily(r.Context(), token.FamilyID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
 	}
+
+	http.SetCookie(w, app.auth.GetExpiredRefreshCookie())
+	app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
 }
 
+// logout revokes the session of the refresh token cookie and clears it.
 func (app *application) logout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(app.auth.CookieName); err == nil {
+		if claims, err := app.auth.ParseRefreshToken(cookie.Value); err == nil {
+			err = app.DB.RevokeRefreshTokenFamily(r.Context(), claims.Family)
+			if err != nil {
+				app.errorJSON(w, err, http.StatusInternalServerError)
+				return
+			}
+
+			if id, err := strconv.Atoi(claims.Subject); err == nil {
+				app.auditLog(r, auditEvent{Action: "logout", Entity: "user", EntityID: claims.Subject, UserID: id})
+			}
+		}
+	}
+
 	http.SetCookie(w, app.auth.GetExpiredRefreshCookie())
 	w.WriteHeader(http.StatusAccepted)
 }
 
 func (app *application) MovieCatalog(w http.ResponseWriter, r *http.Request) {
-	movies, err := app.DB.AllMovies()
+	filter, err := app.readMovieFilter(r)
 	if err != nil {
-		log.Println(err)
 		app.errorJSON(w, err)
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, movies)
+	app.listMovies(w, r, filter)
 }
 
 func (app *application) GetMovie(w http.ResponseWriter, r *http.Request) {
@@ -176,9 +410,10 @@ func (app *application) GetMovie(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	movie, err := app.DB.OneMovie(movieID)
+	movie, err := app.DB.OneMovie(r.Context(), movieID)
 	if err != nil {
-		app.errorJSON(w, err, http.StatusInternalServerError)
+		app.dbErrorJSON(w, err)
+		return
 	}
 
 	app.writeJSON(w, http.StatusOK, movie)
@@ -192,26 +427,51 @@ func (app *application) EditMovie(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	movie, genres, err := app.DB.EditMovie(movieID)
+	movie, genres, err := app.DB.EditMovie(r.Context(), movieID)
 	if err != nil {
 		app.errorJSON(w, err)
 		return
 	}
 
-	var payload = struct {
-		Movie  *models.Movie   `json:"movie"`
-		Genres []*models.Genre `json:"genres"`
-	}{
+	var payload = editMoviePayload{
 		movie,
 		genres,
 	}
 
-	app.writeJSON(w, http.StatusOK, payload)
+	app.writeJSON(w, http.StatusOK, payload, http.Header{"ETag": {movieETag(movie)}})
+
+}
+
+// editMoviePayload is the movie sent to the edit form, with every genre.
+type editMoviePayload struct {
+	Movie  *models.Movie   `json:"movie"`
+	Genres []*models.Genre `json:"genres"`
+}
 
+// movieETag returns the entity tag of a movie, its quoted version.
+func movieETag(movie *models.Movie) string {
+	return strconv.Quote(strconv.Itoa(movie.Version))
+}
+
+// movieConflictJSON answers an update based on a stale version of a movie
+// with 412 and the movie as currently stored, so the editor can merge.
+func (app *application) movieConflictJSON(w http.ResponseWriter, r *http.Request, id int) {
+	movie, genres, err := app.DB.EditMovie(r.Context(), id)
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   true,
+		Message: "the movie was changed since it was loaded",
+		Data:    editMoviePayload{movie, genres},
+	}
+	app.writeJSON(w, http.StatusPreconditionFailed, resp, http.Header{"ETag": {movieETag(movie)}})
 }
 
 func (app *application) AllGenres(w http.ResponseWriter, r *http.Request) {
-	genres, err := app.DB.AllGenres()
+	genres, err := app.DB.AllGenres(r.Context())
 	if err != nil {
 		app.errorJSON(w, err, http.StatusInternalServerError)
 		return
@@ -219,6 +479,234 @@ func (app *application) AllGenres(w http.ResponseWriter, r *http.Request) {
 	app.writeJSON(w, http.StatusOK, genres)
 }
 
+// readGenreName reads and validates the name of a genre from the request body.
+func (app *application) readGenreName(w http.ResponseWriter, r *http.Request) (string, error) {
+	var payload struct {
+		Genre string `json:"genre"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		return "", err
+	}
+
+	name := strings.TrimSpace(payload.Genre)
+	switch {
+	case name == "":
+		return "", errors.New("genre must be provided")
+	case len(name) > 255:
+		return "", errors.New("genre must not be more than 255 bytes long")
+	}
+
+	return name, nil
+}
+
+func (app *application) insertGenre(w http.ResponseWriter, r *http.Request) {
+	name, err := app.readGenreName(w, r)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	genre := models.Genre{
+		Genre:     name,
+		CreatedAt: time.Now(),
+		UpdateAt:  time.Now(),
+	}
+
+	err = app.DB.WithTx(r.Context(), func(tx repository.DatabaseRepo) error {
+		genre.ID, err = tx.InsertGenre(r.Context(), genre)
+		if err != nil {
+			return err
+		}
+
+		return app.audit(r, tx, auditEvent{
+			Action:   "create",
+			Entity:   "genre",
+			EntityID: strconv.Itoa(genre.ID),
+			After:    genre,
+		})
+	})
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "genre created",
+		Data:    genre,
+	}
+	app.writeJSON(w, http.StatusCreated, resp)
+}
+
+func (app *application) UpdateGenre(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	name, err := app.readGenreName(w, r)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	genre := models.Genre{
+		ID:       id,
+		Genre:    name,
+		UpdateAt: time.Now(),
+	}
+
+	err = app.DB.WithTx(r.Context(), func(tx repository.DatabaseRepo) error {
+		before, err := tx.OneGenre(r.Context(), id)
+		if err != nil {
+			return err
+		}
+
+		err = tx.UpdateGenre(r.Context(), genre)
+		if err != nil {
+			return err
+		}
+
+		return app.audit(r, tx, auditEvent{
+			Action:   "update",
+			Entity:   "genre",
+			EntityID: strconv.Itoa(id),
+			Before:   before,
+			After:    genre,
+		})
+	})
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "genre updated",
+	}
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
+// MergeGenres moves the movies of a genre to another one and deletes it.
+func (app *application) MergeGenres(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	var payload struct {
+		Into int `json:"into"`
+	}
+	err = app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+	if payload.Into == 0 || payload.Into == id {
+		app.errorJSON(w, errors.New("into must be the id of another genre"))
+		return
+	}
+
+	err = app.DB.WithTx(r.Context(), func(tx repository.DatabaseRepo) error {
+		before, err := tx.OneGenre(r.Context(), id)
+		if err != nil {
+			return err
+		}
+
+		err = tx.MergeGenres(r.Context(), id, payload.Into)
+		if err != nil {
+			return err
+		}
+
+		return app.audit(r, tx, auditEvent{
+			Action:   "merge",
+			Entity:   "genre",
+			EntityID: strconv.Itoa(id),
+			Before:   before,
+			After:    map[string]int{"merged_into": payload.Into},
+		})
+	})
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "genres merged",
+	}
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
+// DeleteGenre deletes a genre. A genre still used by movies can only be
+// deleted with reassign_to, which moves its movies to another genre, or
+// force, which detaches them.
+func (app *application) DeleteGenre(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	qs := r.URL.Query()
+
+	reassignTo, err := app.readInt(qs, "reassign_to", 0)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+	if reassignTo == id {
+		app.errorJSON(w, errors.New("reassign_to must be the id of another genre"))
+		return
+	}
+
+	force := false
+	if v := qs.Get("force"); v != "" {
+		force, err = strconv.ParseBool(v)
+		if err != nil {
+			app.errorJSON(w, errors.New("force must be a boolean value"))
+			return
+		}
+	}
+
+	err = app.DB.WithTx(r.Context(), func(tx repository.DatabaseRepo) error {
+		before, err := tx.OneGenre(r.Context(), id)
+		if err != nil {
+			return err
+		}
+
+		err = tx.DeleteGenre(r.Context(), id, reassignTo, force)
+		if err != nil {
+			return err
+		}
+
+		return app.audit(r, tx, auditEvent{
+			Action:   "delete",
+			Entity:   "genre",
+			EntityID: strconv.Itoa(id),
+			Before:   before,
+		})
+	})
+	if err != nil {
+		if errors.Is(err, repository.ErrGenreInUse) {
+			app.errorJSON(w, errors.New("genre is used by movies, set reassign_to or force"), http.StatusConflict)
+			return
+		}
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "genre deleted",
+	}
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
 func (app *application) insertMovie(w http.ResponseWriter, r *http.Request) {
 	var movie models.Movie
 
@@ -233,14 +721,35 @@ func (app *application) insertMovie(w http.ResponseWriter, r *http.Request) {
 	movie.CreatedAt = time.Now()
 	movie.UpdateAt = time.Now()
 
-	newID, err := app.DB.InsertMovie(movie)
-	if err != nil {
-		app.errorJSON(w, err)
-		return
-	}
+	// Save the movie and its genres atomically
+	err = app.DB.WithTx(r.Context(), func(tx repository.DatabaseRepo) error {
+		newID, err := tx.InsertMovie(r.Context(), movie)
+		if err != nil {
+			return err
+		}
 
-	// Now handle genres
-	err = app.DB.UpdateMovieGenres(newID, movie.GenresArray)
+		err = tx.UpdateMovieGenres(r.Context(), newID, movie.GenresArray)
+		if err != nil {
+			return err
+		}
+
+		after, err := tx.OneMovie(r.Context(), newID)
+		if err != nil {
+			return err
+		}
+
+		_, err = app.saveRevision(r, tx, after, 0)
+		if err != nil {
+			return err
+		}
+
+		return app.audit(r, tx, auditEvent{
+			Action:   "create",
+			Entity:   "movie",
+			EntityID: strconv.Itoa(newID),
+			After:    after,
+		})
+	})
 	if err != nil {
 		app.errorJSON(w, err)
 		return
@@ -299,37 +808,96 @@ func (app *application) getPoster(movie models.Movie) models.Movie {
 	return movie
 }
 
+// UpdateMovie saves an edited movie. The If-Match header must carry the ETag
+// of the movie as loaded for editing, so that concurrent edits don't silently
+// overwrite each other.
 func (app *application) UpdateMovie(w http.ResponseWriter, r *http.Request) {
-	var payload models.Movie
-
-	err := app.readJSON(w, r, &payload)
-	if err != nil {
-		app.errorJSON(w, err)
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		app.errorJSON(w, errors.New("If-Match header is required"), http.StatusPreconditionRequired)
 		return
 	}
 
-	movie, err := app.DB.OneMovie(payload.ID)
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
 		app.errorJSON(w, err)
 		return
 	}
 
-	movie.Title = payload.Title
-	movie.ReleaseDate = payload.ReleaseDate
-	movie.Description = payload.Description
-	movie.MPAARating = payload.MPAARating
-	movie.Runtime = payload.Runtime
-	movie.UpdateAt = time.Now()
+	var payload models.Movie
 
-	err = app.DB.UpdateMovie(*movie)
+	err = app.readJSON(w, r, &payload)
 	if err != nil {
 		app.errorJSON(w, err)
 		return
 	}
+	if payload.ID != 0 && payload.ID != id {
+		app.errorJSON(w, errors.New("the id of the movie doesn't match the URL"))
+		return
+	}
+
+	var updated *models.Movie
+
+	// Save the movie and its genres atomically
+	err = app.DB.WithTx(r.Context(), func(tx repository.DatabaseRepo) error {
+		movie, err := tx.OneMovie(r.Context(), id)
+		if err != nil {
+			return err
+		}
+		if !etagMatches(ifMatch, movieETag(movie)) {
+			return repository.ErrEditConflict
+		}
+		before := *movie
+
+		movie.Title = payload.Title
+		movie.ReleaseDate = payload.ReleaseDate
+		movie.Description = payload.Description
+		movie.MPAARating = payload.MPAARating
+		movie.Runtime = payload.Runtime
+		movie.UpdateAt = time.Now()
+
+		// Updating locks the movie, so that concurrent first edits don't
+		// both save the base revision
+		err = tx.UpdateMovie(r.Context(), *movie)
+		if err != nil {
+			return err
+		}
+
+		err = app.saveBaseRevision(r.Context(), tx, &before)
+		if err != nil {
+			return err
+		}
+
+		err = tx.UpdateMovieGenres(r.Context(), movie.ID, payload.GenresArray)
+		if err != nil {
+			return err
+		}
 
-	err = app.DB.UpdateMovieGenres(movie.ID, payload.GenresArray)
+		after, err := tx.OneMovie(r.Context(), movie.ID)
+		if err != nil {
+			return err
+		}
+
+		_, err = app.saveRevision(r, tx, after, 0)
+		if err != nil {
+			return err
+		}
+		updated = after
+
+		return app.audit(r, tx, auditEvent{
+			Action:   "update",
+			Entity:   "movie",
+			EntityID: strconv.Itoa(movie.ID),
+			Before:   before,
+			After:    after,
+		})
+	})
 	if err != nil {
-		app.errorJSON(w, err)
+		if errors.Is(err, repository.ErrEditConflict) {
+			app.movieConflictJSON(w, r, id)
+			return
+		}
+		app.dbErrorJSON(w, err)
 		return
 	}
 
@@ -337,9 +905,10 @@ func (app *application) UpdateMovie(w http.ResponseWriter, r *http.Request) {
 		Error:   false,
 		Message: "movie updated",
 	}
-	app.writeJSON(w, http.StatusAccepted, resp)
+	app.writeJSON(w, http.StatusAccepted, resp, http.Header{"ETag": {movieETag(updated)}})
 }
 
+// DeleteMovie moves a movie to the trash, see TrashedMovies.
 func (app *application) DeleteMovie(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
@@ -347,51 +916,32 @@ func (app *application) DeleteMovie(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = app.DB.DeleteMovie(id)
+	err = app.DB.WithTx(r.Context(), func(tx repository.DatabaseRepo) error {
+		before, err := tx.OneMovie(r.Context(), id)
+		if err != nil {
+			return err
+		}
+
+		err = tx.TrashMovie(r.Context(), id, time.Now())
+		if err != nil {
+			return err
+		}
+
+		return app.audit(r, tx, auditEvent{
+			Action:   "trash",
+			Entity:   "movie",
+			EntityID: strconv.Itoa(id),
+			Before:   before,
+		})
+	})
 	if err != nil {
-		app.errorJSON(w, err)
+		app.dbErrorJSON(w, err)
 		return
 	}
 
 	resp := JSONResponse{
 		Error:   false,
-		Message: "movie deleted",
+		Message: "movie moved to trash",
 	}
 	app.writeJSON(w, http.StatusAccepted, resp)
 }
-
-func (app *application) moviesGraphQL(w http.ResponseWriter, r *http.Request) {
-	// Populate our Graph type with the movies
-	movies, err := app.DB.AllMovies()
-	if err != nil {
-		app.logger.WithFields("error", err.Error()).Error("list all movies")
-		app.errorJSON(w, errors.New("unexpected error"), http.StatusInternalServerError)
-		return
-	}
-
-	// Get the query from the request
-	q, err := io.ReadAll(r.Body)
-	if err != nil {
-		app.logger.WithFields("error", err.Error()).Error("list all movies")
-		app.errorJSON(w, errors.New("unexpected error"), http.StatusInternalServerError)
-		return
-	}
-
-	query := string(q)
-
-	// Create a new variable of type *graph.Graph
-	g := graph.New(movies)
-
-	// Set the query string on the variable
-	g.QueryString = query
-
-	// Perform the query
-	resp, err := g.Query()
-	if err != nil {
-		app.errorJSON(w, err)
-		return
-	}
-
-	// Send the response
-	app.writeJSON(w, http.StatusOK, resp)
-}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// signingKey is a key used to sign tokens, or only to verify them once it
+// has been retired.
+type signingKey struct {
+	ID        string
+	Method    jwt.SigningMethod
+	Private   any // nil for verification only keys
+	Public    any
+	RetiredAt time.Time // zero for the current key
+}
+
+// keySet holds the key tokens are signed with and the keys tokens are
+// verified with, selected by the kid header.
+type keySet struct {
+	signing *signingKey
+	keys    map[string]*signingKey
+	// grace is how long a retired key stays valid for verification
+	grace time.Duration
+}
+
+// keyManifest is the format of the keys.json file of a key directory:
+//
+//	{
+//	  "keys": [
+//	    {"kid": "2026-10", "file": "2026-10.pem"},
+//	    {"kid": "2026-04", "file": "2026-04.pem", "retired_at": "2026-10-01T00:00:00Z"}
+//	  ]
+//	}
+//
+// Files hold a PEM encoded RSA (PKCS#1 or PKCS#8) or Ed25519 (PKCS#8) private
+// key, or just the public key for retired keys. Exactly one key must not be
+// retired, it signs the new tokens. To rotate, add the new key, set
+// retired_at on the old one and restart.
+type keyManifest struct {
+	Keys []struct {
+		ID        string    `json:"kid"`
+		File      string    `json:"file"`
+		RetiredAt time.Time `json:"retired_at"`
+	} `json:"keys"`
+}
+
+// newHMACKeySet returns a key set signing with HS256 and a shared secret.
+func newHMACKeySet(secret string) *keySet {
+	key := &signingKey{
+		ID:      "hs256",
+		Method:  jwt.SigningMethodHS256,
+		Private: []byte(secret),
+		Public:  []byte(secret),
+	}
+
+	return &keySet{
+		signing: key,
+		keys:    map[string]*signingKey{key.ID: key},
+	}
+}
+
+// loadKeySet reads the asymmetric keys listed in dir/keys.json.
+func loadKeySet(dir string, grace time.Duration) (*keySet, error) {
+	b, err := os.ReadFile(filepath.Join(dir, "keys.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest keyManifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return nil, fmt.Errorf("keys.json: %w", err)
+	}
+
+	ks := &keySet{
+		keys:  make(map[string]*signingKey),
+		grace: grace,
+	}
+
+	for _, k := range manifest.Keys {
+		if k.ID == "" {
+			return nil, errors.New("keys.json: key without kid")
+		}
+		if _, ok := ks.keys[k.ID]; ok {
+			return nil, fmt.Errorf("keys.json: duplicate kid %q", k.ID)
+		}
+
+		pemBytes, err := os.ReadFile(filepath.Join(dir, k.File))
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := parseKey(pemBytes)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", k.ID, err)
+		}
+		key.ID = k.ID
+		key.RetiredAt = k.RetiredAt
+
+		if key.RetiredAt.IsZero() {
+			if ks.signing != nil {
+				return nil, errors.New("keys.json: only one key can be active, set retired_at on the others")
+			}
+			if key.Private == nil {
+				return nil, fmt.Errorf("key %q: the active key needs a private key", k.ID)
+			}
+			ks.signing = key
+		}
+
+		ks.keys[k.ID] = key
+	}
+
+	if ks.signing == nil {
+		return nil, errors.New("keys.json: no active key")
+	}
+
+	return ks, nil
+}
+
+// parseKey decodes a PEM encoded private or public key.
+func parseKey(b []byte) (*signingKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	var parsed any
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := &signingKey{}
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.Method, key.Private, key.Public = jwt.SigningMethodRS256, k, &k.PublicKey
+	case *rsa.PublicKey:
+		key.Method, key.Public = jwt.SigningMethodRS256, k
+	case ed25519.PrivateKey:
+		key.Method, key.Private, key.Public = jwt.SigningMethodEdDSA, k, k.Public()
+	case ed25519.PublicKey:
+		key.Method, key.Public = jwt.SigningMethodEdDSA, k
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+
+	if pub, ok := key.Public.(*rsa.PublicKey); ok && pub.N.BitLen() < 2048 {
+		return nil, errors.New("RSA keys must be at least 2048 bits")
+	}
+
+	return key, nil
+}
+
+// sign signs claims with the active key, setting the kid header.
+func (ks *keySet) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.signing.Method, claims)
+	token.Header["kid"] = ks.signing.ID
+
+	return token.SignedString(ks.signing.Private)
+}
+
+// algorithms returns the signing algorithms of the keys, the only ones
+// accepted when verifying tokens.
+func (ks *keySet) algorithms() []string {
+	var algs []string
+	seen := make(map[string]bool)
+	for _, key := range ks.keys {
+		alg := key.Method.Alg()
+		if !seen[alg] {
+			seen[alg] = true
+			algs = append(algs, alg)
+		}
+	}
+	return algs
+}
+
+// keyFunc selects the verification key of a token by its kid header. The
+// algorithm of the token must match the one of the key.
+func (ks *keySet) keyFunc(t *jwt.Token) (any, error) {
+	kid, _ := t.Header["kid"].(string)
+
+	key, ok := ks.keys[kid]
+	if !ok {
+		if kid != "" {
+			return nil, fmt.Errorf("unknown key id %q", kid)
+		}
+		// Tokens issued before key ids were introduced
+		key = ks.signing
+	}
+
+	if t.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+	}
+
+	if !key.RetiredAt.IsZero() && time.Now().After(key.RetiredAt.Add(ks.grace)) {
+		return nil, fmt.Errorf("key %q has been retired", key.ID)
+	}
+
+	return key.Public, nil
+}
+
+// jwk is the JSON Web Key representation of a public key.
+type jwk struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+}
+
+// jwks returns the public keys that can still verify tokens. Shared secrets
+// are never published.
+func (ks *keySet) jwks() []jwk {
+	keys := []jwk{}
+
+	for _, key := range ks.keys {
+		if !key.RetiredAt.IsZero() && time.Now().After(key.RetiredAt.Add(ks.grace)) {
+			continue
+		}
+
+		k := jwk{KeyID: key.ID, Use: "sig", Algorithm: key.Method.Alg()}
+		switch pub := key.Public.(type) {
+		case *rsa.PublicKey:
+			k.KeyType = "RSA"
+			k.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			k.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			k.KeyType = "OKP"
+			k.Curve = "Ed25519"
+			k.X = base64.RawURLEncoding.EncodeToString(pub)
+		default:
+			continue
+		}
+
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].KeyID < keys[j].KeyID
+	})
+
+	return keys
+}
+
+// JWKS publishes the public keys tokens can be verified with.
+func (app *application) JWKS(w http.ResponseWriter, r *http.Request) {
+	headers := http.Header{}
+	headers.Set("Cache-Control", "public, max-age=300")
+
+	var payload = struct {
+		Keys []jwk `json:"keys"`
+	}{
+		app.auth.Keys.jwks(),
+	}
+
+	app.writeJSON(w, http.StatusOK, payload, headers)
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"time"
 
+	"github.com/snirkop89/go-movies/internal/graph"
+	"github.com/snirkop89/go-movies/internal/mailer"
+	"github.com/snirkop89/go-movies/internal/oidc"
 	"github.com/snirkop89/go-movies/internal/repository"
 	"github.com/snirkop89/go-movies/internal/repository/dbrepo"
 	"github.com/snirkop89/simplelogger"
@@ -17,14 +21,35 @@ const port = 8080
 type application struct {
 	logger       *simplelogger.Logger
 	DSN          string
+	Store        string
+	DBTimeout    time.Duration
+	Migrate      bool
 	Domain       string
 	DB           repository.DatabaseRepo
+	Graph        *graph.Graph
 	auth         auth
 	JWTSecret    string
+	JWTKeysDir   string
+	JWTKeyGrace  time.Duration
+	JWTLeeway    time.Duration
 	JWTIssuer    string
 	JWTAudience  string
 	CookieDomain string
 	APIKey       string
+	FrontendURL  string
+	Mailer       mailer.Mailer
+	SMTP         mailer.SMTP
+	MailFile     string
+
+	// Bounds of the GraphQL operations, checked before they run
+	GraphLimits graph.Limits
+
+	// Trashed movies are purged once older than TrashRetention, never when 0
+	TrashRetention time.Duration
+
+	// Single sign-on, disabled when OIDC.Issuer is empty
+	OIDC            oidc.Provider
+	OIDCCreateUsers bool
 }
 
 func main() {
@@ -33,40 +58,142 @@ func main() {
 
 	// Config options from command line
 	flag.StringVar(&app.DSN, "dsn", "host=localhost port=5437 user=postgres password=postgres dbname=movies sslmode=disable timezone=UTC connect_timeout=5", "Postgres connection string")
+	flag.StringVar(&app.Store, "store", "postgres", "Storage backend (postgres|memory)")
+	flag.DurationVar(&app.DBTimeout, "db-timeout", 3*time.Second, "Maximum duration of a single database operation")
+	flag.BoolVar(&app.Migrate, "migrate", false, "Apply pending database migrations on startup")
 	flag.StringVar(&app.JWTSecret, "jwt-secret", "verysecret", "signing secret")
+	flag.StringVar(&app.JWTKeysDir, "jwt-keys", "", "Directory of the asymmetric signing keys (see keys.json), overrides -jwt-secret")
+	flag.DurationVar(&app.JWTKeyGrace, "jwt-key-grace", 24*time.Hour, "How long retired signing keys still verify tokens")
+	flag.DurationVar(&app.JWTLeeway, "jwt-leeway", 30*time.Second, "Clock skew tolerated when validating token times")
 	flag.StringVar(&app.JWTIssuer, "jwt-issuer", "example.com", "signing issuer")
 	flag.StringVar(&app.JWTAudience, "jwt-audience", "example.com", "signing audience")
 	flag.StringVar(&app.CookieDomain, "cookie-domain", "localhost", "cookie domain")
 	flag.StringVar(&app.APIKey, "api-key", "c628aab7009d82e6a615f654e8fbda33", "The movieDB API key")
 	flag.StringVar(&app.Domain, "domain", "example.com", "domain")
+	flag.StringVar(&app.FrontendURL, "frontend-url", "http://localhost:3000", "Base URL of the frontend, used in the links sent by email")
+	flag.StringVar(&app.SMTP.Host, "smtp-host", "", "SMTP server host, emails are written to -mail-file when empty")
+	flag.IntVar(&app.SMTP.Port, "smtp-port", 587, "SMTP server port")
+	flag.StringVar(&app.SMTP.Username, "smtp-username", "", "SMTP username")
+	flag.StringVar(&app.SMTP.Password, "smtp-password", "", "SMTP password")
+	flag.StringVar(&app.SMTP.Sender, "smtp-sender", "Go Movies <no-reply@example.com>", "Sender of the emails")
+	flag.StringVar(&app.MailFile, "mail-file", "", "File the emails are appended to when no SMTP server is set, standard output when empty")
+	flag.DurationVar(&app.TrashRetention, "trash-retention", 30*24*time.Hour, "How long deleted movies stay in the trash, forever when 0")
+	flag.IntVar(&app.GraphLimits.MaxDepth, "graphql-max-depth", 15, "Maximum nesting of the fields of a GraphQL query, unlimited when 0")
+	flag.IntVar(&app.GraphLimits.MaxAliases, "graphql-max-aliases", 30, "Maximum number of aliases in a GraphQL query, unlimited when 0")
+	flag.IntVar(&app.GraphLimits.MaxCost, "graphql-max-cost", 5000, "Maximum computed cost of a GraphQL query, unlimited when 0")
+	flag.StringVar(&app.OIDC.Issuer, "oidc-issuer", "", "OpenID Connect provider URL, single sign-on is disabled when empty")
+	flag.StringVar(&app.OIDC.ClientID, "oidc-client-id", "", "OpenID Connect client id")
+	flag.StringVar(&app.OIDC.ClientSecret, "oidc-client-secret", "", "OpenID Connect client secret, empty for public clients")
+	flag.StringVar(&app.OIDC.RedirectURL, "oidc-redirect-url", "http://localhost:8080/oidc/callback", "URL of the callback registered with the OpenID Connect provider")
+	flag.BoolVar(&app.OIDCCreateUsers, "oidc-create-users", true, "Create an account for the single sign-on users without one")
 	flag.Parse()
 
 	// Initialize logger
 	app.logger = simplelogger.New(simplelogger.FormatHuman, simplelogger.LevelInfo)
 
+	// Sub commands
+	if flag.Arg(0) == "migrate" {
+		if err := app.migrate(os.Stdout, flag.Args()[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// connect to database
-	conn, err := app.connectToDB()
+	switch app.Store {
+	case "postgres":
+		conn, err := app.connectToDB()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		app.DB = &dbrepo.PostgresDBRepo{DB: conn, Timeout: app.DBTimeout}
+		defer conn.Close()
+
+		if app.Migrate {
+			if err := app.migrateOnStartup(context.Background()); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+	case "memory":
+		repo := dbrepo.NewMemoryDBRepo()
+		repo.Seed()
+		app.DB = repo
+		app.logger.Info("Using in-memory store")
+	default:
+		fmt.Fprintf(os.Stderr, "unknown store %q\n", app.Store)
+		os.Exit(1)
+	}
+
+	// TODO - create simple logger package
+
+	// GraphQL schema
+	g, err := graph.New(app.DB, app.GraphLimits)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
-	app.DB = &dbrepo.PostgresDBRepo{DB: conn}
-	defer app.DB.Connection().Close()
+	app.Graph = g
 
-	// TODO - create simple logger package
+	// Signing keys
+	keys := newHMACKeySet(app.JWTSecret)
+	if app.JWTKeysDir != "" {
+		var err error
+		keys, err = loadKeySet(app.JWTKeysDir, app.JWTKeyGrace)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		app.logger.Infof("Signing tokens with key %s", keys.signing.ID)
+	} else if app.JWTSecret == "verysecret" {
+		app.logger.Warn("Signing tokens with the default secret, set -jwt-keys or -jwt-secret")
+	}
+
+	// Mailer
+	switch {
+	case app.SMTP.Host != "":
+		app.Mailer = &app.SMTP
+	case app.MailFile != "":
+		f, err := os.OpenFile(app.MailFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		app.Mailer = &mailer.Writer{W: f, Sender: app.SMTP.Sender}
+		app.logger.Infof("Writing emails to %s", app.MailFile)
+	default:
+		app.Mailer = &mailer.Writer{W: os.Stdout, Sender: app.SMTP.Sender}
+		app.logger.Info("Writing emails to the standard output")
+	}
+
+	// Single sign-on
+	if app.OIDC.Issuer != "" {
+		app.OIDC.Scopes = []string{"openid", "email", "profile"}
+		app.OIDC.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+		app.logger.Infof("Single sign-on with %s", app.OIDC.Issuer)
+	}
 
 	// TODO Replace the wasterful vars
 	app.auth = auth{
 		Issuer:        app.JWTIssuer,
 		Audience:      app.JWTAudience,
-		Secret:        app.JWTSecret,
+		Keys:          keys,
+		Leeway:        app.JWTLeeway,
 		TokenExpiry:   time.Minute * 15,
 		RefreshExpiry: time.Hour * 24,
+		MFAExpiry:     time.Minute * 5,
 		CookiePath:    "/",
 		CookieName:    "Host-refresh_token",
 		CookieDomain:  app.CookieDomain,
 	}
 
+	if app.TrashRetention > 0 {
+		app.background(func() { app.purgeTrashEvery(time.Hour) })
+	}
+
 	// start a webserver
 	app.logger.Infof("Starting application on port %d", port)
 	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), app.routes()); err != nil {
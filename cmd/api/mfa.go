@@ -0,0 +1,463 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/snirkop89/go-movies/internal/models"
+	"github.com/snirkop89/go-movies/internal/repository"
+	"github.com/snirkop89/go-movies/internal/totp"
+)
+
+const (
+	recoveryCodeCount = 10
+	// totpSkew is the number of time steps a code may be early or late
+	totpSkew = 1
+)
+
+var (
+	errInvalidCode   = errors.New("invalid code")
+	errMFAEnabled    = errors.New("two-factor authentication is already enabled")
+	errMFANotEnabled = errors.New("two-factor authentication is not enabled")
+)
+
+// mfaChallenge is returned by authenticate instead of the token pair when the
+// user has two-factor authentication enabled.
+type mfaChallenge struct {
+	MFARequired bool   `json:"mfa_required"`
+	Token       string `json:"mfa_token"`
+}
+
+// generateRecoveryCodes returns new recovery codes, formatted as two groups
+// of five characters, and their hashes.
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+
+	b := make([]byte, 7)
+	for i := range codes {
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		s := strings.ToLower(base32.StdEncoding.EncodeToString(b))[:10]
+		codes[i] = s[:5] + "-" + s[5:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode returns the stored form of a recovery code. The codes are
+// random enough for a plain hash to be safe.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// isTOTPCode reports whether code looks like a TOTP code rather than a
+// recovery code.
+func isTOTPCode(code string) bool {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != totp.Digits {
+		return false
+	}
+	for _, r := range code {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// verifyTOTP checks a TOTP code of user, refusing a code that was already
+// used.
+func (app *application) verifyTOTP(ctx context.Context, user *models.User, code string) (bool, error) {
+	step, err := totp.Validate(user.TOTPSecret, code, time.Now(), totpSkew)
+	if err != nil {
+		if errors.Is(err, totp.ErrInvalidCode) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	err = app.DB.UseTOTPStep(ctx, user.ID, step)
+	if err != nil {
+		if errors.Is(err, repository.ErrCodeReused) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// verifySecondFactor checks code as either a TOTP code or a recovery code of
+// user. Recovery codes are consumed.
+func (app *application) verifySecondFactor(r *http.Request, user *models.User, code string) (bool, error) {
+	if isTOTPCode(code) {
+		return app.verifyTOTP(r.Context(), user, code)
+	}
+
+	err := app.DB.UseRecoveryCode(r.Context(), user.ID, hashRecoveryCode(code))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	app.auditLog(r, auditEvent{Action: "mfa.recovery_code_used", Entity: "user", EntityID: strconv.Itoa(user.ID), UserID: user.ID})
+
+	return true, nil
+}
+
+// authenticateMFA exchanges the challenge token returned by authenticate and
+// a TOTP or recovery code for a token pair.
+func (app *application) authenticateMFA(w http.ResponseWriter, r *http.Request) {
+	var requestPayload struct {
+		Token string `json:"mfa_token"`
+		Code  string `json:"code"`
+	}
+	err := app.readJSON(w, r, &requestPayload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	claims, err := app.auth.ValidateToken(requestPayload.Token, tokenTypeMFA)
+	if err != nil {
+		app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
+
+	user, err := app.DB.UserByID(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+			return
+		}
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	if !user.TOTPEnabled {
+		app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
+
+	// Codes are throttled along with passwords
+	email := models.NormalizeEmail(user.Email)
+	ip := clientIP(r)
+
+	if app.loginBlocked(w, r, email, ip) {
+		return
+	}
+
+	valid, err := app.verifySecondFactor(r, user, requestPayload.Code)
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+	if !valid {
+		app.loginFailed(r, email, ip)
+		app.errorJSON(w, errInvalidCode, http.StatusUnauthorized)
+		return
+	}
+
+	err = app.DB.ClearLoginAttempts(r.Context(), accountLoginKey(email))
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	app.auditLog(r, auditEvent{Action: "login", Entity: "user", EntityID: strconv.Itoa(user.ID), UserID: user.ID})
+
+	app.startSession(w, r, user)
+}
+
+// EnrollTOTP starts the enrollment of the caller in two-factor
+// authentication. The returned secret is only required to log in once a
+// first code has been verified with VerifyTOTP.
+func (app *application) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	user, err := app.currentUser(r)
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	if user.TOTPEnabled {
+		app.errorJSON(w, errMFAEnabled, http.StatusConflict)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = app.DB.UpdateUserTOTP(r.Context(), user.ID, secret, false)
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	var payload = struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}{
+		secret,
+		totp.URI(app.auth.Issuer, user.Email, secret),
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "scan the code with an authenticator app, then verify a first code",
+		Data:    payload,
+	}
+	app.writeJSON(w, http.StatusCreated, resp)
+}
+
+// VerifyTOTP completes the enrollment with a first code, and returns the
+// recovery codes. They are only ever shown this once.
+func (app *application) VerifyTOTP(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Code string `json:"code"`
+	}
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.currentUser(r)
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	if user.TOTPEnabled {
+		app.errorJSON(w, errMFAEnabled, http.StatusConflict)
+		return
+	}
+	if user.TOTPSecret == "" {
+		app.errorJSON(w, errors.New("two-factor authentication enrollment has not been started"), http.StatusConflict)
+		return
+	}
+
+	valid, err := app.verifyTOTP(r.Context(), user, payload.Code)
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+	if !valid {
+		app.errorJSON(w, errInvalidCode, http.StatusUnprocessableEntity)
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		if err := repo.UpdateUserTOTP(r.Context(), user.ID, user.TOTPSecret, true); err != nil {
+			return err
+		}
+		return repo.ReplaceRecoveryCodes(r.Context(), user.ID, hashes)
+	})
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	app.auditLog(r, auditEvent{Action: "mfa.enable", Entity: "user", EntityID: strconv.Itoa(user.ID)})
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "two-factor authentication enabled",
+		Data: struct {
+			RecoveryCodes []string `json:"recovery_codes"`
+		}{codes},
+	}
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the caller, who
+// must confirm with a code.
+func (app *application) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Code string `json:"code"`
+	}
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.currentUser(r)
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	if !user.TOTPEnabled {
+		app.errorJSON(w, errMFANotEnabled, http.StatusConflict)
+		return
+	}
+
+	// Throttled as logins, the caller may only hold a stolen access token
+	email := models.NormalizeEmail(user.Email)
+	ip := clientIP(r)
+	if app.loginBlocked(w, r, email, ip) {
+		return
+	}
+
+	valid, err := app.verifySecondFactor(r, user, payload.Code)
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+	if !valid {
+		app.loginFailed(r, email, ip)
+		app.errorJSON(w, errInvalidCode, http.StatusUnauthorized)
+		return
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = app.DB.ReplaceRecoveryCodes(r.Context(), user.ID, hashes)
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "recovery codes replaced",
+		Data: struct {
+			RecoveryCodes []string `json:"recovery_codes"`
+		}{codes},
+	}
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
+// DisableTOTP turns two-factor authentication off for the caller, who must
+// confirm with their password and a code.
+func (app *application) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.currentUser(r)
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	if !user.TOTPEnabled {
+		app.errorJSON(w, errMFANotEnabled, http.StatusConflict)
+		return
+	}
+
+	// Throttled as logins, the caller may only hold a stolen access token
+	email := models.NormalizeEmail(user.Email)
+	ip := clientIP(r)
+	if app.loginBlocked(w, r, email, ip) {
+		return
+	}
+
+	valid, err := user.PasswordMatches(payload.Password)
+	if err != nil || !valid {
+		app.loginFailed(r, email, ip)
+		app.errorJSON(w, errors.New("invalid credentials"), http.StatusUnauthorized)
+		return
+	}
+
+	valid, err = app.verifySecondFactor(r, user, payload.Code)
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+	if !valid {
+		app.loginFailed(r, email, ip)
+		app.errorJSON(w, errInvalidCode, http.StatusUnauthorized)
+		return
+	}
+
+	err = app.disableTOTP(r.Context(), user.ID)
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	app.auditLog(r, auditEvent{Action: "mfa.disable", Entity: "user", EntityID: strconv.Itoa(user.ID)})
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "two-factor authentication disabled",
+	}
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
+// ResetUserMFA lets an admin turn off two-factor authentication for a user
+// who lost both their device and their recovery codes.
+func (app *application) ResetUserMFA(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.disableTOTP(r.Context(), id)
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	app.auditLog(r, auditEvent{Action: "mfa.reset", Entity: "user", EntityID: strconv.Itoa(id)})
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "two-factor authentication disabled",
+	}
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
+// disableTOTP removes the TOTP secret and the recovery codes of a user.
+func (app *application) disableTOTP(ctx context.Context, id int) error {
+	return app.DB.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		if err := repo.UpdateUserTOTP(ctx, id, "", false); err != nil {
+			return err
+		}
+		return repo.ReplaceRecoveryCodes(ctx, id, nil)
+	})
+}
@@ -1,19 +1,30 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
+
+	"github.com/snirkop89/go-movies/internal/models"
 )
 
+type contextKey string
+
+// claimsContextKey holds the verified claims of the caller.
+const claimsContextKey = contextKey("claims")
+
 func (app *application) enableCORS(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "https://full-domain-name")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag")
 
 		if r.Method == http.MethodOptions {
 			w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,PATCH,DELETE,OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, X-CSRF-Token, Authorization")
+			w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, X-CSRF-Token, Authorization, If-Match")
 			return
 		}
 
@@ -21,17 +32,122 @@ func (app *application) enableCORS(h http.Handler) http.Handler {
 	})
 }
 
+// authRequired verifies the access token of the Authorization header, or the
+// API key when the header is "ApiKey <key>".
 func (app *application) authRequired(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		_, _, err := app.auth.GetTokenFromHeaderAndVerify(w, r)
+		claims, err := app.verifyAuthorization(w, r)
 		if err != nil {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
+
+		ctx := context.WithValue(r.Context(), claimsContextKey, claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// authOptional verifies the credentials of the requests that carry some,
+// like authRequired, and lets anonymous requests through without claims.
+func (app *application) authOptional(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			w.Header().Add("Vary", "Authorization")
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		app.authRequired(next).ServeHTTP(w, r)
+	})
+}
+
+// verifyAuthorization checks the API key or access token of the
+// Authorization header and returns its claims.
+func (app *application) verifyAuthorization(w http.ResponseWriter, r *http.Request) (*claims, error) {
+	scheme, key, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if scheme == "ApiKey" {
+		w.Header().Add("Vary", "Authorization")
+		return app.authenticateAPIKey(r, strings.TrimSpace(key))
+	}
+
+	_, claims, err := app.auth.GetTokenFromHeaderAndVerify(w, r)
+	return claims, err
+}
+
+// requireRole only lets through callers with at least the given role.
+// It must be used after authRequired.
+func (app *application) requireRole(role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims := app.claimsFromContext(r)
+			if claims == nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			if !models.RoleAtLeast(claims.Role, role) {
+				app.errorJSON(w, errors.New("insufficient permissions"), http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requireScopes limits what API keys can do: reading needs the read scope
+// and any other method needs the write scope. Tokens aren't limited by
+// scopes. It must be used after authRequired.
+func (app *application) requireScopes(write string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims := app.claimsFromContext(r)
+			if claims == nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			if claims.APIKeyID != 0 {
+				scope := write
+				if r.Method == http.MethodGet || r.Method == http.MethodHead {
+					scope = models.ScopeRead
+				}
+				if !containsString(claims.Scopes, scope) {
+					app.errorJSON(w, fmt.Errorf("api key lacks the %s scope", scope), http.StatusForbidden)
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requireSession refuses API keys, for the routes managing accounts and
+// credentials. It must be used after authRequired.
+func (app *application) requireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims := app.claimsFromContext(r)
+		if claims == nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if claims.APIKeyID != 0 {
+			app.errorJSON(w, errAPIKeyNotAllowed, http.StatusForbidden)
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
 
+// claimsFromContext returns the claims stored by authRequired, or nil.
+func (app *application) claimsFromContext(r *http.Request) *claims {
+	c, _ := r.Context().Value(claimsContextKey).(*claims)
+	return c
+}
+
 func (app *application) logging(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/snirkop89/go-movies/internal/migrations"
+)
+
+const migrateUsage = "usage: go-movies [flags] migrate up|down|status|goto N"
+
+// migrate runs the migrate sub command.
+func (app *application) migrate(out io.Writer, args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	conn, err := app.connectToDB()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	m, err := migrations.New(conn)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	var done []migrations.Migration
+	switch args[0] {
+	case "up":
+		done, err = m.Up(ctx)
+	case "down":
+		done, err = m.Down(ctx)
+	case "goto":
+		if len(args) != 2 {
+			return errors.New(migrateUsage)
+		}
+		version, convErr := strconv.Atoi(args[1])
+		if convErr != nil {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+		done, err = m.Goto(ctx, version)
+	case "status":
+		return printMigrationStatus(ctx, out, m)
+	default:
+		return errors.New(migrateUsage)
+	}
+
+	for _, mig := range done {
+		fmt.Fprintf(out, "%04d_%s\n", mig.Version, mig.Name)
+	}
+	if err != nil {
+		return err
+	}
+	if len(done) == 0 {
+		fmt.Fprintln(out, "no change")
+	}
+
+	return nil
+}
+
+func printMigrationStatus(ctx context.Context, out io.Writer, m *migrations.Migrator) error {
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED AT")
+	for _, s := range statuses {
+		applied := "pending"
+		if s.Applied {
+			applied = s.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%04d\t%s\t%s\n", s.Version, s.Name, applied)
+	}
+
+	return tw.Flush()
+}
+
+// migrateOnStartup applies the pending migrations before the API starts.
+func (app *application) migrateOnStartup(ctx context.Context) error {
+	m, err := migrations.New(app.DB.Connection())
+	if err != nil {
+		return err
+	}
+
+	done, err := m.Up(ctx)
+	for _, mig := range done {
+		app.logger.Infof("Applied migration %04d_%s", mig.Version, mig.Name)
+	}
+
+	return err
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/snirkop89/go-movies/internal/models"
+	"github.com/snirkop89/go-movies/internal/oidc"
+	"github.com/snirkop89/go-movies/internal/repository"
+)
+
+// oidcLoginExpiry is how long a user has to log in at the identity provider.
+const oidcLoginExpiry = 10 * time.Minute
+
+// oidcCookieName is the cookie holding the state of a login in progress. It
+// is only sent to the callback.
+const oidcCookieName = "oidc_login"
+
+var (
+	errOIDCDisabled     = errors.New("single sign-on is not configured")
+	errOIDCLoginFailed  = errors.New("single sign-on failed, please try again")
+	errNoLinkedAccount  = errors.New("no account is linked to this identity")
+	errInvalidReturnURL = errors.New("return_to must be a frontend URL")
+)
+
+// oidcLoginClaims are the claims of the token kept in the login cookie
+// between OIDCLogin and OIDCCallback. The token id is the state parameter.
+type oidcLoginClaims struct {
+	claims
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"cv"`           // PKCE code verifier
+	ReturnTo string `json:"rt,omitempty"` // frontend URL to redirect to
+}
+
+func (app *application) oidcCookie(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     oidcCookieName,
+		Path:     "/oidc",
+		Value:    value,
+		MaxAge:   maxAge,
+		Domain:   app.auth.CookieDomain,
+		Secure:   true,
+		HttpOnly: true,
+		// Lax, the provider redirects back to the callback with a top level
+		// navigation from its own site
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// validReturnTo reports whether u is a URL of the frontend.
+func (app *application) validReturnTo(u string) bool {
+	if u == app.FrontendURL {
+		return true
+	}
+
+	target, err := url.Parse(u)
+	if err != nil {
+		return false
+	}
+	frontend, err := url.Parse(app.FrontendURL)
+	if err != nil {
+		return false
+	}
+	return target.Scheme == frontend.Scheme && target.Host == frontend.Host &&
+		strings.HasPrefix(target.Path, strings.TrimSuffix(frontend.Path, "/")+"/")
+}
+
+// OIDCLogin redirects to the login page of the identity provider, with the
+// state, nonce and PKCE verifier of the login kept in a signed cookie. When
+// return_to is set, the callback redirects there once the session started
+// instead of returning the tokens.
+func (app *application) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if app.OIDC.Issuer == "" {
+		app.errorJSON(w, errOIDCDisabled, http.StatusNotFound)
+		return
+	}
+
+	returnTo := r.URL.Query().Get("return_to")
+	if returnTo != "" && !app.validReturnTo(returnTo) {
+		app.errorJSON(w, errInvalidReturnURL)
+		return
+	}
+
+	state, err := oidc.RandomString(32)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	nonce, err := oidc.RandomString(32)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	verifier, challenge, err := oidc.NewPKCE()
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	authURL, err := app.OIDC.AuthCodeURL(r.Context(), state, nonce, challenge)
+	if err != nil {
+		app.logger.WithFields("error", err.Error()).Error("oidc login")
+		app.errorJSON(w, errOIDCLoginFailed, http.StatusBadGateway)
+		return
+	}
+
+	now := time.Now().UTC()
+	login := oidcLoginClaims{
+		claims: claims{
+			Type: tokenTypeOIDC,
+			RegisteredClaims: jwt.RegisteredClaims{
+				ID:        state,
+				Issuer:    app.auth.Issuer,
+				Audience:  jwt.ClaimStrings{app.auth.Audience},
+				IssuedAt:  jwt.NewNumericDate(now),
+				ExpiresAt: jwt.NewNumericDate(now.Add(oidcLoginExpiry)),
+			},
+		},
+		Nonce:    nonce,
+		Verifier: verifier,
+		ReturnTo: returnTo,
+	}
+	token, err := app.auth.Keys.sign(&login)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, app.oidcCookie(token, int(oidcLoginExpiry.Seconds())))
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// OIDCCallback completes a login started by OIDCLogin: it exchanges the code
+// for an ID token, finds or creates the local user of its subject and starts
+// a session, just like authenticate does.
+func (app *application) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if app.OIDC.Issuer == "" {
+		app.errorJSON(w, errOIDCDisabled, http.StatusNotFound)
+		return
+	}
+
+	// The login state is single use
+	http.SetCookie(w, app.oidcCookie("", -1))
+
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		app.logger.WithFields("error", e, "description", q.Get("error_description")).Warn("oidc login refused")
+		app.errorJSON(w, errOIDCLoginFailed, http.StatusUnauthorized)
+		return
+	}
+
+	cookie, err := r.Cookie(oidcCookieName)
+	if err != nil {
+		app.errorJSON(w, errOIDCLoginFailed, http.StatusUnauthorized)
+		return
+	}
+
+	var login oidcLoginClaims
+	err = app.auth.validateInto(cookie.Value, tokenTypeOIDC, &login)
+	if err != nil || login.ID == "" ||
+		subtle.ConstantTimeCompare([]byte(login.ID), []byte(q.Get("state"))) != 1 {
+		app.errorJSON(w, errOIDCLoginFailed, http.StatusUnauthorized)
+		return
+	}
+
+	tokens, err := app.OIDC.Exchange(r.Context(), q.Get("code"), login.Verifier)
+	if err != nil {
+		app.logger.WithFields("error", err.Error()).Warn("oidc login")
+		app.errorJSON(w, errOIDCLoginFailed, http.StatusUnauthorized)
+		return
+	}
+
+	idToken, err := app.OIDC.VerifyIDToken(r.Context(), tokens.IDToken, login.Nonce)
+	if err != nil {
+		app.logger.WithFields("error", err.Error()).Warn("oidc login")
+		app.errorJSON(w, errOIDCLoginFailed, http.StatusUnauthorized)
+		return
+	}
+
+	user, err := app.oidcUser(r, idToken)
+	if err != nil {
+		if errors.Is(err, errNoLinkedAccount) {
+			app.auditLog(r, auditEvent{Action: "login.oidc_rejected", Entity: "identity", EntityID: idToken.Issuer + " " + idToken.Subject})
+			app.errorJSON(w, err, http.StatusForbidden)
+			return
+		}
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	// The account may be linked by email alone, its second factor is still
+	// required unless the provider checked one
+	if user.TOTPEnabled && !idToken.MultiFactor() {
+		app.oidcMFAChallenge(w, r, user, login.ReturnTo)
+		return
+	}
+
+	app.auditLog(r, auditEvent{Action: "login.oidc", Entity: "user", EntityID: strconv.Itoa(user.ID), UserID: user.ID})
+
+	if login.ReturnTo == "" {
+		app.startSession(w, r, user)
+		return
+	}
+
+	// The frontend gets its access token from the refresh cookie
+	pair, err := app.newSession(r.Context(), user)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, app.auth.GetRefreshCookie(pair.RefresToken))
+	http.Redirect(w, r, login.ReturnTo, http.StatusSeeOther)
+}
+
+// oidcMFAChallenge answers with the token to exchange with a code for a
+// session, as authenticate does. The frontend gets it in the fragment of the
+// URL it is redirected to, which isn't sent to servers.
+func (app *application) oidcMFAChallenge(w http.ResponseWriter, r *http.Request, user *models.User, returnTo string) {
+	token, err := app.auth.GenerateMFAToken(user.ID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if returnTo == "" {
+		app.writeJSON(w, http.StatusAccepted, mfaChallenge{MFARequired: true, Token: token})
+		return
+	}
+
+	u, err := url.Parse(returnTo)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	u.Fragment = "mfa_token=" + token
+	http.Redirect(w, r, u.String(), http.StatusSeeOther)
+}
+
+// oidcUser returns the local user of the subject of idToken. A subject seen
+// for the first time is linked to the user with the same email, provided the
+// provider verified it, or to a new viewer when -oidc-create-users is set.
+// Users created this way have no password and can only log in through the
+// provider.
+func (app *application) oidcUser(r *http.Request, idToken *oidc.IDToken) (*models.User, error) {
+	ctx := r.Context()
+	var user *models.User
+
+	err := app.DB.WithTx(ctx, func(repo repository.DatabaseRepo) error {
+		var err error
+		user, err = repo.UserByIdentity(ctx, idToken.Issuer, idToken.Subject)
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		email := models.NormalizeEmail(idToken.Email)
+		if email == "" || !idToken.EmailVerified {
+			return errNoLinkedAccount
+		}
+
+		action := "identity.link"
+		user, err = repo.UserByEmail(ctx, email)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			if !app.OIDCCreateUsers {
+				return errNoLinkedAccount
+			}
+			user, err = newOIDCUser(idToken)
+			if err != nil {
+				return err
+			}
+			user.ID, err = repo.InsertUser(ctx, *user)
+			if err != nil {
+				return err
+			}
+			action = "identity.create_user"
+		case err != nil:
+			return err
+		}
+
+		identity := models.UserIdentity{
+			Issuer:    idToken.Issuer,
+			Subject:   idToken.Subject,
+			UserID:    user.ID,
+			Email:     email,
+			CreatedAt: time.Now(),
+		}
+		err = repo.InsertUserIdentity(ctx, identity)
+		if err != nil {
+			return err
+		}
+
+		return app.audit(r, repo, auditEvent{
+			Action:   action,
+			Entity:   "user",
+			EntityID: strconv.Itoa(user.ID),
+			UserID:   user.ID,
+			After:    identity,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// newOIDCUser returns a viewer built from the claims of idToken.
+func newOIDCUser(idToken *oidc.IDToken) (*models.User, error) {
+	first, last := strings.TrimSpace(idToken.GivenName), strings.TrimSpace(idToken.FamilyName)
+	if first == "" {
+		first, last, _ = strings.Cut(strings.TrimSpace(idToken.Name), " ")
+	}
+	email := models.NormalizeEmail(idToken.Email)
+	if first == "" {
+		first, _, _ = strings.Cut(email, "@")
+	}
+
+	user := &models.User{
+		FirstName: first,
+		LastName:  strings.TrimSpace(last),
+		Email:     email,
+		Role:      models.RoleViewer,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+
+	for _, check := range []error{
+		validateName("first_name", user.FirstName),
+		validateEmail(user.Email),
+	} {
+		if check != nil {
+			return nil, fmt.Errorf("%w: %v", errNoLinkedAccount, check)
+		}
+	}
+
+	return user, nil
+}
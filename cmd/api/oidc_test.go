@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/snirkop89/go-movies/internal/models"
+	"github.com/snirkop89/go-movies/internal/oidc"
+	"github.com/snirkop89/go-movies/internal/oidc/oidctest"
+	"github.com/snirkop89/go-movies/internal/repository/dbrepo"
+	"github.com/snirkop89/go-movies/internal/totp"
+	"github.com/snirkop89/simplelogger"
+)
+
+// newOIDCTestApp returns the application, running with the memory store and
+// single sign-on with idp, and its server.
+func newOIDCTestApp(t *testing.T, idp *oidctest.Server) (*application, *httptest.Server) {
+	t.Helper()
+
+	repo := dbrepo.NewMemoryDBRepo()
+	repo.Seed()
+
+	app := &application{
+		logger:          simplelogger.New(simplelogger.FormatHuman, simplelogger.LevelInfo, simplelogger.WithWriter(io.Discard)),
+		DB:              repo,
+		FrontendURL:     "http://localhost:3000",
+		OIDCCreateUsers: true,
+	}
+	app.auth = *testAuth(newHMACKeySet("verysecret"))
+	app.auth.CookieName = "Host-refresh_token"
+	app.auth.CookiePath = "/"
+
+	srv := httptest.NewServer(app.routes())
+	t.Cleanup(srv.Close)
+
+	app.OIDC.Issuer = idp.URL
+	app.OIDC.ClientID = idp.ClientID
+	app.OIDC.ClientSecret = idp.ClientSecret
+	app.OIDC.RedirectURL = srv.URL + "/oidc/callback"
+
+	return app, srv
+}
+
+// ssoLogin follows the login flow through the mock provider and returns the
+// response of the callback. Cookies are carried by hand, the jar doesn't send
+// secure cookies over plain HTTP.
+func ssoLogin(t *testing.T, srv *httptest.Server, query string, tamperState bool) *http.Response {
+	t.Helper()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	resp, err := client.Get(srv.URL + "/oidc/login" + query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("login: got %s", resp.Status)
+	}
+
+	var loginCookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == oidcCookieName {
+			loginCookie = c
+		}
+	}
+	if loginCookie == nil {
+		t.Fatal("login: no state cookie")
+	}
+
+	// The provider logs the user in and redirects to the callback
+	resp, err = client.Get(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: got %s", resp.Status)
+	}
+
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tamperState {
+		q := callback.Query()
+		q.Set("state", "forged")
+		callback.RawQuery = q.Encode()
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, callback.String(), nil)
+	req.AddCookie(&http.Cookie{Name: loginCookie.Name, Value: loginCookie.Value})
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	return resp
+}
+
+// sessionUserID returns the id of the user of the token pair in resp.
+func sessionUserID(t *testing.T, app *application, resp *http.Response) string {
+	t.Helper()
+
+	if resp.StatusCode != http.StatusAccepted {
+		body, _ := io.ReadAll(resp.Body)
+		t.Fatalf("callback: got %s: %s", resp.Status, body)
+	}
+
+	var tokens tokenPairs
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		t.Fatal(err)
+	}
+
+	refreshed := false
+	for _, c := range resp.Cookies() {
+		if c.Name == app.auth.CookieName && c.Value == tokens.RefresToken {
+			refreshed = true
+		}
+	}
+	if !refreshed {
+		t.Error("no refresh cookie set")
+	}
+
+	claims, err := app.auth.ValidateToken(tokens.Token, tokenTypeAccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return claims.Subject
+}
+
+func TestOIDCLoginCreatesUser(t *testing.T) {
+	idp := oidctest.NewServer("movies", "s3cret", oidctest.User{
+		Subject:       "bob-42",
+		Email:         "Bob@Corp.example",
+		EmailVerified: true,
+		GivenName:     "Bob",
+		FamilyName:    "Builder",
+	})
+	defer idp.Close()
+
+	app, srv := newOIDCTestApp(t, idp)
+
+	id := sessionUserID(t, app, ssoLogin(t, srv, "", false))
+	if id == "1" {
+		t.Fatal("logged in as the seeded admin")
+	}
+
+	user, err := app.DB.UserByEmail(context.Background(), "bob@corp.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Role != models.RoleViewer || user.FirstName != "Bob" || user.LastName != "Builder" {
+		t.Errorf("unexpected user %+v", user)
+	}
+	if ok, _ := user.PasswordMatches(""); ok {
+		t.Error("user created with a usable password")
+	}
+
+	// The subject is linked, even once the email changed
+	idp.SetUser(oidctest.User{Subject: "bob-42", Email: "robert@corp.example", EmailVerified: true})
+	if again := sessionUserID(t, app, ssoLogin(t, srv, "", false)); again != id {
+		t.Errorf("second login as user %s, want %s", again, id)
+	}
+}
+
+func TestOIDCLoginLinksVerifiedEmail(t *testing.T) {
+	idp := oidctest.NewServer("movies", "", oidctest.User{
+		Subject:       "admin-sso",
+		Email:         "admin@example.com",
+		EmailVerified: true,
+	})
+	defer idp.Close()
+
+	app, srv := newOIDCTestApp(t, idp)
+
+	if id := sessionUserID(t, app, ssoLogin(t, srv, "", false)); id != "1" {
+		t.Errorf("logged in as user %s, want the seeded admin", id)
+	}
+}
+
+func TestOIDCLoginRejected(t *testing.T) {
+	tests := []struct {
+		name        string
+		user        oidctest.User
+		createUsers bool
+		tamperState bool
+		want        int
+	}{
+		{"unverified email of a local user", oidctest.User{Subject: "x", Email: "admin@example.com"}, true, false, http.StatusForbidden},
+		{"no email", oidctest.User{Subject: "x"}, true, false, http.StatusForbidden},
+		{"account creation disabled", oidctest.User{Subject: "x", Email: "new@example.com", EmailVerified: true}, false, false, http.StatusForbidden},
+		{"forged state", oidctest.User{Subject: "x", Email: "admin@example.com", EmailVerified: true}, true, true, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := oidctest.NewServer("movies", "s3cret", tt.user)
+			defer idp.Close()
+
+			app, srv := newOIDCTestApp(t, idp)
+			app.OIDCCreateUsers = tt.createUsers
+
+			resp := ssoLogin(t, srv, "", tt.tamperState)
+			if resp.StatusCode != tt.want {
+				t.Fatalf("got %s, want %d", resp.Status, tt.want)
+			}
+			for _, c := range resp.Cookies() {
+				if c.Name == app.auth.CookieName {
+					t.Error("refresh cookie set")
+				}
+			}
+		})
+	}
+}
+
+func TestOIDCLoginReturnTo(t *testing.T) {
+	idp := oidctest.NewServer("movies", "s3cret", oidctest.User{
+		Subject:       "admin-sso",
+		Email:         "admin@example.com",
+		EmailVerified: true,
+	})
+	defer idp.Close()
+
+	app, srv := newOIDCTestApp(t, idp)
+
+	resp, err := http.Get(srv.URL + "/oidc/login?return_to=" + url.QueryEscape("https://evil.example.com/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("foreign return_to: got %s", resp.Status)
+	}
+
+	resp = ssoLogin(t, srv, "?return_to="+url.QueryEscape(app.FrontendURL+"/admin"), false)
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != app.FrontendURL+"/admin" {
+		t.Fatalf("got %s to %q", resp.Status, resp.Header.Get("Location"))
+	}
+
+	var refresh string
+	for _, c := range resp.Cookies() {
+		if c.Name == app.auth.CookieName {
+			refresh = c.Value
+		}
+	}
+	claims, err := app.auth.ParseRefreshToken(refresh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "1" {
+		t.Errorf("session of user %s, want 1", claims.Subject)
+	}
+}
+
+func TestOIDCLoginSecondFactor(t *testing.T) {
+	tests := []struct {
+		name      string
+		amr       []string
+		acr       string
+		returnTo  bool
+		challenge bool
+	}{
+		{name: "no authentication methods", challenge: true},
+		{name: "password only", amr: []string{"pwd"}, challenge: true},
+		{name: "password only, redirected", amr: []string{"pwd"}, returnTo: true, challenge: true},
+		{name: "mfa method", amr: []string{"pwd", "otp", "mfa"}},
+		{name: "multi-factor acr", acr: oidc.ACRMultiFactor},
+		{name: "mfa method, redirected", amr: []string{"mfa"}, returnTo: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := oidctest.NewServer("movies", "s3cret", oidctest.User{
+				Subject:       "admin-sso",
+				Email:         "admin@example.com",
+				EmailVerified: true,
+				AMR:           tt.amr,
+				ACR:           tt.acr,
+			})
+			defer idp.Close()
+
+			app, srv := newOIDCTestApp(t, idp)
+
+			// The seeded admin turned on two-factor authentication
+			secret, err := totp.GenerateSecret()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := app.DB.UpdateUserTOTP(context.Background(), 1, secret, true); err != nil {
+				t.Fatal(err)
+			}
+
+			query := ""
+			if tt.returnTo {
+				query = "?return_to=" + url.QueryEscape(app.FrontendURL+"/")
+			}
+			resp := ssoLogin(t, srv, query, false)
+
+			if !tt.challenge {
+				if tt.returnTo {
+					if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != app.FrontendURL+"/" {
+						t.Fatalf("got %s to %q", resp.Status, resp.Header.Get("Location"))
+					}
+					return
+				}
+				if id := sessionUserID(t, app, resp); id != "1" {
+					t.Errorf("logged in as user %s, want the seeded admin", id)
+				}
+				return
+			}
+
+			for _, c := range resp.Cookies() {
+				if c.Name == app.auth.CookieName {
+					t.Error("refresh cookie set before the second factor")
+				}
+			}
+
+			var token string
+			if tt.returnTo {
+				if resp.StatusCode != http.StatusSeeOther {
+					t.Fatalf("got %s", resp.Status)
+				}
+				location, err := url.Parse(resp.Header.Get("Location"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				fragment, err := url.ParseQuery(location.Fragment)
+				if err != nil {
+					t.Fatal(err)
+				}
+				token = fragment.Get("mfa_token")
+			} else {
+				if resp.StatusCode != http.StatusAccepted {
+					t.Fatalf("got %s", resp.Status)
+				}
+				var challenge mfaChallenge
+				if err := json.NewDecoder(resp.Body).Decode(&challenge); err != nil {
+					t.Fatal(err)
+				}
+				if !challenge.MFARequired {
+					t.Error("mfa_required not set")
+				}
+				token = challenge.Token
+			}
+
+			claims, err := app.auth.ValidateToken(token, tokenTypeMFA)
+			if err != nil {
+				t.Fatalf("challenge token: %v", err)
+			}
+			if claims.Subject != "1" {
+				t.Errorf("challenge for user %s, want 1", claims.Subject)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/snirkop89/go-movies/internal/mailer"
+	"github.com/snirkop89/go-movies/internal/models"
+	"github.com/snirkop89/go-movies/internal/repository"
+)
+
+// passwordResetExpiry is how long a password reset token can be used.
+const passwordResetExpiry = time.Hour
+
+var errInvalidResetToken = errors.New("invalid or expired password reset token")
+
+// hashResetToken returns the stored form of a password reset token.
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ForgotPassword emails a password reset link to the user. The response is
+// the same whether the email is registered or not, and the email is sent in
+// the background so that a slow mail server doesn't hold the response. The
+// requests are throttled per email and per client.
+func (app *application) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Email string `json:"email"`
+	}
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "if an account exists for this email, a password reset link has been sent to it",
+	}
+
+	// Throttled whether the email is registered or not, so that the answer
+	// tells nothing
+	email := models.NormalizeEmail(payload.Email)
+	ip := clientIP(r)
+	if app.blocked(w, r, errTooManyResets, accountResetKey(email), clientResetKey(ip)) {
+		return
+	}
+	app.recordAttempts(r, []throttled{
+		{accountResetKey(email), accountResetPolicy},
+		{clientResetKey(ip), clientResetPolicy},
+	})
+
+	user, err := app.DB.UserByEmail(r.Context(), email)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.writeJSON(w, http.StatusAccepted, resp)
+			return
+		}
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	token, err := randomToken(32)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	err = app.DB.InsertPasswordReset(r.Context(), models.PasswordReset{
+		TokenHash: hashResetToken(token),
+		UserID:    user.ID,
+		ExpiresAt: now.Add(passwordResetExpiry),
+		CreatedAt: now,
+	})
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	link := fmt.Sprintf("%s/password/reset?token=%s", app.FrontendURL, url.QueryEscape(token))
+	msg := mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\n"+
+			"Someone asked to reset the password of your account. To choose a new\n"+
+			"password, open the link below within %d minutes:\n\n%s\n\n"+
+			"If it wasn't you, ignore this email, your password stays the same.\n",
+			user.FirstName, int(passwordResetExpiry.Minutes()), link),
+	}
+
+	app.background(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		if err := app.Mailer.Send(ctx, msg); err != nil {
+			app.logger.WithFields("user_id", strconv.Itoa(user.ID), "error", err.Error()).Error("send password reset email")
+		}
+	})
+
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
+// ResetPassword sets a new password with a token sent by ForgotPassword. Every
+// session of the user is revoked, along with their other reset tokens.
+func (app *application) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	var userID int
+	var invalidPassword error
+
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		var err error
+		userID, err = repo.ConsumePasswordReset(r.Context(), hashResetToken(payload.Token), time.Now())
+		if err != nil {
+			return err
+		}
+
+		user, err := repo.UserByID(r.Context(), userID)
+		if err != nil {
+			return err
+		}
+
+		// Rolling back keeps the token usable with a better password
+		invalidPassword = validatePassword(payload.Password, user.Email)
+		if invalidPassword != nil {
+			return invalidPassword
+		}
+
+		if err := user.SetPassword(payload.Password); err != nil {
+			return err
+		}
+		if err := repo.UpdateUserPassword(r.Context(), user.ID, user.Password); err != nil {
+			return err
+		}
+		if err := repo.RevokeUserRefreshTokens(r.Context(), user.ID); err != nil {
+			return err
+		}
+		if err := repo.DeleteUserPasswordResets(r.Context(), user.ID); err != nil {
+			return err
+		}
+
+		return repo.ClearLoginAttempts(r.Context(), accountLoginKey(models.NormalizeEmail(user.Email)))
+	})
+	if err != nil {
+		switch {
+		case invalidPassword != nil:
+			app.errorJSON(w, invalidPassword, http.StatusUnprocessableEntity)
+		case errors.Is(err, sql.ErrNoRows):
+			app.errorJSON(w, errInvalidResetToken)
+		default:
+			app.dbErrorJSON(w, err)
+		}
+		return
+	}
+
+	app.auditLog(r, auditEvent{Action: "password.reset", Entity: "user", EntityID: strconv.Itoa(userID), UserID: userID})
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "password updated, please log in again",
+	}
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
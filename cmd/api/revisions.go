@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/snirkop89/go-movies/internal/models"
+	"github.com/snirkop89/go-movies/internal/repository"
+)
+
+var errRevisionNotFound = errors.New("revision not found")
+
+// saveRevision saves movie, as stored after an edit, as its next revision.
+// It must be called in the transaction of the edit.
+func (app *application) saveRevision(r *http.Request, tx repository.DatabaseRepo, movie *models.Movie, restoredFrom int) (int, error) {
+	rev := models.MovieRevision{
+		MovieID:      movie.ID,
+		Movie:        *movie,
+		RestoredFrom: restoredFrom,
+		CreatedAt:    time.Now(),
+	}
+	if id, err := app.currentUserID(r); err == nil {
+		rev.UserID = &id
+	}
+
+	return tx.InsertMovieRevision(r.Context(), rev)
+}
+
+// saveBaseRevision saves movie as its first revision if it has none, so that
+// the first edit of a movie added before revisions were kept can be undone.
+func (app *application) saveBaseRevision(ctx context.Context, tx repository.DatabaseRepo, movie *models.Movie) error {
+	revs, err := tx.MovieRevisions(ctx, movie.ID)
+	if err != nil || len(revs) > 0 {
+		return err
+	}
+
+	_, err = tx.InsertMovieRevision(ctx, models.MovieRevision{
+		MovieID:   movie.ID,
+		Movie:     *movie,
+		CreatedAt: time.Now(),
+	})
+	return err
+}
+
+// movieContent is what an edit can change of a movie. Revisions are diffed on
+// it, leaving out the bookkeeping such as the version bumped by every edit.
+type movieContent struct {
+	Title       string    `json:"title"`
+	ReleaseDate time.Time `json:"release_date"`
+	Runtime     int       `json:"runtime"`
+	MPAARating  string    `json:"mpaa_rating"`
+	Description string    `json:"description"`
+	Image       string    `json:"image"`
+	Genres      []string  `json:"genres"` // sorted names
+}
+
+func movieContentOf(movie models.Movie) movieContent {
+	genres := make([]string, 0, len(movie.Genres))
+	for _, g := range movie.Genres {
+		genres = append(genres, g.Genre)
+	}
+	sort.Strings(genres)
+
+	return movieContent{
+		Title:       movie.Title,
+		ReleaseDate: movie.ReleaseDate,
+		Runtime:     movie.Runtime,
+		MPAARating:  movie.MPAARating,
+		Description: movie.Description,
+		Image:       movie.Image,
+		Genres:      genres,
+	}
+}
+
+// readRevisionParams reads the movie id and the revision number of the URL.
+func (app *application) readRevisionParams(r *http.Request) (int, int, error) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		return 0, 0, errors.New("invalid movie id")
+	}
+	revision, err := strconv.Atoi(chi.URLParam(r, "revision"))
+	if err != nil {
+		return 0, 0, errors.New("invalid revision")
+	}
+	return id, revision, nil
+}
+
+// MovieRevisions lists the revisions of a movie, newest first.
+func (app *application) MovieRevisions(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	revs, err := app.DB.MovieRevisions(r.Context(), id)
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, revs)
+}
+
+func (app *application) MovieRevision(w http.ResponseWriter, r *http.Request) {
+	id, revision, err := app.readRevisionParams(r)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	rev, err := app.DB.MovieRevision(r.Context(), id, revision)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			app.errorJSON(w, errRevisionNotFound, http.StatusNotFound)
+			return
+		}
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, rev)
+}
+
+// DiffMovieRevisions compares two revisions of a movie, given by the from
+// and to query string parameters, in either order.
+func (app *application) DiffMovieRevisions(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	qs := r.URL.Query()
+	from, err := app.readInt(qs, "from", 0)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+	to, err := app.readInt(qs, "to", 0)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+	if from < 1 || to < 1 {
+		app.errorJSON(w, errors.New("from and to must be revision numbers"))
+		return
+	}
+
+	var revs [2]*models.MovieRevision
+	for i, n := range []int{from, to} {
+		revs[i], err = app.DB.MovieRevision(r.Context(), id, n)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				app.errorJSON(w, errRevisionNotFound, http.StatusNotFound)
+				return
+			}
+			app.dbErrorJSON(w, err)
+			return
+		}
+	}
+
+	changes, err := auditDiff(movieContentOf(revs[0].Movie), movieContentOf(revs[1].Movie))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	if changes == nil {
+		changes = json.RawMessage("{}")
+	}
+
+	app.writeJSON(w, http.StatusOK, struct {
+		From    int             `json:"from"`
+		To      int             `json:"to"`
+		Changes json.RawMessage `json:"changes"`
+	}{from, to, changes})
+}
+
+// RestoreMovieRevision sets a movie and its genres back to an old revision.
+// The restored state is saved as a new revision, history is never rewritten.
+// Genres deleted since the revision are left out. As every write of a movie,
+// it requires the ETag of the movie in If-Match.
+func (app *application) RestoreMovieRevision(w http.ResponseWriter, r *http.Request) {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		app.errorJSON(w, errors.New("If-Match header is required"), http.StatusPreconditionRequired)
+		return
+	}
+
+	id, revision, err := app.readRevisionParams(r)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	var newRevision int
+	var restored *models.Movie
+
+	err = app.DB.WithTx(r.Context(), func(tx repository.DatabaseRepo) error {
+		rev, err := tx.MovieRevision(r.Context(), id, revision)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return errRevisionNotFound
+			}
+			return err
+		}
+
+		movie, err := tx.OneMovie(r.Context(), id)
+		if err != nil {
+			return err
+		}
+		if !etagMatches(ifMatch, movieETag(movie)) {
+			return repository.ErrEditConflict
+		}
+		before := *movie
+
+		movie.Title = rev.Movie.Title
+		movie.ReleaseDate = rev.Movie.ReleaseDate
+		movie.Runtime = rev.Movie.Runtime
+		movie.MPAARating = rev.Movie.MPAARating
+		movie.Description = rev.Movie.Description
+		movie.Image = rev.Movie.Image
+		movie.UpdateAt = time.Now()
+
+		err = tx.UpdateMovie(r.Context(), *movie)
+		if err != nil {
+			return err
+		}
+
+		var genreIDs []int
+		for _, g := range rev.Movie.Genres {
+			_, err := tx.OneGenre(r.Context(), g.ID)
+			switch {
+			case err == nil:
+				genreIDs = append(genreIDs, g.ID)
+			case !errors.Is(err, sql.ErrNoRows):
+				return err
+			}
+		}
+		err = tx.UpdateMovieGenres(r.Context(), id, genreIDs)
+		if err != nil {
+			return err
+		}
+
+		after, err := tx.OneMovie(r.Context(), id)
+		if err != nil {
+			return err
+		}
+
+		newRevision, err = app.saveRevision(r, tx, after, revision)
+		if err != nil {
+			return err
+		}
+		restored = after
+
+		return app.audit(r, tx, auditEvent{
+			Action:   "restore",
+			Entity:   "movie",
+			EntityID: strconv.Itoa(id),
+			Before:   before,
+			After:    after,
+		})
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, errRevisionNotFound):
+			app.errorJSON(w, err, http.StatusNotFound)
+		case errors.Is(err, repository.ErrEditConflict):
+			app.movieConflictJSON(w, r, id)
+		default:
+			app.dbErrorJSON(w, err)
+		}
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "revision restored",
+		Data:    map[string]int{"revision": newRevision},
+	}
+	app.writeJSON(w, http.StatusAccepted, resp, http.Header{"ETag": {movieETag(restored)}})
+}
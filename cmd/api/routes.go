@@ -5,6 +5,7 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/snirkop89/go-movies/internal/models"
 )
 
 func (app *application) routes() http.Handler {
@@ -16,29 +17,89 @@ func (app *application) routes() http.Handler {
 	mux.Use(app.logging)
 
 	mux.Get("/", app.Home)
+	mux.Get("/.well-known/jwks.json", app.JWKS)
 
 	// User related routes
 	mux.Post("/authenticate", app.authenticate)
+	mux.Post("/authenticate/mfa", app.authenticateMFA)
 	mux.Get("/refresh", app.refreshToken)
 	mux.Get("/logout", app.logout)
+	mux.Post("/signup", app.signup)
+	mux.Post("/password/forgot", app.ForgotPassword)
+	mux.Post("/password/reset", app.ResetPassword)
+	mux.Get("/oidc/login", app.OIDCLogin)
+	mux.Get("/oidc/callback", app.OIDCCallback)
+
+	mux.Route("/account", func(mux chi.Router) {
+		mux.Use(app.authRequired)
+		mux.Use(app.requireSession)
+
+		mux.Get("/", app.GetAccount)
+		mux.Patch("/", app.UpdateAccount)
+		mux.Delete("/", app.DeleteAccount)
+		mux.Put("/password", app.ChangePassword)
+		mux.Post("/sessions/revoke", app.RevokeSessions)
+
+		mux.Post("/mfa/totp", app.EnrollTOTP)
+		mux.Post("/mfa/totp/verify", app.VerifyTOTP)
+		mux.Delete("/mfa/totp", app.DisableTOTP)
+		mux.Post("/mfa/recovery-codes", app.RegenerateRecoveryCodes)
+
+		mux.Get("/api-keys", app.ListAPIKeys)
+		mux.Post("/api-keys", app.CreateAPIKey)
+		mux.Delete("/api-keys/{id}", app.RevokeAPIKey)
+	})
 
 	// Movies related routes
 	mux.Get("/movies", app.AllMovies)
+	mux.Get("/movies/search", app.SearchMovies)
 	mux.Get("/movies/{id}", app.GetMovie)
 
 	mux.Get("/genres", app.AllGenres)
 	mux.Get("/movies/genres/{id}", app.AllMoviesByGenre)
 
-	mux.Post("/graph", app.moviesGraphQL)
+	mux.With(app.authOptional).Get("/graph", app.moviesGraphQL)
+	mux.With(app.authOptional).Post("/graph", app.moviesGraphQL)
 
 	mux.Route("/admin", func(mux chi.Router) {
 		mux.Use(app.authRequired)
+		mux.Use(app.requireRole(models.RoleEditor))
+		mux.Use(app.requireScopes(models.ScopeCatalogueWrite))
 
 		mux.Get("/movies", app.MovieCatalog)
 		mux.Get("/movies/{id}", app.EditMovie)
 		mux.Put("/movies/0", app.insertMovie)
 		mux.Patch("/movies/{id}", app.UpdateMovie)
-		mux.Delete("/movies/{id}", app.DeleteMovie)
+		mux.Get("/movies/{id}/revisions", app.MovieRevisions)
+		mux.Get("/movies/{id}/revisions/diff", app.DiffMovieRevisions)
+		mux.Get("/movies/{id}/revisions/{revision}", app.MovieRevision)
+		mux.Post("/movies/{id}/revisions/{revision}/restore", app.RestoreMovieRevision)
+
+		mux.Post("/genres", app.insertGenre)
+		mux.Patch("/genres/{id}", app.UpdateGenre)
+
+		// Destructive and user management routes are restricted to admins
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.requireRole(models.RoleAdmin))
+
+			mux.Delete("/movies/{id}", app.DeleteMovie)
+			mux.Get("/trash", app.TrashedMovies)
+			mux.Post("/trash/{id}/restore", app.RestoreTrashedMovie)
+			mux.Delete("/trash/{id}", app.PurgeTrashedMovie)
+			mux.Post("/genres/{id}/merge", app.MergeGenres)
+			mux.Delete("/genres/{id}", app.DeleteGenre)
+
+			mux.Group(func(mux chi.Router) {
+				mux.Use(app.requireSession)
+
+				mux.Get("/audit", app.AuditLog)
+				mux.Put("/users/{id}/role", app.UpdateUserRole)
+				mux.Delete("/users/{id}/sessions", app.RevokeUserSessions)
+				mux.Delete("/users/{id}/lockout", app.ClearLoginLockout)
+				mux.Delete("/users/{id}/mfa", app.ResetUserMFA)
+				mux.Delete("/lockouts/ip/{ip}", app.ClearClientLockout)
+			})
+		})
 	})
 
 	return mux
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/snirkop89/go-movies/internal/models"
+)
+
+var (
+	errTooManyLogins = errors.New("too many failed login attempts, try again later")
+	errTooManyResets = errors.New("too many password reset requests, try again later")
+)
+
+// loginPolicy decides how failed logins are throttled. The first Free
+// failures cost nothing, each following one blocks logins for BaseDelay,
+// doubled every time up to MaxDelay, and MaxFailures failures lock logins
+// out for Lockout. Failures older than Window are forgotten.
+type loginPolicy struct {
+	Free        int
+	MaxFailures int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Lockout     time.Duration
+	Window      time.Duration
+}
+
+// Accounts are locked out quickly, client addresses are allowed more
+// failures since they may be shared by many users.
+var (
+	accountLoginPolicy = loginPolicy{
+		Free:        2,
+		MaxFailures: 5,
+		BaseDelay:   time.Second,
+		MaxDelay:    time.Minute,
+		Lockout:     15 * time.Minute,
+		Window:      15 * time.Minute,
+	}
+	clientLoginPolicy = loginPolicy{
+		Free:        10,
+		MaxFailures: 50,
+		BaseDelay:   time.Second,
+		MaxDelay:    time.Minute,
+		Lockout:     15 * time.Minute,
+		Window:      15 * time.Minute,
+	}
+)
+
+// delay returns how long logins are blocked after the given number of
+// failures, and whether this is a lockout.
+func (p loginPolicy) delay(failures int) (time.Duration, bool) {
+	switch {
+	case failures >= p.MaxFailures:
+		return p.Lockout, true
+	case failures <= p.Free:
+		return 0, false
+	}
+
+	d := p.BaseDelay
+	for i := p.Free + 1; i < failures && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d, false
+}
+
+// Password reset emails are throttled as failed logins, every request
+// counting as a failure: an address gets a few emails an hour, a client a few
+// more.
+var (
+	accountResetPolicy = loginPolicy{
+		Free:        3,
+		MaxFailures: 6,
+		BaseDelay:   time.Minute,
+		MaxDelay:    15 * time.Minute,
+		Lockout:     time.Hour,
+		Window:      time.Hour,
+	}
+	clientResetPolicy = loginPolicy{
+		Free:        10,
+		MaxFailures: 30,
+		BaseDelay:   time.Second,
+		MaxDelay:    time.Minute,
+		Lockout:     time.Hour,
+		Window:      time.Hour,
+	}
+)
+
+// accountLoginKey and clientLoginKey identify the login attempts of an
+// email address, registered or not, and of a client address.
+func accountLoginKey(email string) string { return "email:" + email }
+func clientLoginKey(ip string) string     { return "ip:" + ip }
+
+// accountResetKey and clientResetKey identify the password reset requests of
+// an email address and of a client address.
+func accountResetKey(email string) string { return "reset:email:" + email }
+func clientResetKey(ip string) string     { return "reset:ip:" + ip }
+
+// clientIP returns the address of the client making the request.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// loginBlockedFor returns how long logins are still blocked for any of keys.
+func (app *application) loginBlockedFor(ctx context.Context, keys ...string) (time.Duration, error) {
+	now := time.Now()
+
+	var wait time.Duration
+	for _, key := range keys {
+		attempts, err := app.DB.LoginAttempts(ctx, key)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			}
+			return 0, err
+		}
+		if attempts.Locked(now) && attempts.LockedUntil.Sub(now) > wait {
+			wait = attempts.LockedUntil.Sub(now)
+		}
+	}
+
+	return wait, nil
+}
+
+// loginBlocked answers with 429 and returns true while the attempts of the
+// email or of the client address are blocked. Every check of a password or
+// a code goes through it, not only logins.
+func (app *application) loginBlocked(w http.ResponseWriter, r *http.Request, email, ip string) bool {
+	return app.blocked(w, r, errTooManyLogins, accountLoginKey(email), clientLoginKey(ip))
+}
+
+// blocked answers with 429 and errTooMany, and returns true, while the
+// attempts of any of keys are blocked.
+func (app *application) blocked(w http.ResponseWriter, r *http.Request, errTooMany error, keys ...string) bool {
+	wait, err := app.loginBlockedFor(r.Context(), keys...)
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return true
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds()+1)))
+		app.errorJSON(w, errTooMany, http.StatusTooManyRequests)
+		return true
+	}
+	return false
+}
+
+// loginFailed records a failed login for the email and the client address,
+// blocking further attempts as required by their policies. Errors are only
+// logged, the caller answers with invalid credentials either way.
+func (app *application) loginFailed(r *http.Request, email, ip string) {
+	app.auditLog(r, auditEvent{Action: "login.failed", Entity: "login", EntityID: accountLoginKey(email)})
+
+	app.recordAttempts(r, []throttled{
+		{accountLoginKey(email), accountLoginPolicy},
+		{clientLoginKey(ip), clientLoginPolicy},
+	})
+}
+
+// throttled is a key whose attempts are throttled by policy.
+type throttled struct {
+	key    string
+	policy loginPolicy
+}
+
+// recordAttempts records an attempt for each key, blocking the following ones
+// as required by their policies. Errors are only logged.
+func (app *application) recordAttempts(r *http.Request, keys []throttled) {
+	ctx := r.Context()
+	now := time.Now()
+
+	for _, t := range keys {
+		attempts, err := app.DB.RecordLoginFailure(ctx, t.key, now, t.policy.Window)
+		if err != nil {
+			app.logger.WithFields("key", t.key, "error", err.Error()).Error("record login failure")
+			continue
+		}
+
+		d, lockout := t.policy.delay(attempts.Failures)
+		if d == 0 {
+			continue
+		}
+		if err := app.DB.LockLogin(ctx, t.key, now.Add(d)); err != nil {
+			app.logger.WithFields("key", t.key, "error", err.Error()).Error("lock login")
+			continue
+		}
+
+		if lockout {
+			app.auditLog(r, auditEvent{
+				Action:   "lockout",
+				Entity:   "login",
+				EntityID: t.key,
+				After: map[string]any{
+					"failures":     attempts.Failures,
+					"locked_until": now.Add(d).UTC(),
+				},
+			})
+		}
+	}
+}
+
+// rehashPassword stores the password of user hashed with the current cost.
+// Failing only delays the upgrade to the next login.
+func (app *application) rehashPassword(r *http.Request, user *models.User, plaintext string) {
+	err := user.SetPassword(plaintext)
+	if err == nil {
+		err = app.DB.UpdateUserPassword(r.Context(), user.ID, user.Password)
+	}
+	if err != nil {
+		app.logger.WithFields("user_id", strconv.Itoa(user.ID), "error", err.Error()).Warn("rehash password")
+	}
+}
+
+// dummyUser has a password hash of the current cost, checked against when
+// the email is unknown so that the response takes as long as for a wrong
+// password.
+var dummyUser = func() models.User {
+	var u models.User
+	if err := u.SetPassword("not anybody's password"); err != nil {
+		panic(err)
+	}
+	return u
+}()
+
+// ClearLoginLockout lets an admin lift the throttling of a user's account.
+func (app *application) ClearLoginLockout(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.DB.UserByID(r.Context(), id)
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	app.clearLoginLockout(w, r, accountLoginKey(models.NormalizeEmail(user.Email)))
+}
+
+// ClearClientLockout lets an admin lift the throttling of a client address.
+func (app *application) ClearClientLockout(w http.ResponseWriter, r *http.Request) {
+	ip := net.ParseIP(chi.URLParam(r, "ip"))
+	if ip == nil {
+		app.errorJSON(w, errors.New("invalid ip address"))
+		return
+	}
+
+	app.clearLoginLockout(w, r, clientLoginKey(ip.String()))
+}
+
+func (app *application) clearLoginLockout(w http.ResponseWriter, r *http.Request, key string) {
+	err := app.DB.ClearLoginAttempts(r.Context(), key)
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	app.auditLog(r, auditEvent{Action: "unlock", Entity: "login", EntityID: key})
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "lockout cleared",
+	}
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/snirkop89/go-movies/internal/models"
+	"github.com/snirkop89/go-movies/internal/repository"
+)
+
+var errNotInTrash = errors.New("movie is not in the trash")
+
+// trashedMovie is a movie of the trash, with the time it will be purged at
+// when a retention is set.
+type trashedMovie struct {
+	*models.Movie
+	PurgeAt *time.Time `json:"purge_at,omitempty"`
+}
+
+// TrashedMovies lists the deleted movies, most recently deleted first.
+func (app *application) TrashedMovies(w http.ResponseWriter, r *http.Request) {
+	movies, err := app.DB.TrashedMovies(r.Context())
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	trash := make([]trashedMovie, 0, len(movies))
+	for _, movie := range movies {
+		t := trashedMovie{Movie: movie}
+		if app.TrashRetention > 0 {
+			purgeAt := movie.DeletedAt.Add(app.TrashRetention)
+			t.PurgeAt = &purgeAt
+		}
+		trash = append(trash, t)
+	}
+
+	app.writeJSON(w, http.StatusOK, trash)
+}
+
+// RestoreTrashedMovie takes a movie out of the trash.
+func (app *application) RestoreTrashedMovie(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.DB.WithTx(r.Context(), func(tx repository.DatabaseRepo) error {
+		err := tx.RestoreMovie(r.Context(), id)
+		if err != nil {
+			return err
+		}
+
+		after, err := tx.OneMovie(r.Context(), id)
+		if err != nil {
+			return err
+		}
+
+		return app.audit(r, tx, auditEvent{
+			Action:   "untrash",
+			Entity:   "movie",
+			EntityID: strconv.Itoa(id),
+			After:    after,
+		})
+	})
+	if err != nil {
+		app.trashErrorJSON(w, err)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "movie restored",
+	}
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
+// PurgeTrashedMovie deletes a movie of the trash for good, with its
+// revisions.
+func (app *application) PurgeTrashedMovie(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.DB.WithTx(r.Context(), func(tx repository.DatabaseRepo) error {
+		err := tx.PurgeMovie(r.Context(), id)
+		if err != nil {
+			return err
+		}
+
+		return app.audit(r, tx, auditEvent{
+			Action:   "purge",
+			Entity:   "movie",
+			EntityID: strconv.Itoa(id),
+		})
+	})
+	if err != nil {
+		app.trashErrorJSON(w, err)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "movie purged",
+	}
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
+// trashErrorJSON writes err, telling apart movies missing from the trash.
+func (app *application) trashErrorJSON(w http.ResponseWriter, err error) {
+	if errors.Is(err, sql.ErrNoRows) {
+		app.errorJSON(w, errNotInTrash, http.StatusNotFound)
+		return
+	}
+	app.dbErrorJSON(w, err)
+}
+
+// purgeExpiredTrash purges the movies trashed longer ago than the retention,
+// recording each in the audit log.
+func (app *application) purgeExpiredTrash(ctx context.Context) (int, error) {
+	var purged int
+
+	err := app.DB.WithTx(ctx, func(tx repository.DatabaseRepo) error {
+		now := time.Now()
+
+		ids, err := tx.PurgeTrash(ctx, now.Add(-app.TrashRetention))
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			err := tx.InsertAuditEntry(ctx, models.AuditEntry{
+				Action:    "purge",
+				Entity:    "movie",
+				EntityID:  strconv.Itoa(id),
+				CreatedAt: now,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		purged = len(ids)
+		return nil
+	})
+
+	return purged, err
+}
+
+// purgeTrashEvery runs purgeExpiredTrash now and then at every interval.
+func (app *application) purgeTrashEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		app.purgeTrash()
+		<-ticker.C
+	}
+}
+
+// purgeTrash runs purgeExpiredTrash once, logging what it did. Panics are
+// recovered here, so that the next runs still happen.
+func (app *application) purgeTrash() {
+	defer func() {
+		if err := recover(); err != nil {
+			app.logger.WithFields("error", fmt.Sprint(err)).Error("purge trash")
+		}
+	}()
+
+	n, err := app.purgeExpiredTrash(context.Background())
+	if err != nil {
+		app.logger.WithFields("error", err.Error()).Error("purge trash")
+	} else if n > 0 {
+		app.logger.Infof("Purged %d movies from the trash", n)
+	}
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/snirkop89/go-movies/internal/mailer"
+	"github.com/snirkop89/go-movies/internal/models"
+	"github.com/snirkop89/go-movies/internal/repository"
+)
+
+const (
+	minPasswordLength = 10
+	maxPasswordLength = 72 // bcrypt ignores anything longer
+)
+
+var errEmailTaken = errors.New("an account with this email address already exists")
+
+// validateEmail checks that email is a bare, well formed address.
+func validateEmail(email string) error {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || addr.Name != "" {
+		return errors.New("invalid email address")
+	}
+	if len(email) > 255 {
+		return errors.New("email must not be more than 255 bytes long")
+	}
+	return nil
+}
+
+// validatePassword enforces the password policy: between minPasswordLength
+// and maxPasswordLength bytes, with at least a letter and a digit, and not
+// derived from the email address.
+func validatePassword(password, email string) error {
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("password must be at least %d characters long", minPasswordLength)
+	}
+	if len(password) > maxPasswordLength {
+		return fmt.Errorf("password must not be more than %d bytes long", maxPasswordLength)
+	}
+
+	var letter, digit bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			letter = true
+		case unicode.IsDigit(r):
+			digit = true
+		}
+	}
+	if !letter || !digit {
+		return errors.New("password must contain at least a letter and a digit")
+	}
+
+	lower := strings.ToLower(password)
+	local, _, _ := strings.Cut(email, "@")
+	if lower == email || (len(local) >= 4 && strings.Contains(lower, local)) {
+		return errors.New("password must not contain the email address")
+	}
+
+	return nil
+}
+
+// validateName checks a first or last name.
+func validateName(field, name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("%s must be provided", field)
+	case len(name) > 255:
+		return fmt.Errorf("%s must not be more than 255 bytes long", field)
+	}
+	return nil
+}
+
+// currentUserID returns the id of the user making the request, taken from
+// the claims verified by authRequired.
+func (app *application) currentUserID(r *http.Request) (int, error) {
+	claims := app.claimsFromContext(r)
+	if claims == nil {
+		return 0, errors.New("no authenticated user")
+	}
+
+	return strconv.Atoi(claims.Subject)
+}
+
+// currentUser loads the user making the request.
+func (app *application) currentUser(r *http.Request) (*models.User, error) {
+	id, err := app.currentUserID(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return app.DB.UserByID(r.Context(), id)
+}
+
+func (app *application) signup(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		FirstName string `json:"first_name"`
+		LastName  string `json:"last_name"`
+		Email     string `json:"email"`
+		Password  string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user := models.User{
+		FirstName: strings.TrimSpace(payload.FirstName),
+		LastName:  strings.TrimSpace(payload.LastName),
+		Email:     models.NormalizeEmail(payload.Email),
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+
+	for _, check := range []error{
+		validateName("first_name", user.FirstName),
+		validateName("last_name", user.LastName),
+		validateEmail(user.Email),
+		validatePassword(payload.Password, user.Email),
+	} {
+		if check != nil {
+			app.errorJSON(w, check, http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	err = user.SetPassword(payload.Password)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	user.ID, err = app.DB.InsertUser(r.Context(), user)
+	if err != nil {
+		if errors.Is(err, repository.ErrDuplicate) {
+			app.errorJSON(w, errEmailTaken, http.StatusConflict)
+			return
+		}
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	app.auditLog(r, auditEvent{
+		Action:   "signup",
+		Entity:   "user",
+		EntityID: strconv.Itoa(user.ID),
+		UserID:   user.ID,
+		After:    user,
+	})
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "account created",
+		Data:    user,
+	}
+	app.writeJSON(w, http.StatusCreated, resp)
+}
+
+func (app *application) GetAccount(w http.ResponseWriter, r *http.Request) {
+	user, err := app.currentUser(r)
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, user)
+}
+
+func (app *application) UpdateAccount(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		FirstName *string `json:"first_name"`
+		LastName  *string `json:"last_name"`
+		Email     *string `json:"email"`
+
+		// Required to change the email, as password resets are sent to it
+		CurrentPassword string `json:"current_password"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.currentUser(r)
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	before := *user
+
+	emailChanged := payload.Email != nil && models.NormalizeEmail(*payload.Email) != models.NormalizeEmail(user.Email)
+	if emailChanged && !app.confirmPassword(w, r, user, payload.CurrentPassword) {
+		return
+	}
+
+	if payload.FirstName != nil {
+		user.FirstName = strings.TrimSpace(*payload.FirstName)
+	}
+	if payload.LastName != nil {
+		user.LastName = strings.TrimSpace(*payload.LastName)
+	}
+	if payload.Email != nil {
+		user.Email = models.NormalizeEmail(*payload.Email)
+	}
+	user.UpdatedAt = time.Now()
+
+	for _, check := range []error{
+		validateName("first_name", user.FirstName),
+		validateName("last_name", user.LastName),
+		validateEmail(user.Email),
+	} {
+		if check != nil {
+			app.errorJSON(w, check, http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	// The other sessions may have been opened by whoever changes the email
+	keepFamily := app.sessionFamily(r, user.ID)
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		if err := repo.UpdateUser(r.Context(), *user); err != nil {
+			return err
+		}
+		if !emailChanged {
+			return nil
+		}
+		return repo.RevokeOtherRefreshTokens(r.Context(), user.ID, keepFamily)
+	})
+	if err != nil {
+		if errors.Is(err, repository.ErrDuplicate) {
+			app.errorJSON(w, errEmailTaken, http.StatusConflict)
+			return
+		}
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	app.auditLog(r, auditEvent{
+		Action:   "update",
+		Entity:   "user",
+		EntityID: strconv.Itoa(user.ID),
+		Before:   before,
+		After:    user,
+	})
+
+	if emailChanged {
+		app.notifyEmailChange(before, user.Email)
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "account updated",
+		Data:    user,
+	}
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
+func (app *application) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.currentUser(r)
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	if !app.confirmPassword(w, r, user, payload.CurrentPassword) {
+		return
+	}
+
+	err = validatePassword(payload.NewPassword, user.Email)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+
+	err = user.SetPassword(payload.NewPassword)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	// The other sessions may have been opened with the old password
+	keepFamily := app.sessionFamily(r, user.ID)
+	err = app.DB.WithTx(r.Context(), func(repo repository.DatabaseRepo) error {
+		if err := repo.UpdateUserPassword(r.Context(), user.ID, user.Password); err != nil {
+			return err
+		}
+		return repo.RevokeOtherRefreshTokens(r.Context(), user.ID, keepFamily)
+	})
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	app.auditLog(r, auditEvent{Action: "password.change", Entity: "user", EntityID: strconv.Itoa(user.ID)})
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "password updated",
+	}
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
+// confirmPassword checks the password the caller confirms a change of their
+// account with, throttled as logins since the caller may only hold a stolen
+// access token. It answers and returns false unless the password matches.
+func (app *application) confirmPassword(w http.ResponseWriter, r *http.Request, user *models.User, password string) bool {
+	email := models.NormalizeEmail(user.Email)
+	ip := clientIP(r)
+	if app.loginBlocked(w, r, email, ip) {
+		return false
+	}
+
+	valid, err := user.PasswordMatches(password)
+	if err != nil || !valid {
+		app.loginFailed(r, email, ip)
+		app.errorJSON(w, errors.New("invalid credentials"), http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// notifyEmailChange tells the previous address of user that the email of the
+// account was changed, in case it wasn't them. The email is sent in the
+// background.
+func (app *application) notifyEmailChange(before models.User, email string) {
+	msg := mailer.Message{
+		To:      before.Email,
+		Subject: "The email address of your account was changed",
+		Body: fmt.Sprintf("Hi %s,\n\n"+
+			"The email address of your account was changed to %s.\n\n"+
+			"If it wasn't you, contact an administrator right away: the password\n"+
+			"reset links are now sent to the new address.\n",
+			before.FirstName, email),
+	}
+
+	app.background(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		if err := app.Mailer.Send(ctx, msg); err != nil {
+			app.logger.WithFields("user_id", strconv.Itoa(before.ID), "error", err.Error()).Error("send email change notice")
+		}
+	})
+}
+
+// sessionFamily returns the refresh token family of the session making the
+// request, when its refresh token cookie belongs to userID.
+func (app *application) sessionFamily(r *http.Request, userID int) string {
+	cookie, err := r.Cookie(app.auth.CookieName)
+	if err != nil {
+		return ""
+	}
+	claims, err := app.auth.ParseRefreshToken(cookie.Value)
+	if err != nil || claims.Subject != strconv.Itoa(userID) {
+		return ""
+	}
+	return claims.Family
+}
+
+// DeleteAccount deletes the account of the caller, who must confirm with
+// their password.
+func (app *application) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	user, err := app.currentUser(r)
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	if !app.confirmPassword(w, r, user, payload.Password) {
+		return
+	}
+
+	err = app.DB.WithTx(r.Context(), func(tx repository.DatabaseRepo) error {
+		err := tx.DeleteUser(r.Context(), user.ID)
+		if err != nil {
+			return err
+		}
+
+		return app.audit(r, tx, auditEvent{
+			Action:   "delete",
+			Entity:   "user",
+			EntityID: strconv.Itoa(user.ID),
+			Before:   user,
+		})
+	})
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	http.SetCookie(w, app.auth.GetExpiredRefreshCookie())
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "account deleted",
+	}
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
+// UpdateUserRole lets an admin change the role of a user.
+func (app *application) UpdateUserRole(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	var payload struct {
+		Role string `json:"role"`
+	}
+	err = app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	if !models.ValidRole(payload.Role) {
+		app.errorJSON(w, fmt.Errorf("invalid role %q", payload.Role), http.StatusUnprocessableEntity)
+		return
+	}
+
+	callerID, err := app.currentUserID(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusUnauthorized)
+		return
+	}
+	if callerID == id {
+		app.errorJSON(w, errors.New("you cannot change your own role"), http.StatusForbidden)
+		return
+	}
+
+	err = app.DB.WithTx(r.Context(), func(tx repository.DatabaseRepo) error {
+		before, err := tx.UserByID(r.Context(), id)
+		if err != nil {
+			return err
+		}
+
+		err = tx.UpdateUserRole(r.Context(), id, payload.Role)
+		if err != nil {
+			return err
+		}
+
+		after := *before
+		after.Role = payload.Role
+
+		return app.audit(r, tx, auditEvent{
+			Action:   "role.update",
+			Entity:   "user",
+			EntityID: strconv.Itoa(id),
+			Before:   before,
+			After:    after,
+		})
+	})
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "role updated",
+	}
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
+// RevokeSessions logs the caller out of every session by revoking all their
+// refresh tokens. Access tokens already issued stay valid until they expire.
+func (app *application) RevokeSessions(w http.ResponseWriter, r *http.Request) {
+	id, err := app.currentUserID(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	err = app.DB.RevokeUserRefreshTokens(r.Context(), id)
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	app.auditLog(r, auditEvent{Action: "sessions.revoke", Entity: "user", EntityID: strconv.Itoa(id)})
+
+	http.SetCookie(w, app.auth.GetExpiredRefreshCookie())
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "sessions revoked",
+	}
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
+// RevokeUserSessions lets an admin revoke every session of a user.
+func (app *application) RevokeUserSessions(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.errorJSON(w, err)
+		return
+	}
+
+	err = app.DB.RevokeUserRefreshTokens(r.Context(), id)
+	if err != nil {
+		app.dbErrorJSON(w, err)
+		return
+	}
+
+	app.auditLog(r, auditEvent{Action: "sessions.revoke", Entity: "user", EntityID: strconv.Itoa(id)})
+
+	resp := JSONResponse{
+		Error:   false,
+		Message: "sessions revoked",
+	}
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
@@ -1,10 +1,28 @@
 package main
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/snirkop89/go-movies/internal/repository"
+)
+
+// statusClientClosedRequest is the non-standard status (popularized by nginx)
+// used when the client went away before the response was ready.
+const statusClientClosedRequest = 499
+
+var (
+	errRequestCanceled = errors.New("request canceled")
+	errRequestTimeout  = errors.New("request timed out")
+	errNotFound        = errors.New("not found")
 )
 
 type JSONResponse struct {
@@ -59,6 +77,16 @@ func (app *application) errorJSON(w http.ResponseWriter, err error, status ...in
 		statusCode = status[0]
 	}
 
+	// Cancellations and timeouts take precedence over the caller's status
+	switch {
+	case errors.Is(err, context.Canceled):
+		err = errRequestCanceled
+		statusCode = statusClientClosedRequest
+	case errors.Is(err, context.DeadlineExceeded):
+		err = errRequestTimeout
+		statusCode = http.StatusGatewayTimeout
+	}
+
 	payload := JSONResponse{
 		Error:   true,
 		Message: err.Error(),
@@ -66,3 +94,76 @@ func (app *application) errorJSON(w http.ResponseWriter, err error, status ...in
 
 	return app.writeJSON(w, statusCode, payload)
 }
+
+// dbErrorJSON writes a repository error with the matching status code.
+func (app *application) dbErrorJSON(w http.ResponseWriter, err error) error {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return app.errorJSON(w, errNotFound, http.StatusNotFound)
+	case errors.Is(err, repository.ErrDuplicate), errors.Is(err, repository.ErrGenreInUse),
+		errors.Is(err, repository.ErrEditConflict):
+		return app.errorJSON(w, err, http.StatusConflict)
+	default:
+		app.logger.WithFields("error", err.Error()).Error("database error")
+		return app.errorJSON(w, err, http.StatusInternalServerError)
+	}
+}
+
+// etagMatches reports whether an If-Match header value lists etag, or is
+// "*". Weak tags never match, as If-Match uses the strong comparison.
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// readInt returns the integer value of a query string parameter, or def if
+// the parameter is missing.
+func (app *application) readInt(qs url.Values, key string, def int) (int, error) {
+	s := qs.Get(key)
+	if s == "" {
+		return def, nil
+	}
+
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return def, fmt.Errorf("%s must be an integer value", key)
+	}
+
+	return i, nil
+}
+
+// readCSV splits a comma separated query string parameter.
+func (app *application) readCSV(qs url.Values, key string) []string {
+	s := qs.Get(key)
+	if s == "" {
+		return nil
+	}
+
+	var values []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+
+	return values
+}
+
+// background runs fn in its own goroutine, logging a panic instead of
+// crashing the server.
+func (app *application) background(fn func()) {
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				app.logger.WithFields("error", fmt.Sprint(err)).Error("background task")
+			}
+		}()
+
+		fn()
+	}()
+}
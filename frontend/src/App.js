@@ -60,6 +60,18 @@ function App() {
     }
   }, [tickInterval])
 
+  // After single sign-on, accounts with two-factor authentication are sent
+  // back with the challenge token in the fragment, the code is asked on the
+  // login page
+  useEffect(() => {
+    const fragment = new URLSearchParams(window.location.hash.substring(1));
+    const mfaToken = fragment.get("mfa_token");
+    if (mfaToken) {
+      window.history.replaceState(null, "", window.location.pathname);
+      navigate("/login", { state: { mfaToken: mfaToken } });
+    }
+  }, [navigate])
+
   useEffect(() => {
     if (jwtToken === "") {
       const requestOptions = {
@@ -6,12 +6,36 @@ import TextArea from "./form/Textarea";
 import Checkbox from './form/Checkbox'
 import Swal from "sweetalert2";
 
+// formMovie returns the form state of a movie, from the movie and all genres
+// as returned by the API for editing.
+const formMovie = (data) => {
+    // Fix release date
+    data.movie.release_date = new Date(data.movie.release_date).toISOString().split('T')[0]
+
+    const checks = [];
+    data.genres.forEach(g => {
+        if ((data.movie.genres_array || []).indexOf(g.id) !== -1) {
+            checks.push({ id: g.id, checked: true, genre: g.genre })
+        } else {
+            checks.push({ id: g.id, checked: false, genre: g.genre })
+        }
+    })
+
+    return {
+        ...data.movie,
+        genres_array: data.movie.genres_array || [],
+        genres: checks,
+    }
+}
+
 const EditMovie = () => {
     const navigate = useNavigate();
     const { jwtToken } = useOutletContext();
 
     const [error, setError] = useState(null);
     const [errors, setErrors] = useState([]);
+    // Version of the movie being edited, sent back with the update
+    const [etag, setEtag] = useState("");
 
     const mpaaOptions = [
         { id: "G", value: "G" },
@@ -108,25 +132,11 @@ const EditMovie = () => {
                     if (resp.status !== 200) {
                         setError("Invalid response code: " + resp.status);
                     }
+                    setEtag(resp.headers.get("ETag") || "");
                     return resp.json()
                 })
                 .then(data => {
-                    // Fix release date
-                    data.movie.release_date = new Date(data.movie.release_date).toISOString().split('T')[0]
-
-                    const checks = [];
-                    data.genres.forEach(g => {
-                        if (data.movie.genres_array.indexOf(g.id) !== -1) {
-                            checks.push({ id: g.id, checked: true, genre: g.genre })
-                        } else {
-                            checks.push({ id: g.id, checked: false, genre: g.genre })
-                        }
-                    })
-
-                    setMovie({
-                        ...data.movie,
-                        genres: checks,
-                    })
+                    setMovie(formMovie(data));
                 })
                 .catch(err => {
                     console.log(err)
@@ -177,6 +187,7 @@ const EditMovie = () => {
         let method = "PUT";
         if (movie.id > 0) {
             method = "PATCH";
+            headers.append("If-Match", etag);
         }
 
         const requestBody = movie;
@@ -193,9 +204,23 @@ const EditMovie = () => {
         }
 
         fetch(`${process.env.REACT_APP_BACKEND}/admin/movies/${movie.id}`, requestOptions)
-            .then(resp => resp.json())
-            .then(data => {
-                if (data.error) {
+            .then(resp => {
+                if (resp.status === 412) {
+                    setEtag(resp.headers.get("ETag") || "");
+                }
+                return resp.json().then(data => ({ status: resp.status, data }))
+            })
+            .then(({ status, data }) => {
+                if (status === 412) {
+                    // Someone else saved the movie meanwhile, show their version
+                    setMovie(formMovie(data.data));
+                    Swal.fire({
+                        title: 'Movie changed',
+                        text: 'Someone else saved this movie while you were editing it. The form now shows their version, make your changes again and save.',
+                        icon: 'warning',
+                        confirmButtonText: 'OK',
+                    })
+                } else if (data.error) {
                     console.log(data.error);
                 } else {
                     navigate("/manage-catalogue");
@@ -238,7 +263,7 @@ const EditMovie = () => {
     const confirmDelete = () => {
         Swal.fire({
             title: 'Delete movie?',
-            text: "You cannot undo this action!",
+            text: "The movie will be moved to the trash, an admin can restore it until it is purged.",
             icon: 'warning',
             showCancelButton: true,
             confirmButtonColor: '#3085d6',
@@ -8,24 +8,27 @@ const GraphQL = () => {
     const [fullList, setFullList] = useState([]);
 
     // Perform a search
-    const performSearch = () => {
-        const payload = `
-        {
-            search(titleContains: "${searchTerm}") {
-                id
-                title
-                runtime
-                release_date
-                mpaa_rating
-            }
-        }`;
+    const performSearch = (term) => {
+        const payload = {
+            query: `
+            query Search($term: String) {
+                search(titleContains: $term) {
+                    id
+                    title
+                    runtime
+                    release_date
+                    mpaa_rating
+                }
+            }`,
+            variables: { term: term },
+        };
 
         const headers = new Headers();
-        headers.append("Content-Type", "application/graphql");
+        headers.append("Content-Type", "application/json");
 
         const requestOptions = {
             method: "POST",
-            body: payload,
+            body: JSON.stringify(payload),
             headers: headers,
         }
 
@@ -45,7 +48,7 @@ const GraphQL = () => {
         setSearchTerm(value);
 
         if (value.length > 2) {
-            performSearch();
+            performSearch(value);
         } else {
             setMovies(fullList);
         }
@@ -53,30 +56,34 @@ const GraphQL = () => {
 
     // useEffect
     useEffect(() => {
-        const payload = `
-        {
-            list {
-                id
-                title
-                runtime
-                release_date
-                mpaa_rating
-            }
-        }`;
+        const payload = {
+            query: `
+            {
+                movies(first: 100) {
+                    nodes {
+                        id
+                        title
+                        runtime
+                        release_date
+                        mpaa_rating
+                    }
+                }
+            }`,
+        };
 
         const headers = new Headers();
-        headers.append("Content-Type", "application/graphql");
+        headers.append("Content-Type", "application/json");
         
         const requestOptions = {
             method: "POST",
             headers: headers,
-            body: payload,
+            body: JSON.stringify(payload),
         }
 
         fetch(`${process.env.REACT_APP_BACKEND}/graph`, requestOptions)
             .then(resp => resp.json())
             .then(data => {
-                let theList = Object.values(data.data.list);
+                let theList = Object.values(data.data.movies.nodes);
                 setMovies(theList);
                 setFullList(theList);
             })
@@ -0,0 +1,21 @@
+// LoadMore shows how many movies of the listing are displayed, and a button
+// to fetch the next page while there is one.
+const LoadMore = (props) => {
+    return (
+        <div className="d-flex align-items-center mb-3">
+            <span className="text-muted me-3">
+                Showing {props.shown} of {props.total} movies
+            </span>
+            {props.nextCursor && (
+                <button
+                    className="btn btn-outline-secondary btn-sm"
+                    onClick={() => props.onLoad(props.nextCursor)}
+                >
+                    Load more
+                </button>
+            )}
+        </div>
+    )
+}
+
+export default LoadMore;
@@ -1,10 +1,15 @@
 import { useState } from "react";
-import { useNavigate, useOutletContext } from "react-router-dom";
+import { Link, useLocation, useNavigate, useOutletContext } from "react-router-dom";
 import Input from "./form/Input";
 
 const Login = () => {
+    // single sign-on may already have returned a challenge token
+    const location = useLocation();
+
     const [email, setEmail] = useState("");
     const [password, setPassword] = useState("");
+    const [mfaToken, setMfaToken] = useState(location.state?.mfaToken || "");
+    const [code, setCode] = useState("");
 
     const { setJwtToken } = useOutletContext();
     const { setAlertClassName } = useOutletContext();
@@ -16,11 +21,21 @@ const Login = () => {
     const handleSubmit = (event) => {
         event.preventDefault();
         
-        // build the request payload
+        // build the request payload, the second step sends the code
+        // along with the challenge token returned by the first one
         let payload = {
             email: email,
             password: password,
         }
+        let url = `${process.env.REACT_APP_BACKEND}/authenticate`;
+
+        if (mfaToken !== "") {
+            payload = {
+                mfa_token: mfaToken,
+                code: code,
+            }
+            url = `${process.env.REACT_APP_BACKEND}/authenticate/mfa`;
+        }
 
         const requestOptions = {
             method: "POST",
@@ -31,12 +46,16 @@ const Login = () => {
             body: JSON.stringify(payload)
         }
 
-        fetch(`${process.env.REACT_APP_BACKEND}/authenticate`, requestOptions)
+        fetch(url, requestOptions)
             .then(resp => resp.json())
             .then(data => {
                 if (data.error) {
                     setAlertClassName("alert-danger");
                     setAlertMessage(data.message);
+                } else if (data.mfa_required) {
+                    setMfaToken(data.mfa_token);
+                    setAlertClassName("d-none");
+                    setAlertMessage("");
                 } else {
                     setJwtToken(data.access_token);
                     setAlertClassName("d-none");
@@ -57,29 +76,56 @@ const Login = () => {
             <hr />
 
             <form onSubmit={handleSubmit}>
-                <Input
-                    title="Email Address"
-                    type="email"
-                    className="form-control"
-                    name="email"
-                    onChange={(event) => setEmail(event.target.value)}
-                />
-                <Input
-                    title="Password"
-                    type="password"
-                    className="form-control"
-                    name="password"
-                    onChange={(event) => setPassword(event.target.value)}
-                />
+                {mfaToken === "" ?
+                    <>
+                        <Input
+                            title="Email Address"
+                            type="email"
+                            className="form-control"
+                            name="email"
+                            onChange={(event) => setEmail(event.target.value)}
+                        />
+                        <Input
+                            title="Password"
+                            type="password"
+                            className="form-control"
+                            name="password"
+                            onChange={(event) => setPassword(event.target.value)}
+                        />
+                    </>
+                :
+                    <Input
+                        title="Authentication code or recovery code"
+                        type="text"
+                        className="form-control"
+                        name="code"
+                        onChange={(event) => setCode(event.target.value)}
+                    />
+                }
 
                 <hr />
 
                 <input
                     type="submit"
                     className="btn btn-primary"
-                    value="Login"
+                    value={mfaToken === "" ? "Login" : "Verify"}
                 />
             </form>
+
+            <p className="mt-3">
+                <Link to="/password/reset">Forgot your password?</Link>
+            </p>
+
+            {process.env.REACT_APP_SSO === "true" &&
+                // the backend redirects back here with the refresh cookie
+                // set, or a challenge token when a code is still required
+                <a
+                    className="btn btn-outline-secondary"
+                    href={`${process.env.REACT_APP_BACKEND}/oidc/login?return_to=${encodeURIComponent(window.location.origin + "/")}`}
+                >
+                    Sign in with SSO
+                </a>
+            }
         </div>
 
     )
@@ -1,8 +1,12 @@
 import { useEffect, useState } from "react";
 import { Link, useNavigate, useOutletContext } from "react-router-dom";
+import LoadMore from "./LoadMore";
 
 const ManageCatalogue = () => {
     const [movies, setMovies] = useState([]);
+    const [total, setTotal] = useState(0);
+    const [nextCursor, setNextCursor] = useState("");
+    const [cursor, setCursor] = useState("");
     const { jwtToken } = useOutletContext();
 
     const navigate = useNavigate();
@@ -21,15 +25,23 @@ const ManageCatalogue = () => {
             headers: headers,
         }
 
-        fetch(`${process.env.REACT_APP_BACKEND}/admin/movies`, requestOptions)
+        // The listing is paginated, each page is added to the movies shown
+        let url = `${process.env.REACT_APP_BACKEND}/admin/movies`;
+        if (cursor !== "") {
+            url += `?after=${encodeURIComponent(cursor)}`;
+        }
+
+        fetch(url, requestOptions)
             .then(resp => resp.json())
             .then(data => {
-                setMovies(data);
+                setMovies(movies => cursor === "" ? data.movies : movies.concat(data.movies));
+                setTotal(data.metadata.total_records);
+                setNextCursor(data.metadata.next_cursor || "");
             })
             .catch(err => {
                 console.log(err)
             })
-    }, [jwtToken, navigate]);
+    }, [jwtToken, navigate, cursor]);
     
     return (
         <div className="">
@@ -57,6 +69,7 @@ const ManageCatalogue = () => {
                     ))}
                 </tbody>
             </table>
+            <LoadMore shown={movies.length} total={total} nextCursor={nextCursor} onLoad={setCursor} />
         </div>
 
     )
@@ -1,8 +1,12 @@
 import { useEffect, useState } from "react";
 import { Link } from "react-router-dom";
+import LoadMore from "./LoadMore";
 
 const Movies = () => {
     const [movies, setMovies] = useState([]);
+    const [total, setTotal] = useState(0);
+    const [nextCursor, setNextCursor] = useState("");
+    const [cursor, setCursor] = useState("");
 
     useEffect(() => {
         const headers = new Headers();
@@ -13,15 +17,23 @@ const Movies = () => {
             headers: headers,
         }
 
-        fetch(`${process.env.REACT_APP_BACKEND}/movies`, requestOptions)
+        // The listing is paginated, each page is added to the movies shown
+        let url = `${process.env.REACT_APP_BACKEND}/movies`;
+        if (cursor !== "") {
+            url += `?after=${encodeURIComponent(cursor)}`;
+        }
+
+        fetch(url, requestOptions)
             .then(resp => resp.json())
             .then(data => {
-                setMovies(data);
+                setMovies(movies => cursor === "" ? data.movies : movies.concat(data.movies));
+                setTotal(data.metadata.total_records);
+                setNextCursor(data.metadata.next_cursor || "");
             })
             .catch(err => {
                 console.log(err)
             })
-    }, []);
+    }, [cursor]);
     
     return (
         <div className="">
@@ -49,6 +61,7 @@ const Movies = () => {
                     ))}
                 </tbody>
             </table>
+            <LoadMore shown={movies.length} total={total} nextCursor={nextCursor} onLoad={setCursor} />
         </div>
 
     )
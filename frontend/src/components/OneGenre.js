@@ -1,5 +1,6 @@
 import { useEffect, useState } from "react";
 import { Link, useLocation, useParams } from "react-router-dom"
+import LoadMore from "./LoadMore";
 
 const OneGenre = () => {
     // We need to get the prop passed to this component
@@ -8,6 +9,9 @@ const OneGenre = () => {
 
     // Set stateful variables
     const [movies, setMovies] = useState([]);
+    const [total, setTotal] = useState(0);
+    const [nextCursor, setNextCursor] = useState("");
+    const [cursor, setCursor] = useState("");
 
     // Get the ID from url
     let { id } = useParams();
@@ -22,17 +26,25 @@ const OneGenre = () => {
             headers: headers,
         }
 
-        fetch(`${process.env.REACT_APP_BACKEND}/movies/genres/${id}`, requestOptions)
+        // The listing is paginated, each page is added to the movies shown
+        let url = `${process.env.REACT_APP_BACKEND}/movies/genres/${id}`;
+        if (cursor !== "") {
+            url += `?after=${encodeURIComponent(cursor)}`;
+        }
+
+        fetch(url, requestOptions)
             .then(resp => resp.json())
             .then(data => {
                 if (data.error) {
                     console.log(data.message)
                 } else {
-                    setMovies(data);
+                    setMovies(movies => cursor === "" ? data.movies : movies.concat(data.movies));
+                    setTotal(data.metadata.total_records);
+                    setNextCursor(data.metadata.next_cursor || "");
                 }
             })
             .catch(err => {console.log(err)})
-    }, [id])
+    }, [id, cursor])
 
     return (
         <>
@@ -40,6 +52,7 @@ const OneGenre = () => {
             <hr />
 
             {movies ? (
+            <>
             <table className="table table-striped table-hover">
                 <thead>
                     <tr>
@@ -63,6 +76,8 @@ const OneGenre = () => {
                     </tbody>
                 
             </table>
+            <LoadMore shown={movies.length} total={total} nextCursor={nextCursor} onLoad={setCursor} />
+            </>
             ): (
                 <p>No movies in this genre (yet)!</p>
             )}
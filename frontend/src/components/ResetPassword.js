@@ -0,0 +1,94 @@
+import { useState } from "react";
+import { useNavigate, useOutletContext, useSearchParams } from "react-router-dom";
+import Input from "./form/Input";
+
+// ResetPassword asks for a reset link by email, or sets the new password
+// when opened from that link.
+const ResetPassword = () => {
+    const [email, setEmail] = useState("");
+    const [password, setPassword] = useState("");
+
+    const { setAlertClassName } = useOutletContext();
+    const { setAlertMessage } = useOutletContext();
+
+    const [searchParams] = useSearchParams();
+    const token = searchParams.get("token") || "";
+
+    const navigate = useNavigate();
+
+    const handleSubmit = (event) => {
+        event.preventDefault();
+
+        let payload = { email: email };
+        let url = `${process.env.REACT_APP_BACKEND}/password/forgot`;
+
+        if (token !== "") {
+            payload = { token: token, password: password };
+            url = `${process.env.REACT_APP_BACKEND}/password/reset`;
+        }
+
+        const requestOptions = {
+            method: "POST",
+            headers: {
+                "Content-Type": "application/json",
+            },
+            body: JSON.stringify(payload)
+        }
+
+        fetch(url, requestOptions)
+            .then(resp => resp.json())
+            .then(data => {
+                if (data.error) {
+                    setAlertClassName("alert-danger");
+                    setAlertMessage(data.message);
+                } else {
+                    setAlertClassName("alert-success");
+                    setAlertMessage(data.message);
+                    if (token !== "") {
+                        navigate("/login");
+                    }
+                }
+            })
+            .catch(error => {
+                setAlertClassName("alert-danger");
+                setAlertMessage(error)
+            })
+    }
+
+    return (
+        <div className="col-md-6 offset-md-3">
+            <h2>Reset Password</h2>
+            <hr />
+
+            <form onSubmit={handleSubmit}>
+                {token === "" ?
+                    <Input
+                        title="Email Address"
+                        type="email"
+                        className="form-control"
+                        name="email"
+                        onChange={(event) => setEmail(event.target.value)}
+                    />
+                :
+                    <Input
+                        title="New Password"
+                        type="password"
+                        className="form-control"
+                        name="password"
+                        onChange={(event) => setPassword(event.target.value)}
+                    />
+                }
+
+                <hr />
+
+                <input
+                    type="submit"
+                    className="btn btn-primary"
+                    value={token === "" ? "Send Reset Link" : "Set Password"}
+                />
+            </form>
+        </div>
+    )
+}
+
+export default ResetPassword;
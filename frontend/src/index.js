@@ -12,6 +12,7 @@ import Login from './components/Login';
 import ManageCatalogue from './components/ManageCatalogue';
 import Movies from './components/Movies';
 import Movie from './components/Movie';
+import ResetPassword from './components/ResetPassword';
 
 const router = createBrowserRouter([
   {
@@ -56,6 +57,10 @@ const router = createBrowserRouter([
         path: "/login",
         element: <Login />,
       },
+      {
+        path: "/password/reset",
+        element: <ResetPassword />,
+      },
     ]
   }
 ])
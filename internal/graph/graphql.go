@@ -1,71 +1,79 @@
 package graph
 
 import (
+	"context"
+	"database/sql"
 	"errors"
-	"strings"
+	"fmt"
 
 	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
 	"github.com/snirkop89/go-movies/internal/models"
+	"github.com/snirkop89/go-movies/internal/repository"
 )
 
-// Graph is the type for our graphql operations
+// searchLimit caps the number of movies returned by the search field
+const searchLimit = 50
+
+// Graph is the GraphQL API of the catalogue. Its schema is built once by New
+// and every field is resolved against the repository. Anyone can read, the
+// mutations follow the roles and scopes of the REST admin routes.
 type Graph struct {
-	Movies      []*models.Movie
-	QueryString string
-	Config      graphql.SchemaConfig
-	fields      graphql.Fields
-	movieType   *graphql.Object
+	DB     repository.DatabaseRepo
+	Schema graphql.Schema
+	Limits Limits
 }
 
-func New(movies []*models.Movie) *Graph {
+// New builds the schema of the catalogue.
+func New(db repository.DatabaseRepo, limits Limits) (*Graph, error) {
+	g := &Graph{DB: db, Limits: limits}
+	t := g.newTypes()
 
-	// Describe the database schema
-	movieType := graphql.NewObject(
-		graphql.ObjectConfig{
-			Name: "Movie",
-			Fields: graphql.Fields{
-				"id": &graphql.Field{
-					Type: graphql.Int,
-				},
-				"title": &graphql.Field{
-					Type: graphql.String,
-				},
-				"description": &graphql.Field{
-					Type: graphql.String,
-				},
-				"release_date": &graphql.Field{
-					Type: graphql.DateTime,
-				},
-				"runtime": &graphql.Field{
-					Type: graphql.Int,
-				},
-				"mpaa_rating": &graphql.Field{
-					Type: graphql.String,
-				},
-				"created_at": &graphql.Field{
-					Type: graphql.DateTime,
-				},
-				"updated_at": &graphql.Field{
-					Type: graphql.DateTime,
-				},
-				"image": &graphql.Field{
-					Type: graphql.String,
+	// Defines the available actions on the data
+	fields := graphql.Fields{
+		"movies": &graphql.Field{
+			Type:        graphql.NewNonNull(t.connection),
+			Description: "Movies matching the filters, as a Relay connection",
+			Args:        movieArgs(true),
+			Resolve:     g.movies,
+		},
+		"movie": &graphql.Field{
+			Type:        t.movie,
+			Description: "Get movie by ID",
+			Args: graphql.FieldConfigArgument{
+				"id": &graphql.ArgumentConfig{
+					Type: graphql.NewNonNull(graphql.Int),
 				},
 			},
+			Resolve: g.movie,
 		},
-	)
-
-	// Defines the available actions on the data
-	fields := graphql.Fields{
-		"list": &graphql.Field{
-			Type:        graphql.NewList(movieType),
-			Description: "Get all movies",
+		"genres": &graphql.Field{
+			Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(t.genre))),
+			Description: "Get all genres",
 			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
-				return movies, nil
+				return g.DB.AllGenres(p.Context)
+			},
+		},
+		"genre": &graphql.Field{
+			Type:        t.genre,
+			Description: "Get genre by ID",
+			Args: graphql.FieldConfigArgument{
+				"id": &graphql.ArgumentConfig{
+					Type: graphql.NewNonNull(graphql.Int),
+				},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				genre, err := g.DB.OneGenre(p.Context, p.Args["id"].(int))
+				if errors.Is(err, sql.ErrNoRows) {
+					return nil, nil
+				}
+				return genre, err
 			},
 		},
 		"search": &graphql.Field{
-			Type:        graphql.NewList(movieType),
+			Type:        graphql.NewList(t.movie),
 			Description: "Search movies by title",
 			Args: graphql.FieldConfigArgument{
 				"titleContains": &graphql.ArgumentConfig{
@@ -76,57 +84,200 @@ func New(movies []*models.Movie) *Graph {
 				var ret []*models.Movie
 				search, ok := p.Args["titleContains"].(string)
 				if ok {
-					for i := 0; i < len(movies); i++ {
-						if strings.Contains(strings.ToLower(movies[i].Title), strings.ToLower(search)) {
-							ret = append(ret, movies[i])
-						}
+					results, err := g.DB.SearchMovies(p.Context, search, searchLimit)
+					if err != nil {
+						return nil, err
+					}
+					for _, r := range results {
+						movie := r.Movie
+						ret = append(ret, &movie)
 					}
 				}
 				return ret, nil
 			},
 		},
-		"get": &graphql.Field{
-			Type:        graphql.NewList(movieType),
-			Description: "Get movie by ID",
+		"list": &graphql.Field{
+			Type:              graphql.NewList(t.movie),
+			Description:       "Get the first movies by title",
+			DeprecationReason: "Use movies, which is paginated",
 			Args: graphql.FieldConfigArgument{
-				"id": &graphql.ArgumentConfig{
-					Type: graphql.Int,
+				// Bounds the cost of the field, see Limits
+				"first": &graphql.ArgumentConfig{
+					Type:         graphql.Int,
+					DefaultValue: defaultFirst,
+					Description:  "Number of movies to return, at most 100",
 				},
 			},
 			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
-				id, ok := p.Args["id"].(int)
-				if ok {
-					for _, movie := range movies {
-						if movie.ID == id {
-							return movie, nil
-						}
-					}
+				filter, err := movieFilter(map[string]interface{}{"first": p.Args["first"]})
+				if err != nil {
+					return nil, err
 				}
-				return nil, nil
+				movies, _, err := g.DB.AllMovies(p.Context, filter)
+				return movies, err
 			},
 		},
+		"get": &graphql.Field{
+			Type:              t.movie,
+			Description:       "Get movie by ID",
+			DeprecationReason: "Use movie",
+			Args: graphql.FieldConfigArgument{
+				"id": &graphql.ArgumentConfig{
+					Type: graphql.NewNonNull(graphql.Int),
+				},
+			},
+			Resolve: g.movie,
+		},
 	}
 
-	return &Graph{
-		Movies:    movies,
-		fields:    fields,
-		movieType: movieType,
+	rootQuery := graphql.ObjectConfig{Name: "RootQuery", Fields: fields}
+	rootMutation := graphql.ObjectConfig{Name: "RootMutation", Fields: g.mutations(t)}
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query:    graphql.NewObject(rootQuery),
+		Mutation: graphql.NewObject(rootMutation),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("graphql schema: %w", err)
 	}
+	g.Schema = schema
+
+	return g, nil
 }
 
-func (g *Graph) Query() (*graphql.Result, error) {
-	rootQuery := graphql.ObjectConfig{Name: "RootQuery", Fields: g.fields}
-	schemaConfig := graphql.SchemaConfig{Query: graphql.NewObject(rootQuery)}
-	schema, err := graphql.NewSchema(schemaConfig)
+// Query runs a request against the schema. The errors of the request and of
+// the fields are reported in the result, as laid out by the GraphQL
+// specification. Mutations need an authorized caller.
+//
+// Operations over the limits are rejected before they run. The cost of the
+// operation is reported in the cost extension of the result.
+func (g *Graph) Query(ctx context.Context, req Request) *graphql.Result {
+	ctx = context.WithValue(ctx, contextKey{}, &req)
+	ctx = context.WithValue(ctx, loaderKey{}, newLoader(g.DB))
+
+	src := source.NewSource(&source.Source{
+		Body: []byte(req.Query),
+		Name: "GraphQL request",
+	})
+	doc, err := parser.Parse(parser.ParseParams{Source: src})
+	if err != nil {
+		return &graphql.Result{Errors: gqlerrors.FormatErrors(err)}
+	}
+
+	validation := graphql.ValidateDocument(&g.Schema, doc, nil)
+	if !validation.IsValid {
+		return &graphql.Result{Errors: validation.Errors}
+	}
+
+	// Without a single operation to run, Execute reports the error
+	var extensions map[string]interface{}
+	if op := operation(doc, req.OperationName); op != nil {
+		cost, errs := g.Limits.check(&g.Schema, doc, op, req.Variables)
+		extensions = map[string]interface{}{
+			"cost": costExtension{Requested: cost, Limit: g.Limits.MaxCost},
+		}
+		if len(errs) > 0 {
+			return &graphql.Result{Errors: errs, Extensions: extensions}
+		}
+	}
+
+	result := graphql.Execute(graphql.ExecuteParams{
+		Schema:        g.Schema,
+		AST:           doc,
+		OperationName: req.OperationName,
+		Args:          req.Variables,
+		Context:       ctx,
+	})
+	result.Extensions = extensions
+	return result
+}
+
+// movie resolves a movie by the id argument, null when it doesn't exist.
+func (g *Graph) movie(p graphql.ResolveParams) (interface{}, error) {
+	movie, err := g.DB.OneMovie(p.Context, p.Args["id"].(int))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return movie, err
+}
+
+// movies resolves a page of movies, with their genres loaded in one query.
+func (g *Graph) movies(p graphql.ResolveParams) (interface{}, error) {
+	filter, err := movieFilter(p.Args)
+	if err != nil {
+		return nil, err
+	}
+
+	movies, meta, err := g.DB.AllMovies(p.Context, filter)
 	if err != nil {
 		return nil, err
 	}
 
-	params := graphql.Params{Schema: schema, RequestString: g.QueryString}
-	resp := graphql.Do(params)
-	if len(resp.Errors) > 0 {
-		return nil, errors.New("error executing query")
+	ids := make([]int, len(movies))
+	for i, movie := range movies {
+		ids[i] = movie.ID
+	}
+	genres, err := g.DB.MovieGenres(p.Context, ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, movie := range movies {
+		movie.Genres = genres[movie.ID]
+		if movie.Genres == nil {
+			movie.Genres = []*models.Genre{}
+		}
+	}
+
+	return &connection{filter: filter, movies: movies, meta: meta}, nil
+}
+
+// movieGenres resolves the genres of a movie, unless already loaded. Those of
+// the movies of a query are loaded together.
+func (g *Graph) movieGenres(p graphql.ResolveParams) (interface{}, error) {
+	movie := p.Source.(*models.Movie)
+	if movie.Genres != nil {
+		return movie.Genres, nil
+	}
+	return resolve(p, g.loaderFrom(p.Context).movieGenres(p.Context, movie.ID))
+}
+
+// genreMovies resolves a page of the movies of a genre. Those of the genres
+// of a query are loaded together.
+func (g *Graph) genreMovies(p graphql.ResolveParams) (interface{}, error) {
+	genre := p.Source.(*models.Genre)
+	filter, err := movieFilter(p.Args)
+	if err != nil {
+		return nil, err
+	}
+	return resolve(p, g.loaderFrom(p.Context).genreMovies(p.Context, genre.ID, filter))
+}
+
+// movieFilter builds a movie filter from the arguments of a connection.
+func movieFilter(args map[string]interface{}) (repository.MovieFilter, error) {
+	filter := repository.MovieFilter{PerPage: defaultFirst}
+
+	if first, ok := args["first"].(int); ok {
+		if first < 1 || first > maxFirst {
+			return filter, fmt.Errorf("first must be between 1 and %d", maxFirst)
+		}
+		filter.PerPage = first
+	}
+	filter.After, _ = args["after"].(string)
+	filter.Sort, _ = args["sort"].(string)
+
+	if genres, ok := args["genres"].([]interface{}); ok {
+		for _, id := range genres {
+			filter.Genres = append(filter.Genres, id.(int))
+		}
+	}
+	if ratings, ok := args["mpaaRatings"].([]interface{}); ok {
+		for _, rating := range ratings {
+			filter.MPAARatings = append(filter.MPAARatings, rating.(string))
+		}
 	}
+	filter.YearFrom, _ = args["yearFrom"].(int)
+	filter.YearTo, _ = args["yearTo"].(int)
+	filter.RuntimeMin, _ = args["runtimeMin"].(int)
+	filter.RuntimeMax, _ = args["runtimeMax"].(int)
 
-	return resp, nil
+	return filter, filter.Validate()
 }
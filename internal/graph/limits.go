@@ -0,0 +1,291 @@
+package graph
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// listCost is the number of items assumed for the lists without a first
+// argument, such as the genres of a movie.
+const listCost = 10
+
+// listSizes are the number of items assumed for the lists known to be longer
+// than listCost, by type and field.
+var listSizes = map[string]int{
+	"RootQuery.search": searchLimit,
+}
+
+// maxCount caps the computed cost and counts, so that they can't overflow.
+const maxCount = 1 << 30
+
+// Limits bound the operations run by Graph.Query. They are checked before
+// the operation runs, a zero limit isn't enforced.
+//
+// Every field costs 1, and the fields selected below a list cost as many
+// times as the list has items: the first argument of the connections and
+// lists taking one, the most search returns, or listCost for the other lists. Introspection is free, but counts towards the
+// depth and the aliases.
+type Limits struct {
+	MaxDepth   int // levels of nested fields
+	MaxAliases int
+	MaxCost    int
+}
+
+// costExtension is reported in the cost extension of the responses.
+type costExtension struct {
+	Requested int `json:"requested"`
+	Limit     int `json:"limit,omitempty"`
+}
+
+// complexity is what the analysis found in a selection set.
+type complexity struct {
+	depth   int
+	aliases int
+	cost    int
+	deepest *ast.Field // field at depth, to locate the errors
+}
+
+func (c *complexity) add(sub complexity) {
+	if sub.depth > c.depth {
+		c.depth, c.deepest = sub.depth, sub.deepest
+	}
+	c.aliases = capped(c.aliases + sub.aliases)
+	c.cost = capped(c.cost + sub.cost)
+}
+
+// analysis walks an operation, expanding its fragments.
+type analysis struct {
+	schema    *graphql.Schema
+	variables map[string]interface{}
+	defaults  map[string]ast.Value // defaults of the variables of the operation
+	fragments map[string]*ast.FragmentDefinition
+	memo      map[string]complexity
+}
+
+// check analyses op against the limits. It returns the cost of op and an
+// error for every limit exceeded. The document must be valid.
+func (l Limits) check(schema *graphql.Schema, doc *ast.Document, op *ast.OperationDefinition, variables map[string]interface{}) (int, []gqlerrors.FormattedError) {
+	a := &analysis{
+		schema:    schema,
+		variables: variables,
+		defaults:  map[string]ast.Value{},
+		fragments: map[string]*ast.FragmentDefinition{},
+		memo:      map[string]complexity{},
+	}
+	for _, def := range op.VariableDefinitions {
+		if def.DefaultValue != nil {
+			a.defaults[def.Variable.Name.Value] = def.DefaultValue
+		}
+	}
+	for _, def := range doc.Definitions {
+		if fragment, ok := def.(*ast.FragmentDefinition); ok {
+			a.fragments[fragment.Name.Value] = fragment
+		}
+	}
+
+	var root graphql.Type = schema.QueryType()
+	if op.Operation == ast.OperationTypeMutation {
+		root = schema.MutationType()
+	}
+	c := a.selectionSet(root, op.SelectionSet)
+
+	var errs []gqlerrors.FormattedError
+	if l.MaxDepth > 0 && c.depth > l.MaxDepth {
+		errs = append(errs, located(c.deepest, "query is %d levels deep, the maximum is %d", c.depth, l.MaxDepth))
+	}
+	if l.MaxAliases > 0 && c.aliases > l.MaxAliases {
+		errs = append(errs, located(op, "query has %d aliases, the maximum is %d", c.aliases, l.MaxAliases))
+	}
+	if l.MaxCost > 0 && c.cost > l.MaxCost {
+		errs = append(errs, located(op, "query costs %d, the maximum is %d: lower the first arguments or select fewer fields", c.cost, l.MaxCost))
+	}
+
+	return c.cost, errs
+}
+
+func (a *analysis) selectionSet(parent graphql.Type, set *ast.SelectionSet) complexity {
+	var c complexity
+	if set == nil {
+		return c
+	}
+
+	for _, sel := range set.Selections {
+		switch sel := sel.(type) {
+		case *ast.Field:
+			c.add(a.field(parent, sel))
+		case *ast.InlineFragment:
+			t := parent
+			if sel.TypeCondition != nil {
+				t = a.schema.Type(sel.TypeCondition.Name.Value)
+			}
+			c.add(a.selectionSet(t, sel.SelectionSet))
+		case *ast.FragmentSpread:
+			c.add(a.fragment(sel.Name.Value))
+		}
+	}
+	return c
+}
+
+func (a *analysis) field(parent graphql.Type, f *ast.Field) complexity {
+	var def *graphql.FieldDefinition
+	switch f.Name.Value {
+	case "__schema":
+		def = graphql.SchemaMetaFieldDef
+	case "__type":
+		def = graphql.TypeMetaFieldDef
+	case "__typename":
+		def = graphql.TypeNameMetaFieldDef
+	default:
+		switch t := parent.(type) {
+		case *graphql.Object:
+			def = t.Fields()[f.Name.Value]
+		case *graphql.Interface:
+			def = t.Fields()[f.Name.Value]
+		}
+	}
+
+	c := complexity{depth: 1, deepest: f}
+	if f.Alias != nil {
+		c.aliases = 1
+	}
+	if def == nil {
+		// The validation rejects unknown fields
+		return c
+	}
+
+	sub := a.selectionSet(named(def.Type), f.SelectionSet)
+	if sub.depth > 0 {
+		c.depth, c.deepest = 1+sub.depth, sub.deepest
+	}
+	c.aliases = capped(c.aliases + sub.aliases)
+
+	// Introspection only reads the schema
+	if strings.HasPrefix(f.Name.Value, "__") {
+		return c
+	}
+	c.cost = capped(1 + a.size(parent, def, f)*sub.cost)
+	return c
+}
+
+// fragment analyses a fragment once, however many times it is spread.
+func (a *analysis) fragment(name string) complexity {
+	if c, ok := a.memo[name]; ok {
+		return c
+	}
+	def, ok := a.fragments[name]
+	if !ok {
+		return complexity{}
+	}
+
+	c := a.selectionSet(a.schema.Type(def.TypeCondition.Name.Value), def.SelectionSet)
+	a.memo[name] = c
+	return c
+}
+
+// size returns the number of items the field is assumed to return. The lists
+// of a connection are already counted by the field returning it.
+func (a *analysis) size(parent graphql.Type, def *graphql.FieldDefinition, f *ast.Field) int {
+	for _, arg := range def.Args {
+		if arg.Name() == "first" {
+			n, _ := arg.DefaultValue.(int)
+			return a.intArg(f, "first", n)
+		}
+	}
+
+	t := def.Type
+	if nonNull, ok := t.(*graphql.NonNull); ok {
+		t = nonNull.OfType
+	}
+	if _, ok := t.(*graphql.List); ok && !strings.HasSuffix(parent.Name(), "Connection") {
+		if n, ok := listSizes[parent.Name()+"."+def.Name]; ok {
+			return n
+		}
+		return listCost
+	}
+	return 1
+}
+
+// intArg returns the value of an integer argument of f, given inline or as a
+// variable, or def when it is missing.
+func (a *analysis) intArg(f *ast.Field, name string, def int) int {
+	for _, arg := range f.Arguments {
+		if arg.Name.Value != name {
+			continue
+		}
+
+		value := arg.Value
+		if v, ok := value.(*ast.Variable); ok {
+			switch n := a.variables[v.Name.Value].(type) {
+			case int:
+				return clamp(n)
+			case float64:
+				return clamp(int(n))
+			}
+			value = a.defaults[v.Name.Value]
+		}
+		if v, ok := value.(*ast.IntValue); ok {
+			if n, err := strconv.Atoi(v.Value); err == nil {
+				return clamp(n)
+			}
+		}
+	}
+	return def
+}
+
+// operation returns the operation of doc to run, nil when name doesn't pick
+// a single one.
+func operation(doc *ast.Document, name string) *ast.OperationDefinition {
+	var ops []*ast.OperationDefinition
+	for _, def := range doc.Definitions {
+		op, ok := def.(*ast.OperationDefinition)
+		if !ok {
+			continue
+		}
+		if name == "" || (op.Name != nil && op.Name.Value == name) {
+			ops = append(ops, op)
+		}
+	}
+
+	if len(ops) != 1 {
+		return nil
+	}
+	return ops[0]
+}
+
+// named returns t without its list and non-null wrappers.
+func named(t graphql.Type) graphql.Type {
+	for {
+		switch wrapper := t.(type) {
+		case *graphql.NonNull:
+			t = wrapper.OfType
+		case *graphql.List:
+			t = wrapper.OfType
+		default:
+			return t
+		}
+	}
+}
+
+func located(node ast.Node, format string, args ...interface{}) gqlerrors.FormattedError {
+	err := gqlerrors.NewLocatedError(fmt.Errorf(format, args...), []ast.Node{node})
+	return gqlerrors.FormatError(err)
+}
+
+func capped(n int) int {
+	if n > maxCount {
+		return maxCount
+	}
+	return n
+}
+
+func clamp(n int) int {
+	if n < 0 {
+		return 0
+	}
+	return capped(n)
+}
@@ -0,0 +1,296 @@
+package graph
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/snirkop89/go-movies/internal/repository/dbrepo"
+)
+
+func testGraph(t *testing.T, limits Limits) *Graph {
+	t.Helper()
+
+	g, err := New(dbrepo.NewMemoryDBRepo(), limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestLimits(t *testing.T) {
+	g := testGraph(t, Limits{})
+
+	// Four levels below movie, which costs 412 with the default first of 20
+	// and the assumed 10 genres
+	const deep = `{ movie(id: 1) { genres { movies { nodes { title } } } } }`
+
+	tests := []struct {
+		name      string
+		query     string
+		variables map[string]interface{}
+		limits    Limits
+		wantCost  int
+		wantErrs  []string // one substring per expected error
+	}{
+		{
+			name:     "single field",
+			query:    `{ movie(id: 1) { title } }`,
+			wantCost: 2,
+		},
+		{
+			name:     "list without first",
+			query:    `{ genres { genre } }`,
+			wantCost: 11,
+		},
+		{
+			name:     "connection with the default first",
+			query:    `{ movies { nodes { title } } }`,
+			wantCost: 41,
+		},
+		{
+			name:     "connection with an inline first",
+			query:    `{ movies(first: 5) { nodes { title } } }`,
+			wantCost: 11,
+		},
+		{
+			name:     "nested lists multiply",
+			query:    deep,
+			wantCost: 412,
+		},
+		{
+			name:     "depth at the limit",
+			query:    deep,
+			limits:   Limits{MaxDepth: 5},
+			wantCost: 412,
+		},
+		{
+			name:     "depth over the limit",
+			query:    deep,
+			limits:   Limits{MaxDepth: 4},
+			wantCost: 412,
+			wantErrs: []string{"query is 5 levels deep, the maximum is 4"},
+		},
+		{
+			name:     "depth through a fragment",
+			query:    `{ movie(id: 1) { ...G } } fragment G on Movie { genres { movies { nodes { title } } } }`,
+			limits:   Limits{MaxDepth: 4},
+			wantCost: 412,
+			wantErrs: []string{"query is 5 levels deep"},
+		},
+		{
+			name:     "aliases at the limit",
+			query:    `{ a: movie(id: 1) { t: title } b: movie(id: 2) { title } }`,
+			limits:   Limits{MaxAliases: 3},
+			wantCost: 4,
+		},
+		{
+			name:     "aliases over the limit",
+			query:    `{ a: movie(id: 1) { t: title } b: movie(id: 2) { title } }`,
+			limits:   Limits{MaxAliases: 2},
+			wantCost: 4,
+			wantErrs: []string{"query has 3 aliases, the maximum is 2"},
+		},
+		{
+			name:     "aliases in a fragment spread twice",
+			query:    `{ a: movie(id: 1) { ...F } b: movie(id: 2) { ...F } } fragment F on Movie { t: title }`,
+			limits:   Limits{MaxAliases: 3},
+			wantCost: 4,
+			wantErrs: []string{"query has 4 aliases, the maximum is 3"},
+		},
+		{
+			name:     "fragment spread twice costs twice",
+			query:    `{ a: movie(id: 1) { ...F } b: movie(id: 2) { ...F } } fragment F on Movie { title runtime }`,
+			wantCost: 6,
+		},
+		{
+			name:     "fragment spread twice in the same selection",
+			query:    `{ movie(id: 1) { ...F ...F } } fragment F on Movie { title }`,
+			wantCost: 3,
+		},
+		{
+			name: "nested fragment spread through another spread twice",
+			query: `{ a: movie(id: 1) { ...G } b: movie(id: 2) { ...G } }
+				fragment G on Movie { ...F genres { genre } }
+				fragment F on Movie { title }`,
+			// Each movie: 1 + title 1 + genres 1 + 10 * genre 1
+			wantCost: 26,
+		},
+		{
+			name:     "fragments over the cost limit",
+			query:    `{ movies(first: 100) { nodes { ...F } } } fragment F on Movie { genres { movies(first: 100) { nodes { title } } } }`,
+			limits:   Limits{MaxCost: 100000},
+			wantCost: 1 + 100*(1+1*(1+10*(1+100*2))),
+			wantErrs: []string{"query costs 201201, the maximum is 100000"},
+		},
+		{
+			name:      "first as a variable",
+			query:     `query($n: Int) { movies(first: $n) { nodes { title } } }`,
+			variables: map[string]interface{}{"n": 5},
+			wantCost:  11,
+		},
+		{
+			name:      "first as a decoded JSON variable",
+			query:     `query($n: Int) { movies(first: $n) { nodes { title } } }`,
+			variables: map[string]interface{}{"n": float64(50)},
+			wantCost:  101,
+		},
+		{
+			name:     "first as a variable default",
+			query:    `query($n: Int = 3) { movies(first: $n) { nodes { title } } }`,
+			wantCost: 7,
+		},
+		{
+			name:      "first as a variable overriding its default",
+			query:     `query($n: Int = 3) { movies(first: $n) { nodes { title } } }`,
+			variables: map[string]interface{}{"n": 10},
+			wantCost:  21,
+		},
+		{
+			name:     "first as a variable without a value",
+			query:    `query($n: Int) { movies(first: $n) { nodes { title } } }`,
+			wantCost: 41,
+		},
+		{
+			name:      "first as a variable over the cost limit",
+			query:     `query($n: Int = 1) { movies(first: $n) { nodes { title } } }`,
+			variables: map[string]interface{}{"n": 100},
+			limits:    Limits{MaxCost: 100},
+			wantCost:  201,
+			wantErrs:  []string{"query costs 201, the maximum is 100"},
+		},
+		{
+			name:     "search costs its limit",
+			query:    `{ search(titleContains: "a") { title } }`,
+			wantCost: 1 + searchLimit,
+		},
+		{
+			name:     "list with the default first",
+			query:    `{ list { genres { movies(first: 100) { nodes { title } } } } }`,
+			limits:   Limits{MaxCost: 5000},
+			wantCost: 1 + defaultFirst*(1+10*(1+100*2)),
+			wantErrs: []string{"query costs 40221, the maximum is 5000"},
+		},
+		{
+			name:     "list with an inline first",
+			query:    `{ list(first: 100) { title } }`,
+			wantCost: 101,
+		},
+		{
+			name:     "introspection is free",
+			query:    `{ __schema { types { name fields { name } } } }`,
+			limits:   Limits{MaxCost: 1},
+			wantCost: 0,
+		},
+		{
+			name:     "typename is free",
+			query:    `{ movie(id: 1) { __typename title } }`,
+			wantCost: 2,
+		},
+		{
+			name:     "introspection counts towards the depth",
+			query:    `{ __schema { types { fields { type { name } } } } }`,
+			limits:   Limits{MaxDepth: 4},
+			wantErrs: []string{"query is 5 levels deep"},
+		},
+		{
+			name:     "introspection counts towards the aliases",
+			query:    `{ a: __typename b: __typename }`,
+			limits:   Limits{MaxAliases: 1},
+			wantErrs: []string{"query has 2 aliases"},
+		},
+		{
+			name:     "every limit exceeded",
+			query:    deep,
+			limits:   Limits{MaxDepth: 2, MaxAliases: 0, MaxCost: 10},
+			wantCost: 412,
+			wantErrs: []string{"levels deep", "query costs 412"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := parser.Parse(parser.ParseParams{Source: tt.query})
+			if err != nil {
+				t.Fatal(err)
+			}
+			op := operation(doc, "")
+			if op == nil {
+				t.Fatal("no operation to run")
+			}
+			if op.Operation != ast.OperationTypeQuery {
+				t.Fatalf("operation is a %s", op.Operation)
+			}
+
+			cost, errs := tt.limits.check(&g.Schema, doc, op, tt.variables)
+			if cost != tt.wantCost {
+				t.Errorf("cost = %d, want %d", cost, tt.wantCost)
+			}
+			if len(errs) != len(tt.wantErrs) {
+				t.Fatalf("errors = %v, want %d", errs, len(tt.wantErrs))
+			}
+			for i, want := range tt.wantErrs {
+				if !strings.Contains(errs[i].Message, want) {
+					t.Errorf("error %d = %q, want it to contain %q", i, errs[i].Message, want)
+				}
+				if len(errs[i].Locations) == 0 {
+					t.Errorf("error %d has no location", i)
+				}
+			}
+		})
+	}
+}
+
+func TestQueryCostExtension(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		limits   Limits
+		want     costExtension
+		wantData bool
+	}{
+		{
+			name:     "within the limit",
+			query:    `{ movie(id: 1) { title } }`,
+			limits:   Limits{MaxCost: 100},
+			want:     costExtension{Requested: 2, Limit: 100},
+			wantData: true,
+		},
+		{
+			name:     "without a limit",
+			query:    `{ movies(first: 5) { nodes { title } } }`,
+			want:     costExtension{Requested: 11},
+			wantData: true,
+		},
+		{
+			name:   "over the limit",
+			query:  `{ movies { nodes { title } } }`,
+			limits: Limits{MaxCost: 40},
+			want:   costExtension{Requested: 41, Limit: 40},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := testGraph(t, tt.limits)
+
+			result := g.Query(context.Background(), Request{Query: tt.query})
+			if tt.wantData && result.HasErrors() {
+				t.Fatalf("errors: %v", result.Errors)
+			}
+			if !tt.wantData && (!result.HasErrors() || result.Data != nil) {
+				t.Fatalf("ran over the limit: data %v, errors %v", result.Data, result.Errors)
+			}
+
+			got, ok := result.Extensions["cost"].(costExtension)
+			if !ok {
+				t.Fatalf("cost extension = %#v", result.Extensions["cost"])
+			}
+			if got != tt.want {
+				t.Errorf("cost extension = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/snirkop89/go-movies/internal/models"
+	"github.com/snirkop89/go-movies/internal/repository"
+)
+
+// loader batches the reads of a request. The resolvers queue what they need
+// and return a thunk. The executor runs the thunks of a level once all its
+// resolvers were called, and the first thunk run loads what every resolver
+// queued in one query.
+type loader struct {
+	db repository.DatabaseRepo
+
+	mu sync.Mutex
+
+	// Genres by movie id
+	genres        map[int][]*models.Genre
+	pendingMovies map[int]bool
+
+	// Pages of the movies of genres, by filter then genre id
+	pages        map[string]map[int]repository.MoviePage
+	pendingPages map[string]map[int]bool
+}
+
+func newLoader(db repository.DatabaseRepo) *loader {
+	return &loader{
+		db:            db,
+		genres:        map[int][]*models.Genre{},
+		pendingMovies: map[int]bool{},
+		pages:         map[string]map[int]repository.MoviePage{},
+		pendingPages:  map[string]map[int]bool{},
+	}
+}
+
+type loaderKey struct{}
+
+// loaderFrom returns the loader of the request being run, stored in the
+// context by Query.
+func (g *Graph) loaderFrom(ctx context.Context) *loader {
+	if l, ok := ctx.Value(loaderKey{}).(*loader); ok {
+		return l
+	}
+	return newLoader(g.DB)
+}
+
+// batched reports whether the field is read by a query, whose thunks run once
+// the whole level was resolved. The thunks of mutations only run after every
+// mutation, when the data may have changed again, so they load right away.
+func batched(p graphql.ResolveParams) bool {
+	op, ok := p.Info.Operation.(*ast.OperationDefinition)
+	return ok && op.Operation == ast.OperationTypeQuery
+}
+
+// resolve returns thunk for the executor to run later, or runs it now.
+func resolve(p graphql.ResolveParams, thunk func() (interface{}, error)) (interface{}, error) {
+	if batched(p) {
+		return thunk, nil
+	}
+	return thunk()
+}
+
+// movieGenres queues a movie and returns a thunk resolving its genres.
+func (l *loader) movieGenres(ctx context.Context, movieID int) func() (interface{}, error) {
+	l.mu.Lock()
+	if _, ok := l.genres[movieID]; !ok {
+		l.pendingMovies[movieID] = true
+	}
+	l.mu.Unlock()
+
+	return func() (interface{}, error) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		if len(l.pendingMovies) > 0 {
+			ids := make([]int, 0, len(l.pendingMovies))
+			for id := range l.pendingMovies {
+				ids = append(ids, id)
+			}
+
+			genres, err := l.db.MovieGenres(ctx, ids)
+			if err != nil {
+				return nil, err
+			}
+			for _, id := range ids {
+				l.genres[id] = genres[id]
+				if l.genres[id] == nil {
+					l.genres[id] = []*models.Genre{}
+				}
+			}
+			l.pendingMovies = map[int]bool{}
+		}
+
+		return l.genres[movieID], nil
+	}
+}
+
+// genreMovies queues a genre and returns a thunk resolving its page of
+// movies matching filter.
+func (l *loader) genreMovies(ctx context.Context, genreID int, filter repository.MovieFilter) func() (interface{}, error) {
+	// Genres are loaded together when they share the rest of the filter
+	key := fmt.Sprintf("%+v", filter)
+
+	l.mu.Lock()
+	if _, ok := l.pages[key][genreID]; !ok {
+		if l.pendingPages[key] == nil {
+			l.pendingPages[key] = map[int]bool{}
+		}
+		l.pendingPages[key][genreID] = true
+	}
+	l.mu.Unlock()
+
+	return func() (interface{}, error) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		if pending := l.pendingPages[key]; len(pending) > 0 {
+			ids := make([]int, 0, len(pending))
+			for id := range pending {
+				ids = append(ids, id)
+			}
+
+			pages, err := l.db.GenresMovies(ctx, ids, filter)
+			if err != nil {
+				return nil, err
+			}
+			if l.pages[key] == nil {
+				l.pages[key] = map[int]repository.MoviePage{}
+			}
+			for _, id := range ids {
+				l.pages[key][id] = pages[id]
+			}
+			delete(l.pendingPages, key)
+		}
+
+		page := l.pages[key][genreID]
+		return &connection{filter: filter, movies: page.Movies, meta: page.Metadata}, nil
+	}
+}
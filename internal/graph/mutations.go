@@ -0,0 +1,475 @@
+package graph
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/graphql-go/graphql"
+	"github.com/snirkop89/go-movies/internal/models"
+	"github.com/snirkop89/go-movies/internal/repository"
+)
+
+var (
+	errMovieNotFound = errors.New("movie not found")
+	errGenreNotFound = errors.New("genre not found")
+	errEditConflict  = errors.New("the movie was changed since it was loaded")
+)
+
+// movieInput is the input of createMovie and updateMovie.
+var movieInput = graphql.NewInputObject(graphql.InputObjectConfig{
+	Name: "MovieInput",
+	Fields: graphql.InputObjectConfigFieldMap{
+		"title": &graphql.InputObjectFieldConfig{
+			Type: graphql.NewNonNull(graphql.String),
+		},
+		"description": &graphql.InputObjectFieldConfig{
+			Type: graphql.String,
+		},
+		"release_date": &graphql.InputObjectFieldConfig{
+			Type: graphql.NewNonNull(graphql.DateTime),
+		},
+		"runtime": &graphql.InputObjectFieldConfig{
+			Type: graphql.Int,
+		},
+		"mpaa_rating": &graphql.InputObjectFieldConfig{
+			Type: graphql.String,
+		},
+		"image": &graphql.InputObjectFieldConfig{
+			Type:        graphql.String,
+			Description: "Poster path, kept as is by updateMovie when null",
+		},
+		"genres": &graphql.InputObjectFieldConfig{
+			Type:        graphql.NewList(graphql.NewNonNull(graphql.Int)),
+			Description: "Genre ids, kept as is by updateMovie when null",
+		},
+	},
+})
+
+func (g *Graph) mutations(t *types) graphql.Fields {
+	idArg := func() *graphql.ArgumentConfig {
+		return &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)}
+	}
+
+	return graphql.Fields{
+		"createMovie": &graphql.Field{
+			Type:        t.movie,
+			Description: "Add a movie",
+			Args: graphql.FieldConfigArgument{
+				"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(movieInput)},
+			},
+			Resolve: g.createMovie,
+		},
+		"updateMovie": &graphql.Field{
+			Type:        t.movie,
+			Description: "Edit a movie, version being the one it was loaded at",
+			Args: graphql.FieldConfigArgument{
+				"id":      idArg(),
+				"version": idArg(),
+				"input":   &graphql.ArgumentConfig{Type: graphql.NewNonNull(movieInput)},
+			},
+			Resolve: g.updateMovie,
+		},
+		"setMovieGenres": &graphql.Field{
+			Type:        t.movie,
+			Description: "Replace the genres of a movie",
+			Args: graphql.FieldConfigArgument{
+				"id": idArg(),
+				"genres": &graphql.ArgumentConfig{
+					Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.Int))),
+				},
+			},
+			Resolve: g.setMovieGenres,
+		},
+		"deleteMovie": &graphql.Field{
+			Type:        graphql.Boolean,
+			Description: "Move a movie to the trash",
+			Args: graphql.FieldConfigArgument{
+				"id": idArg(),
+			},
+			Resolve: g.deleteMovie,
+		},
+		"createGenre": &graphql.Field{
+			Type: t.genre,
+			Args: graphql.FieldConfigArgument{
+				"genre": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+			},
+			Resolve: g.createGenre,
+		},
+		"updateGenre": &graphql.Field{
+			Type:        t.genre,
+			Description: "Rename a genre",
+			Args: graphql.FieldConfigArgument{
+				"id":    idArg(),
+				"genre": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+			},
+			Resolve: g.updateGenre,
+		},
+		"mergeGenres": &graphql.Field{
+			Type:        t.genre,
+			Description: "Move the movies of a genre to another one and delete it",
+			Args: graphql.FieldConfigArgument{
+				"from": idArg(),
+				"into": idArg(),
+			},
+			Resolve: g.mergeGenres,
+		},
+		"deleteGenre": &graphql.Field{
+			Type:        graphql.Boolean,
+			Description: "Delete a genre, its movies must be reassigned to another genre or force set",
+			Args: graphql.FieldConfigArgument{
+				"id":         idArg(),
+				"reassignTo": &graphql.ArgumentConfig{Type: graphql.Int},
+				"force":      &graphql.ArgumentConfig{Type: graphql.Boolean, DefaultValue: false},
+			},
+			Resolve: g.deleteGenre,
+		},
+	}
+}
+
+// readMovieInput copies the input argument onto movie. Null optional fields
+// are left untouched.
+func readMovieInput(args map[string]interface{}, movie *models.Movie) ([]int, error) {
+	input := args["input"].(map[string]interface{})
+
+	movie.Title = strings.TrimSpace(input["title"].(string))
+	if movie.Title == "" {
+		return nil, errors.New("title must be provided")
+	}
+	movie.ReleaseDate = input["release_date"].(time.Time)
+	if v, ok := input["description"].(string); ok {
+		movie.Description = v
+	}
+	if v, ok := input["runtime"].(int); ok {
+		movie.Runtime = v
+	}
+	if v, ok := input["mpaa_rating"].(string); ok {
+		movie.MPAARating = v
+	}
+	if v, ok := input["image"].(string); ok {
+		movie.Image = v
+	}
+
+	genres, ok := input["genres"].([]interface{})
+	if !ok {
+		return nil, nil
+	}
+	ids := make([]int, 0, len(genres))
+	for _, id := range genres {
+		ids = append(ids, id.(int))
+	}
+	return ids, nil
+}
+
+// genreName validates the name of a genre.
+func genreName(args map[string]interface{}) (string, error) {
+	name := strings.TrimSpace(args["genre"].(string))
+	switch {
+	case name == "":
+		return "", errors.New("genre must be provided")
+	case len(name) > 255:
+		return "", errors.New("genre must not be more than 255 bytes long")
+	}
+	return name, nil
+}
+
+// mutationError turns the repository errors into messages for the client.
+func mutationError(err error, notFound error) error {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return notFound
+	case errors.Is(err, repository.ErrEditConflict):
+		return errEditConflict
+	case errors.Is(err, repository.ErrDuplicate):
+		return errors.New("a genre with this name already exists")
+	case errors.Is(err, repository.ErrGenreInUse):
+		return errors.New("genre is used by movies, set reassignTo or force")
+	}
+	return err
+}
+
+func (g *Graph) createMovie(p graphql.ResolveParams) (interface{}, error) {
+	if err := authorize(p.Context, models.RoleEditor); err != nil {
+		return nil, err
+	}
+
+	var movie models.Movie
+	genres, err := readMovieInput(p.Args, &movie)
+	if err != nil {
+		return nil, err
+	}
+	movie.CreatedAt = time.Now()
+	movie.UpdateAt = time.Now()
+
+	var after *models.Movie
+	err = g.DB.WithTx(p.Context, func(tx repository.DatabaseRepo) error {
+		id, err := tx.InsertMovie(p.Context, movie)
+		if err != nil {
+			return err
+		}
+
+		err = tx.UpdateMovieGenres(p.Context, id, genres)
+		if err != nil {
+			return err
+		}
+
+		after, err = tx.OneMovie(p.Context, id)
+		if err != nil {
+			return err
+		}
+
+		return record(p.Context, tx, Change{Action: "create", Entity: "movie", EntityID: id, After: after})
+	})
+	if err != nil {
+		return nil, mutationError(err, errMovieNotFound)
+	}
+
+	return after, nil
+}
+
+func (g *Graph) updateMovie(p graphql.ResolveParams) (interface{}, error) {
+	if err := authorize(p.Context, models.RoleEditor); err != nil {
+		return nil, err
+	}
+
+	id := p.Args["id"].(int)
+	version := p.Args["version"].(int)
+
+	return g.editMovie(p.Context, id, func(movie *models.Movie) ([]int, error) {
+		if movie.Version != version {
+			return nil, repository.ErrEditConflict
+		}
+		return readMovieInput(p.Args, movie)
+	})
+}
+
+func (g *Graph) setMovieGenres(p graphql.ResolveParams) (interface{}, error) {
+	if err := authorize(p.Context, models.RoleEditor); err != nil {
+		return nil, err
+	}
+
+	genres := []int{}
+	for _, id := range p.Args["genres"].([]interface{}) {
+		genres = append(genres, id.(int))
+	}
+
+	return g.editMovie(p.Context, p.Args["id"].(int), func(*models.Movie) ([]int, error) {
+		return genres, nil
+	})
+}
+
+// editMovie loads a movie, changes it with edit and saves it with the genres
+// edit returns, if not nil. The version of the movie is bumped even when only
+// the genres change, so that editors notice.
+func (g *Graph) editMovie(ctx context.Context, id int, edit func(*models.Movie) ([]int, error)) (*models.Movie, error) {
+	var after *models.Movie
+
+	err := g.DB.WithTx(ctx, func(tx repository.DatabaseRepo) error {
+		movie, err := tx.OneMovie(ctx, id)
+		if err != nil {
+			return err
+		}
+		before := *movie
+
+		genres, err := edit(movie)
+		if err != nil {
+			return err
+		}
+		movie.UpdateAt = time.Now()
+
+		err = tx.UpdateMovie(ctx, *movie)
+		if err != nil {
+			return err
+		}
+
+		if genres != nil {
+			err = tx.UpdateMovieGenres(ctx, id, genres)
+			if err != nil {
+				return err
+			}
+		}
+
+		after, err = tx.OneMovie(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		return record(ctx, tx, Change{Action: "update", Entity: "movie", EntityID: id, Before: &before, After: after})
+	})
+	if err != nil {
+		return nil, mutationError(err, errMovieNotFound)
+	}
+
+	return after, nil
+}
+
+func (g *Graph) deleteMovie(p graphql.ResolveParams) (interface{}, error) {
+	if err := authorize(p.Context, models.RoleAdmin); err != nil {
+		return nil, err
+	}
+
+	id := p.Args["id"].(int)
+
+	err := g.DB.WithTx(p.Context, func(tx repository.DatabaseRepo) error {
+		before, err := tx.OneMovie(p.Context, id)
+		if err != nil {
+			return err
+		}
+
+		err = tx.TrashMovie(p.Context, id, time.Now())
+		if err != nil {
+			return err
+		}
+
+		return record(p.Context, tx, Change{Action: "trash", Entity: "movie", EntityID: id, Before: before})
+	})
+	if err != nil {
+		return nil, mutationError(err, errMovieNotFound)
+	}
+
+	return true, nil
+}
+
+func (g *Graph) createGenre(p graphql.ResolveParams) (interface{}, error) {
+	if err := authorize(p.Context, models.RoleEditor); err != nil {
+		return nil, err
+	}
+
+	name, err := genreName(p.Args)
+	if err != nil {
+		return nil, err
+	}
+
+	genre := models.Genre{
+		Genre:     name,
+		CreatedAt: time.Now(),
+		UpdateAt:  time.Now(),
+	}
+
+	err = g.DB.WithTx(p.Context, func(tx repository.DatabaseRepo) error {
+		genre.ID, err = tx.InsertGenre(p.Context, genre)
+		if err != nil {
+			return err
+		}
+
+		return record(p.Context, tx, Change{Action: "create", Entity: "genre", EntityID: genre.ID, After: genre})
+	})
+	if err != nil {
+		return nil, mutationError(err, errGenreNotFound)
+	}
+
+	return &genre, nil
+}
+
+func (g *Graph) updateGenre(p graphql.ResolveParams) (interface{}, error) {
+	if err := authorize(p.Context, models.RoleEditor); err != nil {
+		return nil, err
+	}
+
+	name, err := genreName(p.Args)
+	if err != nil {
+		return nil, err
+	}
+	id := p.Args["id"].(int)
+
+	var after *models.Genre
+	err = g.DB.WithTx(p.Context, func(tx repository.DatabaseRepo) error {
+		before, err := tx.OneGenre(p.Context, id)
+		if err != nil {
+			return err
+		}
+
+		genre := *before
+		genre.Genre = name
+		genre.UpdateAt = time.Now()
+
+		err = tx.UpdateGenre(p.Context, genre)
+		if err != nil {
+			return err
+		}
+		after = &genre
+
+		return record(p.Context, tx, Change{Action: "update", Entity: "genre", EntityID: id, Before: before, After: after})
+	})
+	if err != nil {
+		return nil, mutationError(err, errGenreNotFound)
+	}
+
+	return after, nil
+}
+
+func (g *Graph) mergeGenres(p graphql.ResolveParams) (interface{}, error) {
+	if err := authorize(p.Context, models.RoleAdmin); err != nil {
+		return nil, err
+	}
+
+	from, into := p.Args["from"].(int), p.Args["into"].(int)
+	if from == into {
+		return nil, errors.New("a genre can't be merged into itself")
+	}
+
+	var target *models.Genre
+	err := g.DB.WithTx(p.Context, func(tx repository.DatabaseRepo) error {
+		before, err := tx.OneGenre(p.Context, from)
+		if err != nil {
+			return err
+		}
+
+		target, err = tx.OneGenre(p.Context, into)
+		if err != nil {
+			return err
+		}
+
+		err = tx.MergeGenres(p.Context, from, into)
+		if err != nil {
+			return err
+		}
+
+		return record(p.Context, tx, Change{
+			Action:   "merge",
+			Entity:   "genre",
+			EntityID: from,
+			Before:   before,
+			After:    map[string]int{"merged_into": into},
+		})
+	})
+	if err != nil {
+		return nil, mutationError(err, errGenreNotFound)
+	}
+
+	return target, nil
+}
+
+func (g *Graph) deleteGenre(p graphql.ResolveParams) (interface{}, error) {
+	if err := authorize(p.Context, models.RoleAdmin); err != nil {
+		return nil, err
+	}
+
+	id := p.Args["id"].(int)
+	reassignTo, _ := p.Args["reassignTo"].(int)
+	force, _ := p.Args["force"].(bool)
+	if reassignTo == id {
+		return nil, errors.New("reassignTo must be the id of another genre")
+	}
+
+	err := g.DB.WithTx(p.Context, func(tx repository.DatabaseRepo) error {
+		before, err := tx.OneGenre(p.Context, id)
+		if err != nil {
+			return err
+		}
+
+		err = tx.DeleteGenre(p.Context, id, reassignTo, force)
+		if err != nil {
+			return err
+		}
+
+		return record(p.Context, tx, Change{Action: "delete", Entity: "genre", EntityID: id, Before: before})
+	})
+	if err != nil {
+		return nil, mutationError(err, errGenreNotFound)
+	}
+
+	return true, nil
+}
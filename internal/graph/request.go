@@ -0,0 +1,106 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/snirkop89/go-movies/internal/models"
+	"github.com/snirkop89/go-movies/internal/repository"
+)
+
+var (
+	errUnauthenticated = errors.New("authentication required")
+	errForbidden       = errors.New("insufficient permissions")
+)
+
+// Caller is the authenticated user running a request.
+type Caller struct {
+	UserID int
+	Role   string
+	APIKey bool     // authenticated with an API key rather than a token
+	Scopes []string // scopes of the API key
+}
+
+// Change is a write made by a mutation, handed to Request.Record.
+type Change struct {
+	Action   string // create, update, trash, merge or delete
+	Entity   string // movie or genre
+	EntityID int
+	Before   any // entity before the change, nil when it was created
+	After    any // entity after the change, nil when it was deleted
+}
+
+// Request is a GraphQL request, with what the HTTP layer knows of it.
+type Request struct {
+	Query         string
+	Variables     map[string]interface{}
+	OperationName string // operation of Query to run, when it has several
+
+	// Caller is nil for anonymous requests, which can only read.
+	Caller *Caller
+
+	// Record is called in the transaction of every mutation, to keep the
+	// audit log. An error aborts the mutation.
+	Record func(tx repository.DatabaseRepo, c Change) error
+}
+
+// IsMutation reports whether the operation req runs is a mutation. Queries
+// that don't parse or don't name a single operation aren't, running them
+// reports why.
+func (req Request) IsMutation() bool {
+	doc, err := parser.Parse(parser.ParseParams{Source: req.Query})
+	if err != nil {
+		return false
+	}
+
+	op := operation(doc, req.OperationName)
+	return op != nil && op.Operation == ast.OperationTypeMutation
+}
+
+type contextKey struct{}
+
+// requestFrom returns the request being run, stored in the context by Query.
+func requestFrom(ctx context.Context) *Request {
+	req, _ := ctx.Value(contextKey{}).(*Request)
+	if req == nil {
+		return &Request{}
+	}
+	return req
+}
+
+// authorize checks that the caller may change the catalogue with the given
+// role, the same rules as the REST admin routes.
+func authorize(ctx context.Context, role string) error {
+	caller := requestFrom(ctx).Caller
+	if caller == nil {
+		return errUnauthenticated
+	}
+	if !models.RoleAtLeast(caller.Role, role) {
+		return errForbidden
+	}
+	if caller.APIKey && !hasScope(caller.Scopes, models.ScopeCatalogueWrite) {
+		return fmt.Errorf("api key lacks the %s scope", models.ScopeCatalogueWrite)
+	}
+	return nil
+}
+
+// record hands c to the Record function of the request, if any.
+func record(ctx context.Context, tx repository.DatabaseRepo, c Change) error {
+	req := requestFrom(ctx)
+	if req.Record == nil {
+		return nil
+	}
+	return req.Record(tx, c)
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,241 @@
+package graph
+
+import (
+	"github.com/graphql-go/graphql"
+	"github.com/snirkop89/go-movies/internal/models"
+	"github.com/snirkop89/go-movies/internal/repository"
+)
+
+// Page sizes of the connections
+const (
+	defaultFirst = 20
+	maxFirst     = 100
+)
+
+// connection is a page of movies, resolved by the MovieConnection type.
+type connection struct {
+	filter repository.MovieFilter
+	movies []*models.Movie
+	meta   repository.Metadata
+}
+
+// edge is a movie of a connection, with the cursor pointing after it.
+type edge struct {
+	Cursor string        `json:"cursor"`
+	Node   *models.Movie `json:"node"`
+}
+
+// pageInfo follows the Relay cursor connections specification.
+type pageInfo struct {
+	HasNextPage     bool    `json:"hasNextPage"`
+	HasPreviousPage bool    `json:"hasPreviousPage"`
+	StartCursor     *string `json:"startCursor"`
+	EndCursor       *string `json:"endCursor"`
+}
+
+func (c *connection) edges() []edge {
+	edges := make([]edge, len(c.movies))
+	for i, movie := range c.movies {
+		edges[i] = edge{Cursor: c.filter.NextCursor(movie), Node: movie}
+	}
+	return edges
+}
+
+func (c *connection) pageInfo() pageInfo {
+	info := pageInfo{
+		HasNextPage: c.meta.NextCursor != "",
+		// Only forward pagination is supported, a cursor means there was a
+		// page before
+		HasPreviousPage: c.filter.After != "",
+	}
+	if len(c.movies) > 0 {
+		start := c.filter.NextCursor(c.movies[0])
+		end := c.filter.NextCursor(c.movies[len(c.movies)-1])
+		info.StartCursor, info.EndCursor = &start, &end
+	}
+	return info
+}
+
+// movieArgs returns the arguments of the fields returning a
+// MovieConnection, with the genres filter unless the genre is already known.
+func movieArgs(genres bool) graphql.FieldConfigArgument {
+	args := graphql.FieldConfigArgument{
+		"first": &graphql.ArgumentConfig{
+			Type:         graphql.Int,
+			DefaultValue: defaultFirst,
+			Description:  "Number of movies to return, at most 100",
+		},
+		"after": &graphql.ArgumentConfig{
+			Type:        graphql.String,
+			Description: "Cursor of the movie to start after",
+		},
+		"sort": &graphql.ArgumentConfig{
+			Type:        graphql.String,
+			Description: "title, release_date, runtime or created_at, prefixed with - for descending",
+		},
+		"mpaaRatings": &graphql.ArgumentConfig{
+			Type: graphql.NewList(graphql.NewNonNull(graphql.String)),
+		},
+		"yearFrom": &graphql.ArgumentConfig{
+			Type: graphql.Int,
+		},
+		"yearTo": &graphql.ArgumentConfig{
+			Type: graphql.Int,
+		},
+		"runtimeMin": &graphql.ArgumentConfig{
+			Type: graphql.Int,
+		},
+		"runtimeMax": &graphql.ArgumentConfig{
+			Type: graphql.Int,
+		},
+	}
+	if genres {
+		args["genres"] = &graphql.ArgumentConfig{
+			Type:        graphql.NewList(graphql.NewNonNull(graphql.Int)),
+			Description: "Movies in any of these genres",
+		}
+	}
+	return args
+}
+
+// types holds the object types of the schema.
+type types struct {
+	movie      *graphql.Object
+	genre      *graphql.Object
+	connection *graphql.Object
+}
+
+func (g *Graph) newTypes() *types {
+	t := &types{}
+
+	t.genre = graphql.NewObject(graphql.ObjectConfig{
+		Name: "Genre",
+		// A thunk, as genres and movies refer to each other
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			return graphql.Fields{
+				"id": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.Int),
+				},
+				"genre": &graphql.Field{
+					Type: graphql.NewNonNull(graphql.String),
+				},
+				"movies": &graphql.Field{
+					Type:        graphql.NewNonNull(t.connection),
+					Description: "Movies of the genre",
+					Args:        movieArgs(false),
+					Resolve:     g.genreMovies,
+				},
+			}
+		}),
+	})
+
+	t.movie = graphql.NewObject(graphql.ObjectConfig{
+		Name: "Movie",
+		Fields: graphql.Fields{
+			"id": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Int),
+			},
+			"title": &graphql.Field{
+				Type: graphql.String,
+			},
+			"description": &graphql.Field{
+				Type: graphql.String,
+			},
+			"release_date": &graphql.Field{
+				Type: graphql.DateTime,
+			},
+			"runtime": &graphql.Field{
+				Type: graphql.Int,
+			},
+			"mpaa_rating": &graphql.Field{
+				Type: graphql.String,
+			},
+			"created_at": &graphql.Field{
+				Type: graphql.DateTime,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(*models.Movie).CreatedAt, nil
+				},
+			},
+			"updated_at": &graphql.Field{
+				Type: graphql.DateTime,
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(*models.Movie).UpdateAt, nil
+				},
+			},
+			"image": &graphql.Field{
+				Type: graphql.String,
+			},
+			"version": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.Int),
+				Description: "Bumped on every update, to pass to updateMovie",
+			},
+			"genres": &graphql.Field{
+				Type:    graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(t.genre))),
+				Resolve: g.movieGenres,
+			},
+		},
+	})
+
+	pageInfoType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "PageInfo",
+		Fields: graphql.Fields{
+			"hasNextPage": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Boolean),
+			},
+			"hasPreviousPage": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Boolean),
+			},
+			"startCursor": &graphql.Field{
+				Type: graphql.String,
+			},
+			"endCursor": &graphql.Field{
+				Type: graphql.String,
+			},
+		},
+	})
+
+	edgeType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "MovieEdge",
+		Fields: graphql.Fields{
+			"cursor": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.String),
+			},
+			"node": &graphql.Field{
+				Type: graphql.NewNonNull(t.movie),
+			},
+		},
+	})
+
+	t.connection = graphql.NewObject(graphql.ObjectConfig{
+		Name: "MovieConnection",
+		Fields: graphql.Fields{
+			"edges": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(edgeType))),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(*connection).edges(), nil
+				},
+			},
+			"nodes": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(t.movie))),
+				Description: "The movies of the edges, for when cursors aren't needed",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(*connection).movies, nil
+				},
+			},
+			"pageInfo": &graphql.Field{
+				Type: graphql.NewNonNull(pageInfoType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(*connection).pageInfo(), nil
+				},
+			},
+			"totalCount": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Int),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source.(*connection).meta.TotalRecords, nil
+				},
+			},
+		},
+	})
+
+	return t
+}
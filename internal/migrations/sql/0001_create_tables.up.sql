@@ -0,0 +1,34 @@
+create table if not exists genres (
+    id integer generated always as identity primary key,
+    genre varchar(255),
+    created_at timestamp,
+    updated_at timestamp
+);
+
+create table if not exists movies (
+    id integer generated always as identity primary key,
+    title varchar(512),
+    release_date date,
+    runtime integer,
+    mpaa_rating varchar(10),
+    description text,
+    image varchar(255),
+    created_at timestamp,
+    updated_at timestamp
+);
+
+create table if not exists movies_genres (
+    id integer generated always as identity primary key,
+    movie_id integer references movies (id) on update cascade on delete cascade,
+    genre_id integer references genres (id) on update cascade on delete cascade
+);
+
+create table if not exists users (
+    id integer generated always as identity primary key,
+    first_name varchar(255),
+    last_name varchar(255),
+    email varchar(255),
+    password varchar(255),
+    created_at timestamp,
+    updated_at timestamp
+);
@@ -0,0 +1,4 @@
+delete from movies_genres where id between 1 and 6;
+delete from movies where id between 1 and 3;
+delete from genres where id between 1 and 13;
+delete from users where id = 1;
@@ -0,0 +1,3 @@
+drop index if exists movies_search_idx;
+
+alter table movies drop column if exists search;
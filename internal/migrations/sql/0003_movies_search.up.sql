@@ -0,0 +1,6 @@
+alter table movies add column if not exists search tsvector generated always as (
+    setweight(to_tsvector('english', coalesce(title, '')), 'A') ||
+    setweight(to_tsvector('english', coalesce(description, '')), 'B')
+) stored;
+
+create index if not exists movies_search_idx on movies using gin (search);
@@ -0,0 +1 @@
+drop index if exists genres_genre_lower_idx;
@@ -0,0 +1 @@
+create unique index if not exists genres_genre_lower_idx on genres (lower(genre));
@@ -0,0 +1,3 @@
+update users set email = lower(trim(email));
+
+create unique index if not exists users_email_lower_idx on users (lower(email));
@@ -0,0 +1,6 @@
+alter table users add column if not exists role varchar(20) not null default 'viewer';
+
+alter table users add constraint users_role_check check (role in ('viewer', 'editor', 'admin'));
+
+-- The seeded account keeps full access to the admin routes
+update users set role = 'admin' where email = 'admin@example.com';
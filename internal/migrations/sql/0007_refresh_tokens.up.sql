@@ -0,0 +1,13 @@
+create table if not exists refresh_tokens (
+    id varchar(64) primary key,
+    family_id varchar(64) not null,
+    user_id integer not null references users (id) on delete cascade,
+    expires_at timestamp not null,
+    created_at timestamp not null,
+    revoked_at timestamp,
+    replaced_by varchar(64)
+);
+
+create index if not exists refresh_tokens_family_id_idx on refresh_tokens (family_id);
+
+create index if not exists refresh_tokens_user_id_idx on refresh_tokens (user_id);
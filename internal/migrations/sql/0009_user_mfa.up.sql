@@ -0,0 +1,10 @@
+alter table users add column if not exists totp_secret varchar(64) not null default '';
+alter table users add column if not exists totp_enabled boolean not null default false;
+alter table users add column if not exists totp_last_step bigint not null default 0;
+
+create table if not exists recovery_codes (
+    user_id integer not null references users (id) on delete cascade,
+    code_hash varchar(64) not null,
+    used_at timestamp,
+    primary key (user_id, code_hash)
+);
@@ -0,0 +1,9 @@
+create table if not exists password_resets (
+    token_hash varchar(64) primary key,
+    user_id integer not null references users (id) on delete cascade,
+    expires_at timestamp not null,
+    created_at timestamp not null,
+    used_at timestamp
+);
+
+create index if not exists password_resets_user_id_idx on password_resets (user_id);
@@ -0,0 +1,14 @@
+create table if not exists audit_log (
+    id bigint generated always as identity primary key,
+    user_id integer, -- kept when the user is deleted
+    action varchar(50) not null,
+    entity varchar(50) not null,
+    entity_id varchar(255) not null,
+    changes jsonb,
+    ip varchar(64) not null,
+    created_at timestamp not null
+);
+
+create index if not exists audit_log_created_at_idx on audit_log (created_at);
+create index if not exists audit_log_user_id_idx on audit_log (user_id, created_at);
+create index if not exists audit_log_entity_idx on audit_log (entity, entity_id, created_at);
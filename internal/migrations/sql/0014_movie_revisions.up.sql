@@ -0,0 +1,9 @@
+create table if not exists movie_revisions (
+    movie_id integer not null references movies (id) on delete cascade,
+    revision integer not null,
+    snapshot jsonb not null,
+    user_id integer,
+    restored_from integer,
+    created_at timestamp not null,
+    primary key (movie_id, revision)
+);
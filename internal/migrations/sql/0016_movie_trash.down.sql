@@ -0,0 +1,3 @@
+drop index if exists movies_deleted_at_idx;
+delete from movies where deleted_at is not null;
+alter table movies drop column if exists deleted_at;
@@ -0,0 +1,39 @@
+package models
+
+import "time"
+
+// API key scopes. A key grants the intersection of its scopes and of the role
+// of its user.
+const (
+	ScopeRead           = "read"            // read the catalogue
+	ScopeCatalogueWrite = "catalogue:write" // add, edit and remove movies and genres
+)
+
+// ValidScope reports whether scope is a known scope.
+func ValidScope(scope string) bool {
+	return scope == ScopeRead || scope == ScopeCatalogueWrite
+}
+
+// APIKey is a long lived credential for machine clients. Only the hash of
+// the key is stored, the prefix identifies it to its owner.
+type APIKey struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Hash       string     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// HasScope reports whether the key was granted scope.
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,20 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// AuditEntry records an administrative change or an authentication event.
+type AuditEntry struct {
+	ID       int64  `json:"id"`
+	UserID   *int   `json:"user_id"` // acting user, nil for anonymous requests
+	Action   string `json:"action"`
+	Entity   string `json:"entity"`    // kind of the entity acted upon, such as movie
+	EntityID string `json:"entity_id"` // its id, or another key such as an IP address
+
+	// Fields that changed, as {"field": {"from": old, "to": new}}
+	Changes   json.RawMessage `json:"changes,omitempty"`
+	IP        string          `json:"ip"`
+	CreatedAt time.Time       `json:"created_at"`
+}
@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// UserIdentity links an account of an OpenID Connect provider, identified by
+// the issuer and the subject of its ID tokens, to a local user.
+type UserIdentity struct {
+	Issuer    string    `json:"issuer"`
+	Subject   string    `json:"subject"`
+	UserID    int       `json:"user_id"`
+	Email     string    `json:"email"` // as reported by the provider when linked
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// LoginAttempts counts the recent failed logins of an account or a client,
+// identified by Key.
+type LoginAttempts struct {
+	Key           string    `json:"key"`
+	Failures      int       `json:"failures"`
+	LastFailureAt time.Time `json:"last_failure_at"`
+	LockedUntil   time.Time `json:"locked_until"` // zero when not locked
+}
+
+// Locked reports whether logins are refused at t.
+func (a *LoginAttempts) Locked(t time.Time) bool {
+	return t.Before(a.LockedUntil)
+}
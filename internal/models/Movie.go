@@ -3,17 +3,26 @@ package models
 import "time"
 
 type Movie struct {
-	ID          int       `json:"id"`
-	Title       string    `json:"title"`
-	ReleaseDate time.Time `json:"release_date"`
-	Runtime     int       `json:"runtime"`
-	MPAARating  string    `json:"mpaa_rating"`
-	Description string    `json:"description"`
-	Image       string    `json:"image"`
-	Genres      []*Genre  `json:"genres,omitempty"`
-	GenresArray []int     `json:"genres_array,omitempty"` // Genres ID only
-	CreatedAt   time.Time `json:"-"`
-	UpdateAt    time.Time `json:"-"`
+	ID          int        `json:"id"`
+	Title       string     `json:"title"`
+	ReleaseDate time.Time  `json:"release_date"`
+	Runtime     int        `json:"runtime"`
+	MPAARating  string     `json:"mpaa_rating"`
+	Description string     `json:"description"`
+	Image       string     `json:"image"`
+	Genres      []*Genre   `json:"genres,omitempty"`
+	GenresArray []int      `json:"genres_array,omitempty"` // Genres ID only
+	Version     int        `json:"version"`                // bumped on every update
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`   // set while the movie is in the trash
+	CreatedAt   time.Time  `json:"-"`
+	UpdateAt    time.Time  `json:"-"`
+}
+
+// MovieSearchResult is a movie matched by a full-text search.
+type MovieSearchResult struct {
+	Movie
+	Rank    float64 `json:"rank"`
+	Snippet string  `json:"snippet"` // HTML-escaped description excerpt with matches wrapped in <b></b>
 }
 
 type Genre struct {
@@ -23,3 +32,14 @@ type Genre struct {
 	CreatedAt time.Time `json:"-"`
 	UpdateAt  time.Time `json:"-"`
 }
+
+// MovieRevision is a snapshot of a movie and its genres, saved on every
+// edit. Restoring a revision saves a new one.
+type MovieRevision struct {
+	MovieID      int       `json:"movie_id"`
+	Revision     int       `json:"revision"` // numbered from 1 for each movie
+	Movie        Movie     `json:"movie"`
+	UserID       *int      `json:"user_id"`                 // editor, nil when unknown
+	RestoredFrom int       `json:"restored_from,omitempty"` // revision restored by this one
+	CreatedAt    time.Time `json:"created_at"`
+}
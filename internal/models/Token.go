@@ -0,0 +1,26 @@
+package models
+
+import "time"
+
+// RefreshToken is the server side record of an issued refresh token.
+// Tokens are rotated on every use: the used token is revoked and points to
+// its replacement. All the tokens descending from one login share a family.
+type RefreshToken struct {
+	ID         string     `json:"id"` // jti claim
+	FamilyID   string     `json:"family_id"`
+	UserID     int        `json:"user_id"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	ReplacedBy string     `json:"replaced_by,omitempty"`
+}
+
+// PasswordReset is a single use token letting a user choose a new password.
+// Only the hash of the token is stored, the token itself is emailed.
+type PasswordReset struct {
+	TokenHash string     `json:"-"`
+	UserID    int        `json:"user_id"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	CreatedAt time.Time  `json:"created_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+}
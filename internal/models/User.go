@@ -2,6 +2,7 @@ package models
 
 import (
 	"errors"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
@@ -12,9 +13,71 @@ type User struct {
 	FirstName string    `json:"first_name"`
 	LastName  string    `json:"last_name"`
 	Email     string    `json:"email"`
-	Password  string    `json:"password"`
+	Password  string    `json:"-"` // bcrypt hash
+	Role      string    `json:"role"`
 	CreatedAt time.Time `json:"-"`
 	UpdatedAt time.Time `json:"-"`
+
+	// Two-factor authentication. The secret is set when enrolling, but is
+	// only required to log in once the first code has been verified.
+	TOTPSecret   string `json:"-"`
+	TOTPEnabled  bool   `json:"totp_enabled"`
+	TOTPLastStep int64  `json:"-"` // time step of the last accepted code
+}
+
+// User roles, from the least to the most privileged.
+const (
+	RoleViewer = "viewer"
+	RoleEditor = "editor"
+	RoleAdmin  = "admin"
+)
+
+var roleRanks = map[string]int{
+	RoleViewer: 1,
+	RoleEditor: 2,
+	RoleAdmin:  3,
+}
+
+// ValidRole reports whether role is a known role.
+func ValidRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// RoleAtLeast reports whether role grants at least the privileges of min.
+// Unknown roles grant nothing.
+func RoleAtLeast(role, min string) bool {
+	rank, ok := roleRanks[role]
+	return ok && rank >= roleRanks[min]
+}
+
+// PasswordCost is the bcrypt cost of newly hashed passwords. It is the
+// highest cost of the stored hashes, the seeded accounts', so that checking a
+// password takes as long for every account. Lower cost hashes are upgraded
+// on login.
+const PasswordCost = 14
+
+// NormalizeEmail returns the canonical form of an email address, used for
+// storage and lookups.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// SetPassword hashes plaintext and stores it as the user password.
+func (u *User) SetPassword(plaintext string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(plaintext), PasswordCost)
+	if err != nil {
+		return err
+	}
+	u.Password = string(hash)
+	return nil
+}
+
+// PasswordNeedsRehash reports whether the password hash is of a lower cost
+// than PasswordCost.
+func (u *User) PasswordNeedsRehash() bool {
+	cost, err := bcrypt.Cost([]byte(u.Password))
+	return err == nil && cost < PasswordCost
 }
 
 func (u *User) PasswordMatches(plaintext string) (bool, error) {
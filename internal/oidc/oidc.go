@@ -0,0 +1,451 @@
+// Package oidc implements the relying party side of OpenID Connect:
+// provider discovery, the authorization code flow with PKCE, and ID token
+// validation against the keys published by the provider.
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Leeway is the clock skew tolerated on the times of ID tokens.
+const Leeway = time.Minute
+
+// keysRefreshInterval is the minimum time between two fetches of the
+// provider keys, so that tokens with unknown key ids can't make us hammer it.
+const keysRefreshInterval = time.Minute
+
+var (
+	// ErrInvalidToken is wrapped by the errors of VerifyIDToken.
+	ErrInvalidToken = errors.New("invalid id token")
+
+	// supportedAlgorithms are the ID token signing algorithms accepted.
+	// Symmetric algorithms are not, the client secret is not a signing key.
+	supportedAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+)
+
+// Metadata is the part of the provider configuration document we use.
+type Metadata struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	SigningAlgorithms     []string `json:"id_token_signing_alg_values_supported"`
+}
+
+// Provider is an OpenID Connect provider our application is registered with.
+// Its configuration is discovered on first use.
+type Provider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string // empty for public clients
+	RedirectURL  string
+	Scopes       []string // openid is always requested
+	HTTPClient   *http.Client
+
+	mu          sync.Mutex
+	meta        *Metadata
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+}
+
+// IDToken holds the claims of a verified ID token.
+type IDToken struct {
+	AuthorizedBy  string   `json:"azp"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Name          string   `json:"name"`
+	GivenName     string   `json:"given_name"`
+	FamilyName    string   `json:"family_name"`
+	AMR           []string `json:"amr,omitempty"` // authentication methods, RFC 8176
+	ACR           string   `json:"acr,omitempty"` // authentication context class
+	jwt.RegisteredClaims
+}
+
+// ACR values of the OpenID Provider Authentication Policy Extension, stating
+// that the user authenticated with several factors.
+const (
+	ACRMultiFactor         = "http://schemas.openid.net/pape/policies/2007/06/multi-factor"
+	ACRMultiFactorPhysical = "http://schemas.openid.net/pape/policies/2007/06/multi-factor-physical"
+)
+
+// MultiFactor reports whether the provider says the user authenticated with
+// several factors, through the mfa method of the amr claim or the acr claim.
+func (t *IDToken) MultiFactor() bool {
+	for _, method := range t.AMR {
+		if method == "mfa" {
+			return true
+		}
+	}
+	return t.ACR == ACRMultiFactor || t.ACR == ACRMultiFactorPhysical
+}
+
+// Tokens is the response of the token endpoint.
+type Tokens struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	IDToken     string `json:"id_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// NewPKCE returns a PKCE code verifier and its S256 challenge.
+func NewPKCE() (verifier, challenge string, err error) {
+	verifier, err = RandomString(32)
+	if err != nil {
+		return "", "", err
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// RandomString returns a URL safe random string built from n random bytes,
+// suitable for states and nonces.
+func RandomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (p *Provider) client() *http.Client {
+	if p.HTTPClient != nil {
+		return p.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// getJSON fetches url and decodes its JSON body into dst.
+func (p *Provider) getJSON(ctx context.Context, url string, dst any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: unexpected status %s", url, resp.Status)
+	}
+
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(dst)
+}
+
+// Metadata returns the provider configuration, fetching it on first use.
+func (p *Provider) Metadata(ctx context.Context) (*Metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.meta != nil {
+		return p.meta, nil
+	}
+
+	issuer := strings.TrimSuffix(p.Issuer, "/")
+
+	var meta Metadata
+	err := p.getJSON(ctx, issuer+"/.well-known/openid-configuration", &meta)
+	if err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+
+	// The issuer must be exactly the one we were configured with,
+	// OpenID Connect Discovery section 4.3
+	if strings.TrimSuffix(meta.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("oidc discovery: issuer %q does not match %q", meta.Issuer, p.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, errors.New("oidc discovery: incomplete provider configuration")
+	}
+
+	p.meta = &meta
+	return p.meta, nil
+}
+
+// AuthCodeURL returns the URL of the provider login page. The provider
+// redirects back to RedirectURL with a code and the state.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, codeChallenge string) (string, error) {
+	meta, err := p.Metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	scopes := []string{"openid"}
+	for _, s := range p.Scopes {
+		if s != "openid" {
+			scopes = append(scopes, s)
+		}
+	}
+
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.ClientID)
+	v.Set("redirect_uri", p.RedirectURL)
+	v.Set("scope", strings.Join(scopes, " "))
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+	v.Set("code_challenge", codeChallenge)
+	v.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return meta.AuthorizationEndpoint + sep + v.Encode(), nil
+}
+
+// Exchange trades an authorization code and its PKCE verifier for tokens.
+func (p *Provider) Exchange(ctx context.Context, code, verifier string) (*Tokens, error) {
+	meta, err := p.Metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("code_verifier", verifier)
+	if p.ClientSecret == "" {
+		form.Set("client_id", p.ClientID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		// client_secret_basic, RFC 6749 section 2.3.1
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var oauthErr struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		if json.Unmarshal(body, &oauthErr) == nil && oauthErr.Error != "" {
+			return nil, fmt.Errorf("token exchange: %s: %s", oauthErr.Error, oauthErr.Description)
+		}
+		return nil, fmt.Errorf("token exchange: unexpected status %s", resp.Status)
+	}
+
+	var tokens Tokens
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return nil, fmt.Errorf("token exchange: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return nil, errors.New("token exchange: no id_token in response")
+	}
+
+	return &tokens, nil
+}
+
+// VerifyIDToken checks the signature of an ID token against the provider
+// keys, that it was issued by the provider for us, that it is not expired and
+// that it carries the nonce of the login request.
+func (p *Provider) VerifyIDToken(ctx context.Context, raw, nonce string) (*IDToken, error) {
+	meta, err := p.Metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	algs := supportedAlgorithms
+	if len(meta.SigningAlgorithms) > 0 {
+		algs = nil
+		for _, alg := range meta.SigningAlgorithms {
+			for _, supported := range supportedAlgorithms {
+				if alg == supported {
+					algs = append(algs, alg)
+				}
+			}
+		}
+	}
+
+	var token IDToken
+	parser := jwt.NewParser(jwt.WithValidMethods(algs), jwt.WithoutClaimsValidation())
+	_, err = parser.ParseWithClaims(raw, &token, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.key(ctx, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	now := time.Now()
+	switch {
+	case strings.TrimSuffix(token.Issuer, "/") != strings.TrimSuffix(meta.Issuer, "/"):
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidToken, token.Issuer)
+	case !token.VerifyAudience(p.ClientID, true):
+		return nil, fmt.Errorf("%w: not issued for this client", ErrInvalidToken)
+	case len(token.Audience) > 1 && token.AuthorizedBy != p.ClientID:
+		return nil, fmt.Errorf("%w: unexpected authorized party %q", ErrInvalidToken, token.AuthorizedBy)
+	case !token.VerifyExpiresAt(now.Add(-Leeway), true):
+		return nil, fmt.Errorf("%w: expired", ErrInvalidToken)
+	case !token.VerifyIssuedAt(now.Add(Leeway), true):
+		return nil, fmt.Errorf("%w: issued in the future", ErrInvalidToken)
+	case !token.VerifyNotBefore(now.Add(Leeway), false):
+		return nil, fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+	case token.Subject == "":
+		return nil, fmt.Errorf("%w: no subject", ErrInvalidToken)
+	case subtle.ConstantTimeCompare([]byte(token.Nonce), []byte(nonce)) != 1:
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidToken)
+	}
+
+	return &token, nil
+}
+
+// key returns the provider key with the given id, fetching the provider keys
+// again if it is unknown, as the provider may have rotated them.
+func (p *Provider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	lookup := func() (crypto.PublicKey, bool) {
+		if kid == "" && len(p.keys) == 1 {
+			for _, k := range p.keys {
+				return k, true
+			}
+		}
+		k, ok := p.keys[kid]
+		return k, ok
+	}
+
+	if k, ok := lookup(); ok {
+		return k, nil
+	}
+	if time.Since(p.keysFetched) < keysRefreshInterval {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := p.getJSON(ctx, p.meta.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	p.keysFetched = time.Now()
+
+	p.keys = make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, raw := range set.Keys {
+		id, key, err := parseJWK(raw)
+		if err != nil {
+			// Skip the keys we can't use, such as encryption keys
+			continue
+		}
+		p.keys[id] = key
+	}
+
+	if k, ok := lookup(); ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+// parseJWK decodes an RSA or EC signing key of a JWK set.
+func parseJWK(raw json.RawMessage) (string, crypto.PublicKey, error) {
+	var k struct {
+		KeyType string `json:"kty"`
+		KeyID   string `json:"kid"`
+		Use     string `json:"use"`
+		N       string `json:"n"`
+		E       string `json:"e"`
+		Curve   string `json:"crv"`
+		X       string `json:"x"`
+		Y       string `json:"y"`
+	}
+	if err := json.Unmarshal(raw, &k); err != nil {
+		return "", nil, err
+	}
+	if k.Use != "" && k.Use != "sig" {
+		return "", nil, fmt.Errorf("key %q is not a signing key", k.KeyID)
+	}
+
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch k.KeyType {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return "", nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return "", nil, err
+		}
+		if !e.IsInt64() || n.BitLen() < 2048 {
+			return "", nil, fmt.Errorf("unsupported RSA key %q", k.KeyID)
+		}
+		return k.KeyID, &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return "", nil, fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return "", nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return "", nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return "", nil, fmt.Errorf("invalid EC key %q", k.KeyID)
+		}
+		return k.KeyID, &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return "", nil, fmt.Errorf("unsupported key type %q", k.KeyType)
+}
@@ -0,0 +1,241 @@
+package oidc_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/snirkop89/go-movies/internal/oidc"
+	"github.com/snirkop89/go-movies/internal/oidc/oidctest"
+)
+
+var testUser = oidctest.User{
+	Subject:       "alice-1",
+	Email:         "alice@example.com",
+	EmailVerified: true,
+	GivenName:     "Alice",
+	FamilyName:    "Liddell",
+}
+
+func newProvider(idp *oidctest.Server) *oidc.Provider {
+	return &oidc.Provider{
+		Issuer:       idp.URL,
+		ClientID:     idp.ClientID,
+		ClientSecret: idp.ClientSecret,
+		RedirectURL:  "http://localhost:8080/oidc/callback",
+		Scopes:       []string{"email", "profile"},
+	}
+}
+
+// login runs the authorization code flow and returns the ID token.
+func login(t *testing.T, p *oidc.Provider, verifierOverride string) (string, string, error) {
+	t.Helper()
+	ctx := context.Background()
+
+	verifier, challenge, err := oidc.NewPKCE()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce, _ := oidc.RandomString(16)
+
+	authURL, err := p.AuthCodeURL(ctx, "the-state", nonce, challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: got %s to %q", resp.Status, resp.Header.Get("Location"))
+	}
+	if got := loc.Query().Get("state"); got != "the-state" {
+		t.Fatalf("state = %q", got)
+	}
+
+	if verifierOverride != "" {
+		verifier = verifierOverride
+	}
+	tokens, err := p.Exchange(ctx, loc.Query().Get("code"), verifier)
+	if err != nil {
+		return "", "", err
+	}
+	return tokens.IDToken, nonce, nil
+}
+
+func TestLogin(t *testing.T) {
+	idp := oidctest.NewServer("movies", "s3cret", testUser)
+	defer idp.Close()
+
+	p := newProvider(idp)
+	raw, nonce, err := login(t, p, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := p.VerifyIDToken(context.Background(), raw, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Subject != testUser.Subject || token.Email != testUser.Email || !token.EmailVerified ||
+		token.GivenName != testUser.GivenName || token.FamilyName != testUser.FamilyName {
+		t.Errorf("unexpected claims %+v", token)
+	}
+}
+
+func TestExchangeRejectsWrongVerifier(t *testing.T) {
+	idp := oidctest.NewServer("movies", "s3cret", testUser)
+	defer idp.Close()
+
+	_, _, err := login(t, newProvider(idp), "not-the-verifier-not-the-verifier-not-the")
+	if err == nil {
+		t.Fatal("exchange succeeded with a wrong PKCE verifier")
+	}
+}
+
+func TestExchangeRejectsWrongSecret(t *testing.T) {
+	idp := oidctest.NewServer("movies", "s3cret", testUser)
+	defer idp.Close()
+
+	p := newProvider(idp)
+	p.ClientSecret = "wrong"
+	if _, _, err := login(t, p, ""); err == nil {
+		t.Fatal("exchange succeeded with a wrong client secret")
+	}
+}
+
+func TestDiscoveryRejectsIssuerMismatch(t *testing.T) {
+	idp := oidctest.NewServer("movies", "", testUser)
+	defer idp.Close()
+
+	p := newProvider(idp)
+	p.Issuer = idp.URL + "/other"
+	if _, err := p.Metadata(context.Background()); err == nil {
+		t.Fatal("discovery accepted a configuration for another issuer")
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	idp := oidctest.NewServer("movies", "", testUser)
+	defer idp.Close()
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := func() jwt.MapClaims {
+		now := time.Now()
+		return jwt.MapClaims{
+			"iss":   idp.URL,
+			"sub":   "alice-1",
+			"aud":   "movies",
+			"iat":   now.Unix(),
+			"exp":   now.Add(5 * time.Minute).Unix(),
+			"nonce": "n0nce",
+		}
+	}
+
+	tests := []struct {
+		name   string
+		token  func() string
+		wantOK bool
+	}{
+		{"valid", func() string {
+			s, _ := idp.Sign(valid())
+			return s
+		}, true},
+		{"multiple audiences with azp", func() string {
+			c := valid()
+			c["aud"] = []string{"movies", "other"}
+			c["azp"] = "movies"
+			s, _ := idp.Sign(c)
+			return s
+		}, true},
+		{"multiple audiences without azp", func() string {
+			c := valid()
+			c["aud"] = []string{"movies", "other"}
+			s, _ := idp.Sign(c)
+			return s
+		}, false},
+		{"other audience", func() string {
+			c := valid()
+			c["aud"] = "other"
+			s, _ := idp.Sign(c)
+			return s
+		}, false},
+		{"other issuer", func() string {
+			c := valid()
+			c["iss"] = "https://evil.example.com"
+			s, _ := idp.Sign(c)
+			return s
+		}, false},
+		{"expired", func() string {
+			c := valid()
+			c["exp"] = time.Now().Add(-2 * oidc.Leeway).Unix()
+			s, _ := idp.Sign(c)
+			return s
+		}, false},
+		{"expired within leeway", func() string {
+			c := valid()
+			c["exp"] = time.Now().Add(-oidc.Leeway / 2).Unix()
+			s, _ := idp.Sign(c)
+			return s
+		}, true},
+		{"wrong nonce", func() string {
+			c := valid()
+			c["nonce"] = "other"
+			s, _ := idp.Sign(c)
+			return s
+		}, false},
+		{"no subject", func() string {
+			c := valid()
+			delete(c, "sub")
+			s, _ := idp.Sign(c)
+			return s
+		}, false},
+		{"unknown key", func() string {
+			token := jwt.NewWithClaims(jwt.SigningMethodRS256, valid())
+			token.Header["kid"] = oidctest.KeyID
+			s, _ := token.SignedString(otherKey)
+			return s
+		}, false},
+		{"alg none", func() string {
+			token := jwt.NewWithClaims(jwt.SigningMethodNone, valid())
+			s, _ := token.SignedString(jwt.UnsafeAllowNoneSignatureType)
+			return s
+		}, false},
+		{"HS256 with the client id", func() string {
+			token := jwt.NewWithClaims(jwt.SigningMethodHS256, valid())
+			token.Header["kid"] = oidctest.KeyID
+			s, _ := token.SignedString([]byte("movies"))
+			return s
+		}, false},
+	}
+
+	p := newProvider(idp)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := p.VerifyIDToken(context.Background(), tt.token(), "n0nce")
+			if tt.wantOK && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tt.wantOK && !errors.Is(err, oidc.ErrInvalidToken) {
+				t.Fatalf("got %v, want ErrInvalidToken", err)
+			}
+		})
+	}
+}
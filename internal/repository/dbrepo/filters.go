@@ -0,0 +1,96 @@
+package dbrepo
+
+import (
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/snirkop89/go-movies/internal/models"
+	"github.com/snirkop89/go-movies/internal/repository"
+)
+
+// paginate trims the extra row fetched to detect a next page and builds the
+// metadata of the page.
+func paginate(filter repository.MovieFilter, movies []*models.Movie, total int) ([]*models.Movie, repository.Metadata) {
+	meta := repository.Metadata{TotalRecords: total}
+	if filter.PerPage <= 0 {
+		return movies, meta
+	}
+
+	meta.PerPage = filter.PerPage
+	if filter.After == "" {
+		meta.CurrentPage = 1
+		if filter.Page > 1 {
+			meta.CurrentPage = filter.Page
+		}
+	}
+
+	if len(movies) > filter.PerPage {
+		movies = movies[:filter.PerPage]
+		meta.NextCursor = filter.NextCursor(movies[len(movies)-1])
+	}
+
+	return movies, meta
+}
+
+// compareMovies orders two movies by column, then by id.
+func compareMovies(a, b *models.Movie, column string) int {
+	var c int
+	switch column {
+	case "release_date":
+		c = compareTimes(a.ReleaseDate, b.ReleaseDate)
+	case "runtime":
+		c = a.Runtime - b.Runtime
+	case "created_at":
+		c = compareTimes(a.CreatedAt, b.CreatedAt)
+	default:
+		c = strings.Compare(a.Title, b.Title)
+	}
+
+	if c != 0 {
+		return c
+	}
+	return a.ID - b.ID
+}
+
+func compareTimes(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+// cursorMovie builds a movie holding the cursor position, so it can be
+// compared with compareMovies.
+func cursorMovie(column string, cursor repository.Cursor) (*models.Movie, error) {
+	movie := &models.Movie{ID: cursor.ID}
+
+	var err error
+	switch column {
+	case "release_date":
+		movie.ReleaseDate, err = time.Parse("2006-01-02", cursor.Value)
+	case "runtime":
+		movie.Runtime, err = strconv.Atoi(cursor.Value)
+	case "created_at":
+		movie.CreatedAt, err = time.Parse(time.RFC3339Nano, cursor.Value)
+	default:
+		movie.Title = cursor.Value
+	}
+	if err != nil {
+		return nil, repository.ErrInvalidCursor
+	}
+
+	return movie, nil
+}
+
+// searchTerms splits a search query into lower-cased words, dropping
+// anything that is not a letter or a digit.
+func searchTerms(query string) []string {
+	return strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
@@ -0,0 +1,1728 @@
+package dbrepo
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"html"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/snirkop89/go-movies/internal/models"
+	"github.com/snirkop89/go-movies/internal/repository"
+)
+
+// MemoryDBRepo is an in-memory implementation of repository.DatabaseRepo.
+// It is safe for concurrent use and is meant for tests and local demos.
+type MemoryDBRepo struct {
+	mu   *sync.RWMutex
+	data *memoryData
+	inTx bool
+}
+
+// memoryData holds the tables of the in-memory store.
+type memoryData struct {
+	movies      map[int]*models.Movie
+	genres      map[int]*models.Genre
+	users       map[int]*models.User
+	movieGenres map[int][]int // movie id -> genre ids
+	tokens      map[string]*models.RefreshToken
+	logins      map[string]*models.LoginAttempts
+	recovery    map[int]map[string]bool // user id -> code hash -> used
+	resets      map[string]*models.PasswordReset
+	apiKeys     map[int]*models.APIKey
+	identities  map[[2]string]*models.UserIdentity // issuer, subject
+	audit       []*models.AuditEntry               // in insertion order
+	revisions   map[int][]*models.MovieRevision    // movie id -> revisions in order
+	nextMovieID int
+	nextGenreID int
+	nextUserID  int
+	nextKeyID   int
+	nextAuditID int64
+}
+
+// NewMemoryDBRepo returns an empty in-memory repository.
+func NewMemoryDBRepo() *MemoryDBRepo {
+	return &MemoryDBRepo{
+		mu: &sync.RWMutex{},
+		data: &memoryData{
+			movies:      make(map[int]*models.Movie),
+			genres:      make(map[int]*models.Genre),
+			users:       make(map[int]*models.User),
+			movieGenres: make(map[int][]int),
+			tokens:      make(map[string]*models.RefreshToken),
+			logins:      make(map[string]*models.LoginAttempts),
+			recovery:    make(map[int]map[string]bool),
+			resets:      make(map[string]*models.PasswordReset),
+			apiKeys:     make(map[int]*models.APIKey),
+			identities:  make(map[[2]string]*models.UserIdentity),
+			revisions:   make(map[int][]*models.MovieRevision),
+			nextMovieID: 1,
+			nextGenreID: 1,
+			nextUserID:  1,
+			nextKeyID:   1,
+			nextAuditID: 1,
+		},
+	}
+}
+
+// clone returns a deep copy of the data.
+func (d *memoryData) clone() *memoryData {
+	c := &memoryData{
+		movies:      make(map[int]*models.Movie, len(d.movies)),
+		genres:      make(map[int]*models.Genre, len(d.genres)),
+		users:       make(map[int]*models.User, len(d.users)),
+		movieGenres: make(map[int][]int, len(d.movieGenres)),
+		tokens:      make(map[string]*models.RefreshToken, len(d.tokens)),
+		logins:      make(map[string]*models.LoginAttempts, len(d.logins)),
+		recovery:    make(map[int]map[string]bool, len(d.recovery)),
+		resets:      make(map[string]*models.PasswordReset, len(d.resets)),
+		apiKeys:     make(map[int]*models.APIKey, len(d.apiKeys)),
+		identities:  make(map[[2]string]*models.UserIdentity, len(d.identities)),
+		revisions:   make(map[int][]*models.MovieRevision, len(d.revisions)),
+		nextMovieID: d.nextMovieID,
+		nextGenreID: d.nextGenreID,
+		nextUserID:  d.nextUserID,
+		nextKeyID:   d.nextKeyID,
+		nextAuditID: d.nextAuditID,
+		audit:       make([]*models.AuditEntry, len(d.audit)),
+	}
+	for id, movie := range d.movies {
+		mv := *movie
+		c.movies[id] = &mv
+	}
+	for id, genre := range d.genres {
+		g := *genre
+		c.genres[id] = &g
+	}
+	for id, user := range d.users {
+		u := *user
+		c.users[id] = &u
+	}
+	for id, genres := range d.movieGenres {
+		c.movieGenres[id] = append([]int(nil), genres...)
+	}
+	for id, token := range d.tokens {
+		t := *token
+		c.tokens[id] = &t
+	}
+	for key, login := range d.logins {
+		l := *login
+		c.logins[key] = &l
+	}
+	for id, key := range d.apiKeys {
+		c.apiKeys[id] = copyAPIKey(key)
+	}
+	for id, revs := range d.revisions {
+		c.revisions[id] = make([]*models.MovieRevision, len(revs))
+		for i, rev := range revs {
+			c.revisions[id][i] = copyMovieRevision(rev)
+		}
+	}
+	for i, entry := range d.audit {
+		c.audit[i] = copyAuditEntry(entry)
+	}
+	for key, identity := range d.identities {
+		i := *identity
+		c.identities[key] = &i
+	}
+	for hash, reset := range d.resets {
+		r := *reset
+		c.resets[hash] = &r
+	}
+	for id, codes := range d.recovery {
+		c.recovery[id] = make(map[string]bool, len(codes))
+		for hash, used := range codes {
+			c.recovery[id][hash] = used
+		}
+	}
+	return c
+}
+
+// Connection returns nil, there is no underlying database.
+func (m *MemoryDBRepo) Connection() *sql.DB {
+	return nil
+}
+
+// WithTx runs fn against a private copy of the data, which replaces the
+// store only if fn returns nil. Transactions are serialized: the store is
+// locked for the duration of fn, so fn must only use the repo it is given.
+func (m *MemoryDBRepo) WithTx(ctx context.Context, fn func(repo repository.DatabaseRepo) error) error {
+	if m.inTx {
+		return fn(m)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tx := &MemoryDBRepo{
+		mu:   &sync.RWMutex{},
+		data: m.data.clone(),
+		inTx: true,
+	}
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	m.data = tx.data
+	return nil
+}
+
+// Seed loads the same fixtures as the 0002_seed_data migration.
+func (m *MemoryDBRepo) Seed() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	created := time.Date(2022, 9, 23, 0, 0, 0, 0, time.UTC)
+
+	genres := []string{
+		"Comedy", "Sci-Fi", "Horror", "Romance", "Action", "Thriller", "Drama",
+		"Mystery", "Crime", "Animation", "Adventure", "Fantasy", "Superhero",
+	}
+	for i, name := range genres {
+		m.data.genres[i+1] = &models.Genre{ID: i + 1, Genre: name, CreatedAt: created, UpdateAt: created}
+	}
+	m.data.nextGenreID = len(genres) + 1
+
+	movies := []models.Movie{
+		{
+			ID:          1,
+			Title:       "Highlander",
+			ReleaseDate: time.Date(1986, 3, 7, 0, 0, 0, 0, time.UTC),
+			Runtime:     116,
+			MPAARating:  "R",
+			Description: "He fought his first battle on the Scottish Highlands in 1536. He will fight his greatest battle on the streets of New York City in 1986. His name is Connor MacLeod. He is immortal.",
+			Image:       "/8Z8dptJEypuLoOQro1WugD855YE.jpg",
+			GenresArray: []int{5, 12},
+		},
+		{
+			ID:          2,
+			Title:       "Raiders of the Lost Ark",
+			ReleaseDate: time.Date(1981, 6, 12, 0, 0, 0, 0, time.UTC),
+			Runtime:     115,
+			MPAARating:  "PG-13",
+			Description: "Archaeology professor Indiana Jones ventures to seize a biblical artefact known as the Ark of the Covenant. While doing so, he puts up a fight against Renee and a troop of Nazis.",
+			Image:       "/ceG9VzoRAVGwivFU403Wc3AHRys.jpg",
+			GenresArray: []int{5, 11},
+		},
+		{
+			ID:          3,
+			Title:       "The Godfather",
+			ReleaseDate: time.Date(1972, 3, 24, 0, 0, 0, 0, time.UTC),
+			Runtime:     175,
+			MPAARating:  "18A",
+			Description: "The aging patriarch of an organized crime dynasty in postwar New York City transfers control of his clandestine empire to his reluctant youngest son.",
+			Image:       "/3bhkrj58Vtu7enYsRolD1fZdja1.jpg",
+			GenresArray: []int{9, 7},
+		},
+	}
+	for i := range movies {
+		movie := movies[i]
+		movie.CreatedAt = created
+		movie.UpdateAt = created
+		movie.Version = 1
+		m.data.movieGenres[movie.ID] = movie.GenresArray
+		movie.GenresArray = nil
+		m.data.movies[movie.ID] = &movie
+		if movie.ID >= m.data.nextMovieID {
+			m.data.nextMovieID = movie.ID + 1
+		}
+	}
+
+	m.data.users[1] = &models.User{
+		ID:        1,
+		FirstName: "Admin",
+		LastName:  "User",
+		Email:     "admin@example.com",
+		Password:  "$2a$14$wVsaPvJnJJsomWArouWCtusem6S/.Gauq/GjOIEHpyh2DAMmso1wy",
+		Role:      models.RoleAdmin,
+		CreatedAt: created,
+		UpdatedAt: created,
+	}
+	m.data.nextUserID = 2
+}
+
+func (m *MemoryDBRepo) AllMovies(ctx context.Context, filter repository.MovieFilter) ([]*models.Movie, repository.Metadata, error) {
+	var meta repository.Metadata
+
+	if err := ctx.Err(); err != nil {
+		return nil, meta, err
+	}
+
+	if err := filter.Validate(); err != nil {
+		return nil, meta, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var movies []*models.Movie
+	for _, movie := range m.data.movies {
+		if movie.DeletedAt != nil || !m.matchesFilter(movie, filter) {
+			continue
+		}
+		mv := *movie
+		movies = append(movies, &mv)
+	}
+
+	col := filter.SortColumn()
+	desc := filter.Descending()
+	less := func(a, b *models.Movie) bool {
+		if desc {
+			return compareMovies(a, b, col) > 0
+		}
+		return compareMovies(a, b, col) < 0
+	}
+	sort.Slice(movies, func(i, j int) bool {
+		return less(movies[i], movies[j])
+	})
+
+	total := len(movies)
+
+	if filter.After != "" {
+		cursor, err := filter.Cursor()
+		if err != nil {
+			return nil, meta, err
+		}
+		pivot, err := cursorMovie(col, cursor)
+		if err != nil {
+			return nil, meta, err
+		}
+		// Skip everything up to and including the cursor position
+		i := sort.Search(len(movies), func(i int) bool {
+			return less(pivot, movies[i])
+		})
+		movies = movies[i:]
+	}
+
+	if filter.PerPage > 0 {
+		offset := filter.Offset()
+		if offset > len(movies) {
+			offset = len(movies)
+		}
+		movies = movies[offset:]
+		if len(movies) > filter.PerPage+1 {
+			movies = movies[:filter.PerPage+1]
+		}
+	}
+
+	movies, meta = paginate(filter, movies, total)
+
+	return movies, meta, nil
+}
+
+// GenresMovies returns a page of the movies of every genre of genreIDs
+// matching filter, each genre paginated on its own. Its Genres and Genre
+// fields are ignored.
+func (m *MemoryDBRepo) GenresMovies(ctx context.Context, genreIDs []int, filter repository.MovieFilter) (map[int]repository.MoviePage, error) {
+	filter.Genres = nil
+
+	pages := make(map[int]repository.MoviePage, len(genreIDs))
+	for _, id := range genreIDs {
+		filter.Genre = id
+		movies, meta, err := m.AllMovies(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+		pages[id] = repository.MoviePage{Movies: movies, Metadata: meta}
+	}
+
+	return pages, nil
+}
+
+// matchesFilter reports whether movie passes the filter criteria.
+// The caller must hold the lock.
+func (m *MemoryDBRepo) matchesFilter(movie *models.Movie, filter repository.MovieFilter) bool {
+	if len(filter.Genres) > 0 {
+		found := false
+		for _, id := range filter.Genres {
+			if containsInt(m.data.movieGenres[movie.ID], id) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if filter.Genre > 0 && !containsInt(m.data.movieGenres[movie.ID], filter.Genre) {
+		return false
+	}
+
+	if len(filter.MPAARatings) > 0 {
+		found := false
+		for _, rating := range filter.MPAARatings {
+			if movie.MPAARating == rating {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	year := movie.ReleaseDate.Year()
+	if filter.YearFrom > 0 && year < filter.YearFrom {
+		return false
+	}
+	if filter.YearTo > 0 && year > filter.YearTo {
+		return false
+	}
+	if filter.RuntimeMin > 0 && movie.Runtime < filter.RuntimeMin {
+		return false
+	}
+	if filter.RuntimeMax > 0 && movie.Runtime > filter.RuntimeMax {
+		return false
+	}
+
+	return true
+}
+
+// SearchMovies approximates the Postgres full-text search: every word of the
+// query must appear in the title or the description, the last one as a
+// prefix. Title matches rank higher than description ones.
+func (m *MemoryDBRepo) SearchMovies(ctx context.Context, query string, limit int) ([]*models.MovieSearchResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var results []*models.MovieSearchResult
+	for _, movie := range m.data.movies {
+		if movie.DeletedAt != nil {
+			continue
+		}
+
+		titleWords := searchTerms(movie.Title)
+		descWords := searchTerms(movie.Description)
+
+		rank := 0.0
+		for i, term := range terms {
+			prefix := i == len(terms)-1
+			t := countMatches(titleWords, term, prefix)
+			d := countMatches(descWords, term, prefix)
+			if t+d == 0 {
+				rank = 0
+				break
+			}
+			rank += float64(t) + 0.4*float64(d)
+		}
+		if rank == 0 {
+			continue
+		}
+
+		results = append(results, &models.MovieSearchResult{
+			Movie:   *movie,
+			Rank:    rank,
+			Snippet: highlight(movie.Description, terms),
+		})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Rank != results[j].Rank {
+			return results[i].Rank > results[j].Rank
+		}
+		return results[i].Title < results[j].Title
+	})
+
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+
+	return results, nil
+}
+
+func (m *MemoryDBRepo) OneMovie(ctx context.Context, id int) (*models.Movie, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	movie, ok := m.data.movies[id]
+	if !ok || movie.DeletedAt != nil {
+		return nil, sql.ErrNoRows
+	}
+
+	mv := *movie
+	mv.Genres = m.movieGenresSorted(id)
+
+	return &mv, nil
+}
+
+func (m *MemoryDBRepo) EditMovie(ctx context.Context, id int) (*models.Movie, []*models.Genre, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	movie, ok := m.data.movies[id]
+	if !ok || movie.DeletedAt != nil {
+		return nil, nil, sql.ErrNoRows
+	}
+
+	mv := *movie
+	mv.Genres = m.movieGenresSorted(id)
+	for _, g := range mv.Genres {
+		mv.GenresArray = append(mv.GenresArray, g.ID)
+	}
+
+	var allGenres []*models.Genre
+	for _, g := range m.allGenresSorted() {
+		allGenres = append(allGenres, &models.Genre{ID: g.ID, Genre: g.Genre})
+	}
+
+	return &mv, allGenres, nil
+}
+
+func (m *MemoryDBRepo) UserByEmail(ctx context.Context, email string) (*models.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	email = models.NormalizeEmail(email)
+	for _, user := range m.data.users {
+		if models.NormalizeEmail(user.Email) == email {
+			u := *user
+			return &u, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+func (m *MemoryDBRepo) UserByID(ctx context.Context, id int) (*models.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	user, ok := m.data.users[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	u := *user
+	return &u, nil
+}
+
+func (m *MemoryDBRepo) InsertUser(ctx context.Context, user models.User) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user.Email = models.NormalizeEmail(user.Email)
+	if m.emailTaken(user.Email, 0) {
+		return 0, repository.ErrDuplicate
+	}
+	if user.Role == "" {
+		user.Role = models.RoleViewer
+	}
+
+	user.ID = m.data.nextUserID
+	m.data.nextUserID++
+	m.data.users[user.ID] = &user
+
+	return user.ID, nil
+}
+
+func (m *MemoryDBRepo) UpdateUser(ctx context.Context, user models.User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.data.users[user.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	email := models.NormalizeEmail(user.Email)
+	if m.emailTaken(email, user.ID) {
+		return repository.ErrDuplicate
+	}
+
+	existing.FirstName = user.FirstName
+	existing.LastName = user.LastName
+	existing.Email = email
+	existing.UpdatedAt = user.UpdatedAt
+
+	return nil
+}
+
+func (m *MemoryDBRepo) UpdateUserPassword(ctx context.Context, id int, hash string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.data.users[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	user.Password = hash
+	user.UpdatedAt = time.Now()
+
+	return nil
+}
+
+func (m *MemoryDBRepo) UpdateUserRole(ctx context.Context, id int, role string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.data.users[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	user.Role = role
+	user.UpdatedAt = time.Now()
+
+	return nil
+}
+
+// UpdateUserTOTP sets the TOTP secret of a user and whether it is required
+// to log in. An empty secret disables two-factor authentication.
+func (m *MemoryDBRepo) UpdateUserTOTP(ctx context.Context, id int, secret string, enabled bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.data.users[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	user.TOTPSecret = secret
+	user.TOTPEnabled = enabled
+	user.UpdatedAt = time.Now()
+
+	return nil
+}
+
+// UseTOTPStep records that the code of a time step was used. It fails with
+// ErrCodeReused if a code of that step, or of a later one, was already
+// accepted.
+func (m *MemoryDBRepo) UseTOTPStep(ctx context.Context, id int, step int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.data.users[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	if user.TOTPLastStep >= step {
+		return repository.ErrCodeReused
+	}
+	user.TOTPLastStep = step
+
+	return nil
+}
+
+// ReplaceRecoveryCodes replaces the recovery codes of a user.
+func (m *MemoryDBRepo) ReplaceRecoveryCodes(ctx context.Context, userID int, hashes []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	codes := make(map[string]bool, len(hashes))
+	for _, hash := range hashes {
+		codes[hash] = false
+	}
+	m.data.recovery[userID] = codes
+
+	return nil
+}
+
+// UseRecoveryCode marks a recovery code as used. It returns sql.ErrNoRows if
+// the code doesn't exist or was already used.
+func (m *MemoryDBRepo) UseRecoveryCode(ctx context.Context, userID int, hash string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	used, ok := m.data.recovery[userID][hash]
+	if !ok || used {
+		return sql.ErrNoRows
+	}
+	m.data.recovery[userID][hash] = true
+
+	return nil
+}
+
+func (m *MemoryDBRepo) DeleteUser(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.data.users[id]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(m.data.users, id)
+	delete(m.data.recovery, id)
+
+	for hash, r := range m.data.resets {
+		if r.UserID == id {
+			delete(m.data.resets, hash)
+		}
+	}
+
+	for kid, k := range m.data.apiKeys {
+		if k.UserID == id {
+			delete(m.data.apiKeys, kid)
+		}
+	}
+
+	for key, i := range m.data.identities {
+		if i.UserID == id {
+			delete(m.data.identities, key)
+		}
+	}
+
+	for tid, t := range m.data.tokens {
+		if t.UserID == id {
+			delete(m.data.tokens, tid)
+		}
+	}
+
+	return nil
+}
+
+// UserByIdentity returns the user linked to the subject of an OpenID Connect
+// issuer, or sql.ErrNoRows.
+func (m *MemoryDBRepo) UserByIdentity(ctx context.Context, issuer, subject string) (*models.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	identity, ok := m.data.identities[[2]string{issuer, subject}]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	user, ok := m.data.users[identity.UserID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	u := *user
+	return &u, nil
+}
+
+func (m *MemoryDBRepo) InsertUserIdentity(ctx context.Context, identity models.UserIdentity) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := [2]string{identity.Issuer, identity.Subject}
+	if _, ok := m.data.identities[key]; ok {
+		return repository.ErrDuplicate
+	}
+	if _, ok := m.data.users[identity.UserID]; !ok {
+		return sql.ErrNoRows
+	}
+
+	m.data.identities[key] = &identity
+
+	return nil
+}
+
+// emailTaken reports whether a user other than id already uses email.
+// The caller must hold the lock.
+func (m *MemoryDBRepo) emailTaken(email string, id int) bool {
+	for _, u := range m.data.users {
+		if u.ID != id && models.NormalizeEmail(u.Email) == email {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemoryDBRepo) AllGenres(ctx context.Context) ([]*models.Genre, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var genres []*models.Genre
+	for _, g := range m.allGenresSorted() {
+		genre := *g
+		genres = append(genres, &genre)
+	}
+
+	return genres, nil
+}
+
+func (m *MemoryDBRepo) OneGenre(ctx context.Context, id int) (*models.Genre, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	g, ok := m.data.genres[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	genre := *g
+	return &genre, nil
+}
+
+func (m *MemoryDBRepo) InsertGenre(ctx context.Context, genre models.Genre) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.genreNameTaken(genre.Genre, 0) {
+		return 0, repository.ErrDuplicate
+	}
+
+	genre.ID = m.data.nextGenreID
+	m.data.nextGenreID++
+	genre.Checked = false
+	m.data.genres[genre.ID] = &genre
+
+	return genre.ID, nil
+}
+
+func (m *MemoryDBRepo) UpdateGenre(ctx context.Context, genre models.Genre) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.data.genres[genre.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	if m.genreNameTaken(genre.Genre, genre.ID) {
+		return repository.ErrDuplicate
+	}
+
+	existing.Genre = genre.Genre
+	existing.UpdateAt = genre.UpdateAt
+
+	return nil
+}
+
+// MergeGenres moves every movie of the fromID genre to the intoID one, then
+// deletes fromID.
+func (m *MemoryDBRepo) MergeGenres(ctx context.Context, fromID, intoID int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if fromID == intoID {
+		return errors.New("cannot merge a genre into itself")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, fromOK := m.data.genres[fromID]
+	_, intoOK := m.data.genres[intoID]
+	if !fromOK || !intoOK {
+		return sql.ErrNoRows
+	}
+
+	for movieID, ids := range m.data.movieGenres {
+		if !containsInt(ids, fromID) {
+			continue
+		}
+		if !containsInt(ids, intoID) {
+			ids = append(ids, intoID)
+		}
+		m.data.movieGenres[movieID] = removeInt(ids, fromID)
+	}
+	delete(m.data.genres, fromID)
+
+	return nil
+}
+
+// DeleteGenre deletes a genre. If movies still use it, their links are moved
+// to reassignTo when set, dropped when force is set, and ErrGenreInUse is
+// returned otherwise.
+func (m *MemoryDBRepo) DeleteGenre(ctx context.Context, id int, reassignTo int, force bool) error {
+	if reassignTo > 0 {
+		return m.MergeGenres(ctx, id, reassignTo)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.data.genres[id]; !ok {
+		return sql.ErrNoRows
+	}
+
+	for movieID, ids := range m.data.movieGenres {
+		if !containsInt(ids, id) {
+			continue
+		}
+		if !force {
+			return repository.ErrGenreInUse
+		}
+		m.data.movieGenres[movieID] = removeInt(ids, id)
+	}
+	delete(m.data.genres, id)
+
+	return nil
+}
+
+// genreNameTaken reports whether another genre than id already has name,
+// ignoring case. The caller must hold the lock.
+func (m *MemoryDBRepo) genreNameTaken(name string, id int) bool {
+	for _, g := range m.data.genres {
+		if g.ID != id && strings.EqualFold(g.Genre, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemoryDBRepo) InsertMovie(ctx context.Context, movie models.Movie) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	movie.ID = m.data.nextMovieID
+	m.data.nextMovieID++
+	movie.Version = 1
+	movie.Genres = nil
+	movie.GenresArray = nil
+	m.data.movies[movie.ID] = &movie
+
+	return movie.ID, nil
+}
+
+func (m *MemoryDBRepo) UpdateMovie(ctx context.Context, movie models.Movie) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing, ok := m.data.movies[movie.ID]
+	if !ok || existing.DeletedAt != nil {
+		return sql.ErrNoRows
+	}
+	if existing.Version != movie.Version {
+		return repository.ErrEditConflict
+	}
+
+	existing.Title = movie.Title
+	existing.Description = movie.Description
+	existing.ReleaseDate = movie.ReleaseDate
+	existing.Runtime = movie.Runtime
+	existing.MPAARating = movie.MPAARating
+	existing.UpdateAt = movie.UpdateAt
+	existing.Image = movie.Image
+	existing.Version++
+
+	return nil
+}
+
+func (m *MemoryDBRepo) UpdateMovieGenres(ctx context.Context, id int, genresIDs []int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ids := make([]int, len(genresIDs))
+	copy(ids, genresIDs)
+	m.data.movieGenres[id] = ids
+
+	return nil
+}
+
+func (m *MemoryDBRepo) MovieGenres(ctx context.Context, movieIDs []int) (map[int][]*models.Genre, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	genres := make(map[int][]*models.Genre, len(movieIDs))
+	for _, id := range movieIDs {
+		if g := m.movieGenresSorted(id); len(g) > 0 {
+			genres[id] = g
+		}
+	}
+
+	return genres, nil
+}
+
+func (m *MemoryDBRepo) TrashMovie(ctx context.Context, id int, at time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	movie, ok := m.data.movies[id]
+	if !ok || movie.DeletedAt != nil {
+		return sql.ErrNoRows
+	}
+	movie.DeletedAt = &at
+
+	return nil
+}
+
+func (m *MemoryDBRepo) TrashedMovies(ctx context.Context) ([]*models.Movie, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var movies []*models.Movie
+	for _, movie := range m.data.movies {
+		if movie.DeletedAt == nil {
+			continue
+		}
+		mv := *movie
+		movies = append(movies, &mv)
+	}
+
+	sort.Slice(movies, func(i, j int) bool {
+		if !movies[i].DeletedAt.Equal(*movies[j].DeletedAt) {
+			return movies[i].DeletedAt.After(*movies[j].DeletedAt)
+		}
+		return movies[i].ID < movies[j].ID
+	})
+
+	return movies, nil
+}
+
+func (m *MemoryDBRepo) RestoreMovie(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	movie, ok := m.data.movies[id]
+	if !ok || movie.DeletedAt == nil {
+		return sql.ErrNoRows
+	}
+	movie.DeletedAt = nil
+
+	return nil
+}
+
+func (m *MemoryDBRepo) PurgeMovie(ctx context.Context, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	movie, ok := m.data.movies[id]
+	if !ok || movie.DeletedAt == nil {
+		return sql.ErrNoRows
+	}
+	m.purgeMovie(id)
+
+	return nil
+}
+
+func (m *MemoryDBRepo) PurgeTrash(ctx context.Context, before time.Time) ([]int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ids []int
+	for id, movie := range m.data.movies {
+		if movie.DeletedAt != nil && movie.DeletedAt.Before(before) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		m.purgeMovie(id)
+	}
+
+	return ids, nil
+}
+
+// purgeMovie removes a movie and everything attached to it. The caller must
+// hold the lock.
+func (m *MemoryDBRepo) purgeMovie(id int) {
+	delete(m.data.movies, id)
+	delete(m.data.movieGenres, id)
+	delete(m.data.revisions, id)
+}
+
+func (m *MemoryDBRepo) InsertRefreshToken(ctx context.Context, token models.RefreshToken) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.data.tokens[token.ID]; ok {
+		return repository.ErrDuplicate
+	}
+	m.data.tokens[token.ID] = &token
+
+	return nil
+}
+
+func (m *MemoryDBRepo) RefreshTokenByID(ctx context.Context, id string) (*models.RefreshToken, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	token, ok := m.data.tokens[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	t := *token
+	return &t, nil
+}
+
+// RotateRefreshToken revokes oldID in favour of next. It fails with
+// ErrTokenReused if oldID was already revoked.
+func (m *MemoryDBRepo) RotateRefreshToken(ctx context.Context, oldID string, next models.RefreshToken) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.data.tokens[oldID]
+	if !ok || old.RevokedAt != nil {
+		return repository.ErrTokenReused
+	}
+
+	now := time.Now()
+	old.RevokedAt = &now
+	old.ReplacedBy = next.ID
+	m.data.tokens[next.ID] = &next
+
+	return nil
+}
+
+func (m *MemoryDBRepo) RevokeRefreshTokenFamily(ctx context.Context, familyID string) error {
+	return m.revokeTokens(ctx, func(t *models.RefreshToken) bool {
+		return t.FamilyID == familyID
+	})
+}
+
+func (m *MemoryDBRepo) RevokeUserRefreshTokens(ctx context.Context, userID int) error {
+	return m.revokeTokens(ctx, func(t *models.RefreshToken) bool {
+		return t.UserID == userID
+	})
+}
+
+// RevokeOtherRefreshTokens revokes the sessions of a user, except the one of
+// the keepFamilyID refresh token family.
+func (m *MemoryDBRepo) RevokeOtherRefreshTokens(ctx context.Context, userID int, keepFamilyID string) error {
+	return m.revokeTokens(ctx, func(t *models.RefreshToken) bool {
+		return t.UserID == userID && t.FamilyID != keepFamilyID
+	})
+}
+
+// revokeTokens revokes every active refresh token matching fn.
+func (m *MemoryDBRepo) revokeTokens(ctx context.Context, fn func(t *models.RefreshToken) bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for _, t := range m.data.tokens {
+		if t.RevokedAt == nil && fn(t) {
+			t.RevokedAt = &now
+		}
+	}
+
+	return nil
+}
+
+// copyAPIKey returns a deep copy of key.
+func copyAPIKey(key *models.APIKey) *models.APIKey {
+	k := *key
+	k.Scopes = append([]string(nil), key.Scopes...)
+	return &k
+}
+
+func (m *MemoryDBRepo) InsertAPIKey(ctx context.Context, key models.APIKey) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, k := range m.data.apiKeys {
+		if k.Hash == key.Hash {
+			return 0, repository.ErrDuplicate
+		}
+	}
+
+	key.ID = m.data.nextKeyID
+	m.data.nextKeyID++
+	m.data.apiKeys[key.ID] = copyAPIKey(&key)
+
+	return key.ID, nil
+}
+
+func (m *MemoryDBRepo) APIKeyByHash(ctx context.Context, hash string) (*models.APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, k := range m.data.apiKeys {
+		if k.Hash == hash {
+			return copyAPIKey(k), nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+// UserAPIKeys returns the keys of a user, revoked ones included, newest
+// first.
+func (m *MemoryDBRepo) UserAPIKeys(ctx context.Context, userID int) ([]*models.APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	keys := []*models.APIKey{}
+	for _, k := range m.data.apiKeys {
+		if k.UserID == userID {
+			keys = append(keys, copyAPIKey(k))
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.After(keys[j].CreatedAt)
+		}
+		return keys[i].ID > keys[j].ID
+	})
+
+	return keys, nil
+}
+
+// RevokeAPIKey revokes a key of a user. It returns sql.ErrNoRows if the user
+// has no such active key.
+func (m *MemoryDBRepo) RevokeAPIKey(ctx context.Context, userID, id int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k, ok := m.data.apiKeys[id]
+	if !ok || k.UserID != userID || k.RevokedAt != nil {
+		return sql.ErrNoRows
+	}
+
+	now := time.Now()
+	k.RevokedAt = &now
+
+	return nil
+}
+
+// TouchAPIKey records when a key was last used.
+func (m *MemoryDBRepo) TouchAPIKey(ctx context.Context, id int, at time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if k, ok := m.data.apiKeys[id]; ok {
+		k.LastUsedAt = &at
+	}
+
+	return nil
+}
+
+func (m *MemoryDBRepo) InsertPasswordReset(ctx context.Context, reset models.PasswordReset) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.data.resets[reset.TokenHash]; ok {
+		return repository.ErrDuplicate
+	}
+	m.data.resets[reset.TokenHash] = &reset
+
+	return nil
+}
+
+// ConsumePasswordReset marks a reset token as used and returns the id of its
+// user. It returns sql.ErrNoRows if the token is unknown, expired at the given
+// time or already used.
+func (m *MemoryDBRepo) ConsumePasswordReset(ctx context.Context, tokenHash string, at time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	reset, ok := m.data.resets[tokenHash]
+	if !ok || reset.UsedAt != nil || !reset.ExpiresAt.After(at) {
+		return 0, sql.ErrNoRows
+	}
+	reset.UsedAt = &at
+
+	return reset.UserID, nil
+}
+
+// DeleteUserPasswordResets invalidates every reset token of a user.
+func (m *MemoryDBRepo) DeleteUserPasswordResets(ctx context.Context, userID int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for hash, r := range m.data.resets {
+		if r.UserID == userID {
+			delete(m.data.resets, hash)
+		}
+	}
+
+	return nil
+}
+
+func (m *MemoryDBRepo) LoginAttempts(ctx context.Context, key string) (*models.LoginAttempts, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	login, ok := m.data.logins[key]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	l := *login
+	return &l, nil
+}
+
+// RecordLoginFailure counts a failed login for key at the given time. The
+// count starts over when the previous failure is older than window.
+func (m *MemoryDBRepo) RecordLoginFailure(ctx context.Context, key string, at time.Time, window time.Duration) (*models.LoginAttempts, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	login, ok := m.data.logins[key]
+	if !ok {
+		login = &models.LoginAttempts{Key: key}
+		m.data.logins[key] = login
+	}
+	if login.LastFailureAt.Before(at.Add(-window)) {
+		login.Failures = 0
+	}
+	login.Failures++
+	login.LastFailureAt = at
+
+	l := *login
+	return &l, nil
+}
+
+func (m *MemoryDBRepo) LockLogin(ctx context.Context, key string, until time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	login, ok := m.data.logins[key]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	login.LockedUntil = until
+
+	return nil
+}
+
+func (m *MemoryDBRepo) ClearLoginAttempts(ctx context.Context, keys ...string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, key := range keys {
+		delete(m.data.logins, key)
+	}
+
+	return nil
+}
+
+// movieGenresSorted returns the genres of a movie ordered by name.
+// The caller must hold the lock.
+func (m *MemoryDBRepo) movieGenresSorted(id int) []*models.Genre {
+	var genres []*models.Genre
+	for _, gid := range m.data.movieGenres[id] {
+		if g, ok := m.data.genres[gid]; ok {
+			genres = append(genres, &models.Genre{ID: g.ID, Genre: g.Genre})
+		}
+	}
+
+	sort.Slice(genres, func(i, j int) bool {
+		return genres[i].Genre < genres[j].Genre
+	})
+
+	return genres
+}
+
+// allGenresSorted returns every genre ordered by name.
+// The caller must hold the lock.
+func (m *MemoryDBRepo) allGenresSorted() []*models.Genre {
+	genres := make([]*models.Genre, 0, len(m.data.genres))
+	for _, g := range m.data.genres {
+		genres = append(genres, g)
+	}
+
+	sort.Slice(genres, func(i, j int) bool {
+		return genres[i].Genre < genres[j].Genre
+	})
+
+	return genres
+}
+
+// removeInt returns a copy of s without v.
+func removeInt(s []int, v int) []int {
+	out := make([]int, 0, len(s))
+	for _, n := range s {
+		if n != v {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+func containsInt(s []int, v int) bool {
+	for _, n := range s {
+		if n == v {
+			return true
+		}
+	}
+	return false
+}
+
+// countMatches counts the words equal to term, or starting with it when
+// prefix is set.
+func countMatches(words []string, term string, prefix bool) int {
+	n := 0
+	for _, w := range words {
+		if w == term || (prefix && strings.HasPrefix(w, term)) {
+			n++
+		}
+	}
+	return n
+}
+
+// highlight wraps the words of text matching one of terms in <b></b>. The rest
+// of text is escaped, as the description can't be trusted to be HTML.
+func highlight(text string, terms []string) string {
+	var b strings.Builder
+
+	isWord := func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r)
+	}
+
+	runes := []rune(text)
+	for i := 0; i < len(runes); {
+		if !isWord(runes[i]) {
+			b.WriteString(html.EscapeString(string(runes[i])))
+			i++
+			continue
+		}
+
+		j := i
+		for j < len(runes) && isWord(runes[j]) {
+			j++
+		}
+		word := string(runes[i:j])
+
+		matched := false
+		for k, term := range terms {
+			if countMatches([]string{strings.ToLower(word)}, term, k == len(terms)-1) > 0 {
+				matched = true
+				break
+			}
+		}
+
+		if matched {
+			b.WriteString("<b>" + word + "</b>")
+		} else {
+			b.WriteString(word)
+		}
+		i = j
+	}
+
+	return b.String()
+}
+
+// copyAuditEntry returns a deep copy of entry.
+func copyAuditEntry(entry *models.AuditEntry) *models.AuditEntry {
+	e := *entry
+	if entry.UserID != nil {
+		id := *entry.UserID
+		e.UserID = &id
+	}
+	e.Changes = append(json.RawMessage(nil), entry.Changes...)
+	return &e
+}
+
+func (m *MemoryDBRepo) InsertAuditEntry(ctx context.Context, entry models.AuditEntry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry.ID = m.data.nextAuditID
+	m.data.nextAuditID++
+	m.data.audit = append(m.data.audit, copyAuditEntry(&entry))
+
+	return nil
+}
+
+// AuditEntries returns the entries matching filter, newest first.
+func (m *MemoryDBRepo) AuditEntries(ctx context.Context, filter repository.AuditFilter) ([]*models.AuditEntry, repository.Metadata, error) {
+	var meta repository.Metadata
+
+	if err := filter.Validate(); err != nil {
+		return nil, meta, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, meta, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	entries := []*models.AuditEntry{}
+	for i := len(m.data.audit) - 1; i >= 0; i-- {
+		e := m.data.audit[i]
+		switch {
+		case filter.UserID > 0 && (e.UserID == nil || *e.UserID != filter.UserID),
+			filter.Entity != "" && e.Entity != filter.Entity,
+			filter.EntityID != "" && e.EntityID != filter.EntityID,
+			filter.Action != "" && e.Action != filter.Action,
+			!filter.From.IsZero() && e.CreatedAt.Before(filter.From),
+			!filter.To.IsZero() && !e.CreatedAt.Before(filter.To):
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	meta.TotalRecords = len(entries)
+	if filter.PerPage > 0 {
+		meta.PerPage = filter.PerPage
+		meta.CurrentPage = 1
+		if filter.Page > 1 {
+			meta.CurrentPage = filter.Page
+		}
+
+		offset := filter.Offset()
+		if offset > len(entries) {
+			offset = len(entries)
+		}
+		end := offset + filter.PerPage
+		if end > len(entries) {
+			end = len(entries)
+		}
+		entries = entries[offset:end]
+	}
+
+	page := make([]*models.AuditEntry, len(entries))
+	for i, e := range entries {
+		page[i] = copyAuditEntry(e)
+	}
+
+	return page, meta, nil
+}
+
+// copyMovieRevision returns a deep copy of rev.
+func copyMovieRevision(rev *models.MovieRevision) *models.MovieRevision {
+	r := *rev
+	if rev.UserID != nil {
+		id := *rev.UserID
+		r.UserID = &id
+	}
+	r.Movie.Genres = make([]*models.Genre, len(rev.Movie.Genres))
+	for i, g := range rev.Movie.Genres {
+		genre := *g
+		r.Movie.Genres[i] = &genre
+	}
+	r.Movie.GenresArray = append([]int(nil), rev.Movie.GenresArray...)
+	return &r
+}
+
+// InsertMovieRevision saves rev as the next revision of its movie and
+// returns its number.
+func (m *MemoryDBRepo) InsertMovieRevision(ctx context.Context, rev models.MovieRevision) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.data.movies[rev.MovieID]; !ok {
+		return 0, sql.ErrNoRows
+	}
+
+	rev.Revision = len(m.data.revisions[rev.MovieID]) + 1
+	m.data.revisions[rev.MovieID] = append(m.data.revisions[rev.MovieID], copyMovieRevision(&rev))
+
+	return rev.Revision, nil
+}
+
+// MovieRevisions returns the revisions of a movie, newest first.
+func (m *MemoryDBRepo) MovieRevisions(ctx context.Context, movieID int) ([]*models.MovieRevision, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	revs := m.data.revisions[movieID]
+	list := make([]*models.MovieRevision, 0, len(revs))
+	for i := len(revs) - 1; i >= 0; i-- {
+		list = append(list, copyMovieRevision(revs[i]))
+	}
+
+	return list, nil
+}
+
+func (m *MemoryDBRepo) MovieRevision(ctx context.Context, movieID, revision int) (*models.MovieRevision, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	revs := m.data.revisions[movieID]
+	if revision < 1 || revision > len(revs) {
+		return nil, sql.ErrNoRows
+	}
+
+	return copyMovieRevision(revs[revision-1]), nil
+}
@@ -3,80 +3,449 @@ package dbrepo
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
+	"strings"
 	"time"
 
+	"github.com/jackc/pgconn"
 	"github.com/snirkop89/go-movies/internal/models"
+	"github.com/snirkop89/go-movies/internal/repository"
 )
 
 type PostgresDBRepo struct {
 	DB *sql.DB
+	// Timeout bounds every query, on top of the caller's context.
+	// Zero means dbTimeout.
+	Timeout time.Duration
+
+	// tx is set on the copies handed out by WithTx.
+	tx *sql.Tx
+}
+
+// dbtx is the subset of *sql.DB and *sql.Tx used by the repository.
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
 }
 
 const dbTimeout = time.Second * 3
 
+// uniqueViolation is the Postgres error code of a unique constraint failure
+const uniqueViolation = "23505"
+
+// withTimeout derives a context from the caller's one, bounded by the
+// repository timeout.
+func (m *PostgresDBRepo) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	timeout := m.Timeout
+	if timeout <= 0 {
+		timeout = dbTimeout
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
 func (m *PostgresDBRepo) Connection() *sql.DB {
 	return m.DB
 }
 
-func (m *PostgresDBRepo) AllMovies(genre ...int) ([]*models.Movie, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// conn returns the running transaction, if any, or the connection pool.
+func (m *PostgresDBRepo) conn() dbtx {
+	if m.tx != nil {
+		return m.tx
+	}
+	return m.DB
+}
+
+// WithTx runs fn inside a database transaction. The transaction is committed
+// if fn returns nil and rolled back otherwise. Calling WithTx on a repository
+// that is already part of a transaction reuses it.
+func (m *PostgresDBRepo) WithTx(ctx context.Context, fn func(repo repository.DatabaseRepo) error) error {
+	return m.inTx(ctx, func(tx *PostgresDBRepo) error {
+		return fn(tx)
+	})
+}
+
+func (m *PostgresDBRepo) inTx(ctx context.Context, fn func(tx *PostgresDBRepo) error) error {
+	if m.tx != nil {
+		return fn(m)
+	}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	// Rollback is a no-op once the transaction has been committed
+	defer tx.Rollback()
+
+	err = fn(&PostgresDBRepo{DB: m.DB, Timeout: m.Timeout, tx: tx})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// movieSortTypes maps the sortable columns to their SQL type, used to cast
+// cursor values.
+var movieSortTypes = map[string]string{
+	"title":        "text",
+	"release_date": "date",
+	"runtime":      "integer",
+	"created_at":   "timestamp",
+}
+
+// movieQuery builds the where clause and the arguments of a query on the
+// movies.
+type movieQuery struct {
+	conds []string
+	args  []any
+}
+
+// arg adds an argument and returns its placeholder.
+func (q *movieQuery) arg(v any) string {
+	q.args = append(q.args, v)
+	return fmt.Sprintf("$%d", len(q.args))
+}
+
+// list adds n arguments and returns their placeholders, comma separated.
+func (q *movieQuery) list(n int, v func(i int) any) string {
+	ph := make([]string, n)
+	for i := range ph {
+		ph[i] = q.arg(v(i))
+	}
+	return strings.Join(ph, ", ")
+}
+
+func (q *movieQuery) where() string {
+	return "where " + strings.Join(q.conds, " and ")
+}
+
+// newMovieQuery returns the conditions of the filter criteria, leaving the
+// cursor and the page out.
+func newMovieQuery(filter repository.MovieFilter) *movieQuery {
+	q := &movieQuery{conds: []string{"deleted_at is null"}}
+
+	if len(filter.Genres) > 0 {
+		q.conds = append(q.conds, fmt.Sprintf("id in (select movie_id from movies_genres where genre_id in (%s))",
+			q.list(len(filter.Genres), func(i int) any { return filter.Genres[i] })))
+	}
+	if filter.Genre > 0 {
+		q.conds = append(q.conds, "id in (select movie_id from movies_genres where genre_id = "+q.arg(filter.Genre)+")")
+	}
+	if len(filter.MPAARatings) > 0 {
+		q.conds = append(q.conds, fmt.Sprintf("mpaa_rating in (%s)",
+			q.list(len(filter.MPAARatings), func(i int) any { return filter.MPAARatings[i] })))
+	}
+	if filter.YearFrom > 0 {
+		q.conds = append(q.conds, "extract(year from release_date) >= "+q.arg(filter.YearFrom))
+	}
+	if filter.YearTo > 0 {
+		q.conds = append(q.conds, "extract(year from release_date) <= "+q.arg(filter.YearTo))
+	}
+	if filter.RuntimeMin > 0 {
+		q.conds = append(q.conds, "runtime >= "+q.arg(filter.RuntimeMin))
+	}
+	if filter.RuntimeMax > 0 {
+		q.conds = append(q.conds, "runtime <= "+q.arg(filter.RuntimeMax))
+	}
+
+	return q
+}
+
+// after adds the condition of the After cursor of filter, if any.
+func (q *movieQuery) after(filter repository.MovieFilter) error {
+	if filter.After == "" {
+		return nil
+	}
+	cursor, err := filter.Cursor()
+	if err != nil {
+		return err
+	}
+
+	col := filter.SortColumn()
+	cmp := ">"
+	if filter.Descending() {
+		cmp = "<"
+	}
+	q.conds = append(q.conds, fmt.Sprintf("(%s, id) %s (%s::%s, %s)", col, cmp, q.arg(cursor.Value), movieSortTypes[col], q.arg(cursor.ID)))
+	return nil
+}
+
+// sortDirection returns the SQL direction of the sort order of filter.
+func sortDirection(filter repository.MovieFilter) string {
+	if filter.Descending() {
+		return "desc"
+	}
+	return "asc"
+}
+
+const movieColumns = `id, title, release_date, runtime,
+			mpaa_rating, description, coalesce(image, ''), version,
+			created_at, updated_at`
+
+// scanMovie scans the movieColumns of a row, after dest.
+func scanMovie(rows *sql.Rows, movie *models.Movie, dest ...any) error {
+	return rows.Scan(append(dest,
+		&movie.ID,
+		&movie.Title,
+		&movie.ReleaseDate,
+		&movie.Runtime,
+		&movie.MPAARating,
+		&movie.Description,
+		&movie.Image,
+		&movie.Version,
+		&movie.CreatedAt,
+		&movie.UpdateAt,
+	)...)
+}
+
+func (m *PostgresDBRepo) AllMovies(ctx context.Context, filter repository.MovieFilter) ([]*models.Movie, repository.Metadata, error) {
+	var meta repository.Metadata
+
+	if err := filter.Validate(); err != nil {
+		return nil, meta, err
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
-	where := ""
-	if len(genre) > 0 {
-		where = fmt.Sprintf("where id in (select movie_id from movies_genres where genre_id = %d)", genre[0])
+	q := newMovieQuery(filter)
+
+	// Total number of matching rows, regardless of the page
+	err := m.conn().QueryRowContext(ctx, "select count(*) from movies "+q.where(), q.args...).Scan(&meta.TotalRecords)
+	if err != nil {
+		return nil, meta, err
+	}
+
+	if err := q.after(filter); err != nil {
+		return nil, meta, err
+	}
+
+	limit := ""
+	if filter.PerPage > 0 {
+		// Fetch one more row to know whether there is a next page
+		limit = fmt.Sprintf("limit %s offset %s", q.arg(filter.PerPage+1), q.arg(filter.Offset()))
 	}
 
+	col, dir := filter.SortColumn(), sortDirection(filter)
 	query := fmt.Sprintf(`
 		select
-			id, title, release_date, runtime,
-			mpaa_rating, description, coalesce(image, ''),
-			created_at, updated_at
+			%s
 		from
 			movies %s
 		order by
-			title`, where)
+			%s %s, id %s
+		%s`, movieColumns, q.where(), col, dir, dir, limit)
 
-	rows, err := m.DB.QueryContext(ctx, query)
+	rows, err := m.conn().QueryContext(ctx, query, q.args...)
 	if err != nil {
-		return nil, err
+		return nil, meta, err
 	}
 	defer rows.Close()
 
 	var movies []*models.Movie
 	for rows.Next() {
 		var movie models.Movie
+		if err := scanMovie(rows, &movie); err != nil {
+			return nil, meta, err
+		}
+		movies = append(movies, &movie)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, meta, err
+	}
+
+	movies, meta = paginate(filter, movies, meta.TotalRecords)
+
+	return movies, meta, nil
+}
+
+// GenresMovies returns a page of the movies of every genre of genreIDs
+// matching filter, each genre paginated on its own. Its Genres and Genre
+// fields are ignored.
+func (m *PostgresDBRepo) GenresMovies(ctx context.Context, genreIDs []int, filter repository.MovieFilter) (map[int]repository.MoviePage, error) {
+	filter.Genres, filter.Genre = nil, 0
+	if err := filter.Validate(); err != nil {
+		return nil, err
+	}
+
+	pages := make(map[int]repository.MoviePage, len(genreIDs))
+	if len(genreIDs) == 0 {
+		return pages, nil
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	q := newMovieQuery(filter)
+	genres := q.list(len(genreIDs), func(i int) any { return genreIDs[i] })
+
+	// Totals of the genres, regardless of the page
+	query := fmt.Sprintf(`
+		select genre_id, count(*)
+		from movies_genres
+		where genre_id in (%s) and movie_id in (select id from movies %s)
+		group by genre_id`, genres, q.where())
+
+	rows, err := m.conn().QueryContext(ctx, query, q.args...)
+	if err != nil {
+		return nil, err
+	}
+	totals := make(map[int]int, len(genreIDs))
+	for rows.Next() {
+		var genreID, total int
+		if err := rows.Scan(&genreID, &total); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		totals[genreID] = total
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := q.after(filter); err != nil {
+		return nil, err
+	}
+
+	// Number each genre's movies in the sort order, and keep the rows of
+	// the page plus one to know whether there is a next page
+	rank := ""
+	if filter.PerPage > 0 {
+		rank = fmt.Sprintf("where rank > %s and rank <= %s",
+			q.arg(filter.Offset()), q.arg(filter.Offset()+filter.PerPage+1))
+	}
+
+	col, dir := filter.SortColumn(), sortDirection(filter)
+	query = fmt.Sprintf(`
+		select
+			genre_id, %s
+		from (
+			select
+				mg.genre_id, m.*,
+				row_number() over (partition by mg.genre_id order by m.%s %s, m.id %s) as rank
+			from
+				movies_genres mg
+				join (select * from movies %s) m on m.id = mg.movie_id
+			where
+				mg.genre_id in (%s)
+		) ranked
+		%s
+		order by
+			genre_id, rank`, movieColumns, col, dir, dir, q.where(), genres, rank)
+
+	rows, err = m.conn().QueryContext(ctx, query, q.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	movies := make(map[int][]*models.Movie, len(genreIDs))
+	for rows.Next() {
+		var genreID int
+		var movie models.Movie
+		if err := scanMovie(rows, &movie, &genreID); err != nil {
+			return nil, err
+		}
+		movies[genreID] = append(movies[genreID], &movie)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, id := range genreIDs {
+		var page repository.MoviePage
+		page.Movies, page.Metadata = paginate(filter, movies[id], totals[id])
+		pages[id] = page
+	}
+
+	return pages, nil
+}
+
+// SearchMovies runs a full-text search over the title and description of the
+// movies. Every word of the query must match, the last one as a prefix so
+// partial input can be used for type-ahead.
+func (m *PostgresDBRepo) SearchMovies(ctx context.Context, query string, limit int) ([]*models.MovieSearchResult, error) {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+	terms[len(terms)-1] += ":*"
+	tsquery := strings.Join(terms, " & ")
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `
+		select
+			id, title, release_date, runtime,
+			mpaa_rating, description, coalesce(image, ''), version,
+			created_at, updated_at,
+			ts_rank(search, q) as rank,
+			ts_headline('english', translate(coalesce(description, ''), chr(1) || chr(2), ''), q,
+				'StartSel=' || chr(1) || ', StopSel=' || chr(2) || ', MaxFragments=2, MaxWords=25, MinWords=10')
+		from
+			movies, to_tsquery('english', $1) q
+		where
+			search @@ q and deleted_at is null
+		order by
+			rank desc, title
+		limit $2`
+
+	rows, err := m.conn().QueryContext(ctx, stmt, tsquery, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []*models.MovieSearchResult
+	for rows.Next() {
+		var r models.MovieSearchResult
 		err := rows.Scan(
-			&movie.ID,
-			&movie.Title,
-			&movie.ReleaseDate,
-			&movie.Runtime,
-			&movie.MPAARating,
-			&movie.Description,
-			&movie.Image,
-			&movie.CreatedAt,
-			&movie.UpdateAt,
+			&r.ID,
+			&r.Title,
+			&r.ReleaseDate,
+			&r.Runtime,
+			&r.MPAARating,
+			&r.Description,
+			&r.Image,
+			&r.Version,
+			&r.CreatedAt,
+			&r.UpdateAt,
+			&r.Rank,
+			&r.Snippet,
 		)
 		if err != nil {
 			return nil, err
 		}
-		movies = append(movies, &movie)
+		r.Snippet = snippetHTML(r.Snippet)
+		results = append(results, &r)
 	}
 
-	return movies, nil
+	return results, rows.Err()
+}
+
+// snippetHTML escapes a headline, whose matches are delimited by the \x01 and
+// \x02 control characters, then wraps the matches in <b></b>. The description
+// can't be trusted to be HTML.
+func snippetHTML(headline string) string {
+	return strings.NewReplacer("\x01", "<b>", "\x02", "</b>").Replace(html.EscapeString(headline))
 }
 
-func (m *PostgresDBRepo) OneMovie(id int) (*models.Movie, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (m *PostgresDBRepo) OneMovie(ctx context.Context, id int) (*models.Movie, error) {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
 	query := `select id, title, release_date, runtime, mpaa_rating,
-		description, coalesce(image, ''), created_at, updated_at
-		from movies where id = $1`
+		description, coalesce(image, ''), version, created_at, updated_at
+		from movies where id = $1 and deleted_at is null`
 
 	var movie models.Movie
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+	err := m.conn().QueryRowContext(ctx, query, id).Scan(
 		&movie.ID,
 		&movie.Title,
 		&movie.ReleaseDate,
@@ -84,6 +453,7 @@ func (m *PostgresDBRepo) OneMovie(id int) (*models.Movie, error) {
 		&movie.MPAARating,
 		&movie.Description,
 		&movie.Image,
+		&movie.Version,
 		&movie.CreatedAt,
 		&movie.UpdateAt,
 	)
@@ -96,7 +466,7 @@ func (m *PostgresDBRepo) OneMovie(id int) (*models.Movie, error) {
 		where mg.movie_id = $1
 		order by g.genre`
 
-	rows, err := m.DB.QueryContext(ctx, query, id)
+	rows, err := m.conn().QueryContext(ctx, query, id)
 	if err != nil && err != sql.ErrNoRows {
 		return nil, err
 	}
@@ -116,16 +486,16 @@ func (m *PostgresDBRepo) OneMovie(id int) (*models.Movie, error) {
 	return &movie, nil
 }
 
-func (m *PostgresDBRepo) EditMovie(id int) (*models.Movie, []*models.Genre, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (m *PostgresDBRepo) EditMovie(ctx context.Context, id int) (*models.Movie, []*models.Genre, error) {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
 	query := `select id, title, release_date, runtime, mpaa_rating,
-		description, coalesce(image, ''), created_at, updated_at
-		from movies where id = $1`
+		description, coalesce(image, ''), version, created_at, updated_at
+		from movies where id = $1 and deleted_at is null`
 
 	var movie models.Movie
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+	err := m.conn().QueryRowContext(ctx, query, id).Scan(
 		&movie.ID,
 		&movie.Title,
 		&movie.ReleaseDate,
@@ -133,6 +503,7 @@ func (m *PostgresDBRepo) EditMovie(id int) (*models.Movie, []*models.Genre, erro
 		&movie.MPAARating,
 		&movie.Description,
 		&movie.Image,
+		&movie.Version,
 		&movie.CreatedAt,
 		&movie.UpdateAt,
 	)
@@ -145,7 +516,7 @@ func (m *PostgresDBRepo) EditMovie(id int) (*models.Movie, []*models.Genre, erro
 		where mg.movie_id = $1
 		order by g.genre`
 
-	rows, err := m.DB.QueryContext(ctx, query, id)
+	rows, err := m.conn().QueryContext(ctx, query, id)
 	if err != nil && err != sql.ErrNoRows {
 		return nil, nil, err
 	}
@@ -167,7 +538,7 @@ func (m *PostgresDBRepo) EditMovie(id int) (*models.Movie, []*models.Genre, erro
 
 	// Get all available genres from DB
 	query = `select id, genre from genres order by genre`
-	gRows, err := m.DB.QueryContext(ctx, query)
+	gRows, err := m.conn().QueryContext(ctx, query)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -186,27 +557,32 @@ func (m *PostgresDBRepo) EditMovie(id int) (*models.Movie, []*models.Genre, erro
 	return &movie, allGenres, nil
 }
 
-func (m *PostgresDBRepo) UserByEmail(email string) (*models.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (m *PostgresDBRepo) UserByEmail(ctx context.Context, email string) (*models.User, error) {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
 	query := `
 		select
-			id, email, first_name, last_name, password, created_at, updated_at 
+			id, email, first_name, last_name, password, role, created_at, updated_at,
+			totp_secret, totp_enabled, totp_last_step
 		from 
 			users 
 		where 
-			email = $1`
+			lower(email) = lower($1)`
 
 	var user models.User
-	err := m.DB.QueryRowContext(ctx, query, email).Scan(
+	err := m.conn().QueryRowContext(ctx, query, email).Scan(
 		&user.ID,
 		&user.Email,
 		&user.FirstName,
 		&user.LastName,
 		&user.Password,
+		&user.Role,
 		&user.CreatedAt,
 		&user.UpdatedAt,
+		&user.TOTPSecret,
+		&user.TOTPEnabled,
+		&user.TOTPLastStep,
 	)
 	if err != nil {
 		return nil, err
@@ -215,27 +591,32 @@ func (m *PostgresDBRepo) UserByEmail(email string) (*models.User, error) {
 	return &user, nil
 }
 
-func (m *PostgresDBRepo) UserByID(id int) (*models.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (m *PostgresDBRepo) UserByID(ctx context.Context, id int) (*models.User, error) {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
 	query := `
 		select
-			id, email, first_name, last_name, password, created_at, updated_at 
+			id, email, first_name, last_name, password, role, created_at, updated_at,
+			totp_secret, totp_enabled, totp_last_step
 		from 
 			users 
 		where 
 			id = $1`
 
 	var user models.User
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+	err := m.conn().QueryRowContext(ctx, query, id).Scan(
 		&user.ID,
 		&user.Email,
 		&user.FirstName,
 		&user.LastName,
 		&user.Password,
+		&user.Role,
 		&user.CreatedAt,
 		&user.UpdatedAt,
+		&user.TOTPSecret,
+		&user.TOTPEnabled,
+		&user.TOTPLastStep,
 	)
 	if err != nil {
 		return nil, err
@@ -244,103 +625,1207 @@ func (m *PostgresDBRepo) UserByID(id int) (*models.User, error) {
 	return &user, nil
 }
 
-func (m *PostgresDBRepo) AllGenres() ([]*models.Genre, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (m *PostgresDBRepo) InsertUser(ctx context.Context, user models.User) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
-	query := `select id, genre, created_at, updated_at from genres order by genre`
+	if user.Role == "" {
+		user.Role = models.RoleViewer
+	}
+
+	stmt := `insert into users (first_name, last_name, email, password, role, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7)
+		returning id`
 
-	rows, err := m.DB.QueryContext(ctx, query)
+	var newID int
+	err := m.conn().QueryRowContext(ctx, stmt,
+		user.FirstName, user.LastName, models.NormalizeEmail(user.Email),
+		user.Password, user.Role, user.CreatedAt, user.UpdatedAt,
+	).Scan(&newID)
 	if err != nil {
-		return nil, err
+		if isUniqueViolation(err) {
+			return 0, repository.ErrDuplicate
+		}
+		return 0, err
 	}
-	defer rows.Close()
 
-	var genres []*models.Genre
-	for rows.Next() {
-		var g models.Genre
-		err := rows.Scan(&g.ID, &g.Genre, &g.CreatedAt, &g.UpdateAt)
-		if err != nil {
-			return nil, err
+	return newID, nil
+}
+
+func (m *PostgresDBRepo) UpdateUser(ctx context.Context, user models.User) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update users set first_name = $1, last_name = $2, email = $3, updated_at = $4
+		where id = $5`
+
+	res, err := m.conn().ExecContext(ctx, stmt,
+		user.FirstName, user.LastName, models.NormalizeEmail(user.Email),
+		user.UpdatedAt, user.ID,
+	)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return repository.ErrDuplicate
 		}
-		genres = append(genres, &g)
+		return err
 	}
 
-	return genres, nil
+	return expectRows(res)
 }
 
-func (m *PostgresDBRepo) InsertMovie(movie models.Movie) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (m *PostgresDBRepo) UpdateUserPassword(ctx context.Context, id int, hash string) error {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
-	stmt := `insert into movies (title, description, release_date, runtime,
-		mpaa_rating, created_at, updated_at, image)
-		values ($1, $2, $3, $4, $5, $6, $7, $8)
-		returning id`
+	stmt := `update users set password = $1, updated_at = $2 where id = $3`
 
-	var newID int
-	err := m.DB.QueryRowContext(ctx, stmt,
-		movie.Title, movie.Description, movie.ReleaseDate,
-		movie.Runtime, movie.MPAARating, movie.CreatedAt, movie.UpdateAt,
-		movie.Image,
-	).Scan(&newID)
+	res, err := m.conn().ExecContext(ctx, stmt, hash, time.Now(), id)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	return newID, nil
+	return expectRows(res)
 }
 
-func (m *PostgresDBRepo) UpdateMovie(movie models.Movie) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (m *PostgresDBRepo) UpdateUserRole(ctx context.Context, id int, role string) error {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
-	stmt := `update movies set title=$1, description=$2, release_date=$3,
-		runtime=$4, mpaa_rating=$5, updated_at=$6, image=$7 where id = $8`
+	stmt := `update users set role = $1, updated_at = $2 where id = $3`
 
-	_, err := m.DB.ExecContext(ctx, stmt,
-		movie.Title, movie.Description, movie.ReleaseDate,
-		movie.Runtime, movie.MPAARating, movie.UpdateAt,
-		movie.Image, movie.ID,
-	)
+	res, err := m.conn().ExecContext(ctx, stmt, role, time.Now(), id)
 	if err != nil {
 		return err
 	}
-	return nil
+
+	return expectRows(res)
 }
 
-func (m *PostgresDBRepo) UpdateMovieGenres(id int, genresIDs []int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// UpdateUserTOTP sets the TOTP secret of a user and whether it is required
+// to log in. An empty secret disables two-factor authentication.
+func (m *PostgresDBRepo) UpdateUserTOTP(ctx context.Context, id int, secret string, enabled bool) error {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
-	stmt := `delete from movies_genres where movie_id = $1`
+	stmt := `update users set totp_secret = $1, totp_enabled = $2, updated_at = $3 where id = $4`
 
-	_, err := m.DB.ExecContext(ctx, stmt, id)
+	res, err := m.conn().ExecContext(ctx, stmt, secret, enabled, time.Now(), id)
 	if err != nil {
 		return err
 	}
 
-	for _, n := range genresIDs {
-		stmt := `insert into movies_genres (movie_id, genre_id) values ($1, $2)`
-		_, err := m.DB.ExecContext(ctx, stmt, id, n)
-		if err != nil {
-			return err
+	return expectRows(res)
+}
+
+// UseTOTPStep records that the code of a time step was used. It fails with
+// ErrCodeReused if a code of that step, or of a later one, was already
+// accepted.
+func (m *PostgresDBRepo) UseTOTPStep(ctx context.Context, id int, step int64) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update users set totp_last_step = $1 where id = $2 and totp_last_step < $1`
+
+	res, err := m.conn().ExecContext(ctx, stmt, step, id)
+	if err != nil {
+		return err
+	}
+	if err := expectRows(res); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return repository.ErrCodeReused
 		}
+		return err
 	}
 
 	return nil
 }
 
-func (m *PostgresDBRepo) DeleteMovie(id int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// ReplaceRecoveryCodes replaces the recovery codes of a user.
+func (m *PostgresDBRepo) ReplaceRecoveryCodes(ctx context.Context, userID int, hashes []string) error {
+	return m.inTx(ctx, func(tx *PostgresDBRepo) error {
+		ctx, cancel := tx.withTimeout(ctx)
+		defer cancel()
+
+		_, err := tx.conn().ExecContext(ctx, `delete from recovery_codes where user_id = $1`, userID)
+		if err != nil {
+			return err
+		}
+
+		for _, hash := range hashes {
+			_, err := tx.conn().ExecContext(ctx,
+				`insert into recovery_codes (user_id, code_hash) values ($1, $2)`, userID, hash)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// UseRecoveryCode marks a recovery code as used. It returns sql.ErrNoRows if
+// the code doesn't exist or was already used.
+func (m *PostgresDBRepo) UseRecoveryCode(ctx context.Context, userID int, hash string) error {
+	ctx, cancel := m.withTimeout(ctx)
 	defer cancel()
 
-	stmt := `delete from movies where id = $1`
+	stmt := `update recovery_codes set used_at = $1
+		where user_id = $2 and code_hash = $3 and used_at is null`
 
-	_, err := m.DB.ExecContext(ctx, stmt, id)
+	res, err := m.conn().ExecContext(ctx, stmt, time.Now(), userID, hash)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return expectRows(res)
+}
+
+func (m *PostgresDBRepo) DeleteUser(ctx context.Context, id int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	res, err := m.conn().ExecContext(ctx, `delete from users where id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	return expectRows(res)
+}
+
+// UserByIdentity returns the user linked to the subject of an OpenID Connect
+// issuer, or sql.ErrNoRows.
+func (m *PostgresDBRepo) UserByIdentity(ctx context.Context, issuer, subject string) (*models.User, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		select
+			u.id, u.email, u.first_name, u.last_name, u.password, u.role, u.created_at, u.updated_at,
+			u.totp_secret, u.totp_enabled, u.totp_last_step
+		from
+			users u
+			join user_identities i on i.user_id = u.id
+		where
+			i.issuer = $1 and i.subject = $2`
+
+	var user models.User
+	err := m.conn().QueryRowContext(ctx, query, issuer, subject).Scan(
+		&user.ID,
+		&user.Email,
+		&user.FirstName,
+		&user.LastName,
+		&user.Password,
+		&user.Role,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+		&user.TOTPSecret,
+		&user.TOTPEnabled,
+		&user.TOTPLastStep,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func (m *PostgresDBRepo) InsertUserIdentity(ctx context.Context, identity models.UserIdentity) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `insert into user_identities (issuer, subject, user_id, email, created_at)
+		values ($1, $2, $3, $4, $5)`
+
+	_, err := m.conn().ExecContext(ctx, stmt,
+		identity.Issuer, identity.Subject, identity.UserID, identity.Email, identity.CreatedAt,
+	)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return repository.ErrDuplicate
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (m *PostgresDBRepo) AllGenres(ctx context.Context) ([]*models.Genre, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `select id, genre, created_at, updated_at from genres order by genre`
+
+	rows, err := m.conn().QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var genres []*models.Genre
+	for rows.Next() {
+		var g models.Genre
+		err := rows.Scan(&g.ID, &g.Genre, &g.CreatedAt, &g.UpdateAt)
+		if err != nil {
+			return nil, err
+		}
+		genres = append(genres, &g)
+	}
+
+	return genres, nil
+}
+
+func (m *PostgresDBRepo) InsertMovie(ctx context.Context, movie models.Movie) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `insert into movies (title, description, release_date, runtime,
+		mpaa_rating, created_at, updated_at, image)
+		values ($1, $2, $3, $4, $5, $6, $7, $8)
+		returning id`
+
+	var newID int
+	err := m.conn().QueryRowContext(ctx, stmt,
+		movie.Title, movie.Description, movie.ReleaseDate,
+		movie.Runtime, movie.MPAARating, movie.CreatedAt, movie.UpdateAt,
+		movie.Image,
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+func (m *PostgresDBRepo) UpdateMovie(ctx context.Context, movie models.Movie) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update movies set title=$1, description=$2, release_date=$3,
+		runtime=$4, mpaa_rating=$5, updated_at=$6, image=$7, version = version + 1
+		where id = $8 and version = $9 and deleted_at is null`
+
+	res, err := m.conn().ExecContext(ctx, stmt,
+		movie.Title, movie.Description, movie.ReleaseDate,
+		movie.Runtime, movie.MPAARating, movie.UpdateAt,
+		movie.Image, movie.ID, movie.Version,
+	)
+	if err != nil {
+		return err
+	}
+
+	err = expectRows(res)
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	// Tell a stale version from a deleted movie
+	var exists bool
+	err = m.conn().QueryRowContext(ctx, `select exists(select 1 from movies where id = $1 and deleted_at is null)`, movie.ID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return repository.ErrEditConflict
+	}
+	return sql.ErrNoRows
+}
+
+// UpdateMovieGenres replaces the genres of a movie. The old rows are removed
+// and the new ones inserted in a single batch, within a transaction.
+func (m *PostgresDBRepo) UpdateMovieGenres(ctx context.Context, id int, genresIDs []int) error {
+	return m.inTx(ctx, func(tx *PostgresDBRepo) error {
+		ctx, cancel := tx.withTimeout(ctx)
+		defer cancel()
+
+		stmt := `delete from movies_genres where movie_id = $1`
+
+		_, err := tx.conn().ExecContext(ctx, stmt, id)
+		if err != nil {
+			return err
+		}
+
+		if len(genresIDs) == 0 {
+			return nil
+		}
+
+		values := make([]string, 0, len(genresIDs))
+		args := []any{id}
+		for i, n := range genresIDs {
+			values = append(values, fmt.Sprintf("($1, $%d)", i+2))
+			args = append(args, n)
+		}
+
+		stmt = `insert into movies_genres (movie_id, genre_id) values ` + strings.Join(values, ", ")
+		_, err = tx.conn().ExecContext(ctx, stmt, args...)
+		return err
+	})
+}
+
+// MovieGenres returns the genres of the given movies, ordered by name, in a
+// single query.
+func (m *PostgresDBRepo) MovieGenres(ctx context.Context, movieIDs []int) (map[int][]*models.Genre, error) {
+	genres := make(map[int][]*models.Genre, len(movieIDs))
+	if len(movieIDs) == 0 {
+		return genres, nil
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	ph := make([]string, len(movieIDs))
+	args := make([]any, len(movieIDs))
+	for i, id := range movieIDs {
+		ph[i] = fmt.Sprintf("$%d", i+1)
+		args[i] = id
+	}
+
+	query := `select mg.movie_id, g.id, g.genre from movies_genres mg
+		join genres g on (mg.genre_id = g.id)
+		where mg.movie_id in (` + strings.Join(ph, ", ") + `)
+		order by g.genre`
+
+	rows, err := m.conn().QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var movieID int
+		var g models.Genre
+		if err := rows.Scan(&movieID, &g.ID, &g.Genre); err != nil {
+			return nil, err
+		}
+		genres[movieID] = append(genres[movieID], &g)
+	}
+
+	return genres, rows.Err()
+}
+
+// TrashMovie moves a movie to the trash.
+func (m *PostgresDBRepo) TrashMovie(ctx context.Context, id int, at time.Time) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update movies set deleted_at = $2 where id = $1 and deleted_at is null`
+
+	res, err := m.conn().ExecContext(ctx, stmt, id, at)
+	if err != nil {
+		return err
+	}
+
+	return expectRows(res)
+}
+
+// TrashedMovies lists the movies in the trash, most recently deleted first.
+func (m *PostgresDBRepo) TrashedMovies(ctx context.Context) ([]*models.Movie, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `
+		select
+			id, title, release_date, runtime,
+			mpaa_rating, description, coalesce(image, ''), version,
+			deleted_at, created_at, updated_at
+		from
+			movies
+		where
+			deleted_at is not null
+		order by
+			deleted_at desc, id`
+
+	rows, err := m.conn().QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var movies []*models.Movie
+	for rows.Next() {
+		var movie models.Movie
+		err := rows.Scan(
+			&movie.ID,
+			&movie.Title,
+			&movie.ReleaseDate,
+			&movie.Runtime,
+			&movie.MPAARating,
+			&movie.Description,
+			&movie.Image,
+			&movie.Version,
+			&movie.DeletedAt,
+			&movie.CreatedAt,
+			&movie.UpdateAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		movies = append(movies, &movie)
+	}
+
+	return movies, rows.Err()
+}
+
+// RestoreMovie takes a movie out of the trash.
+func (m *PostgresDBRepo) RestoreMovie(ctx context.Context, id int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update movies set deleted_at = null where id = $1 and deleted_at is not null`
+
+	res, err := m.conn().ExecContext(ctx, stmt, id)
+	if err != nil {
+		return err
+	}
+
+	return expectRows(res)
+}
+
+// PurgeMovie deletes a trashed movie for good, with its genres and revisions.
+func (m *PostgresDBRepo) PurgeMovie(ctx context.Context, id int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `delete from movies where id = $1 and deleted_at is not null`
+
+	res, err := m.conn().ExecContext(ctx, stmt, id)
+	if err != nil {
+		return err
+	}
+
+	return expectRows(res)
+}
+
+// PurgeTrash deletes for good the movies trashed before a time and returns
+// their ids.
+func (m *PostgresDBRepo) PurgeTrash(ctx context.Context, before time.Time) ([]int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `delete from movies where deleted_at < $1 returning id`
+
+	rows, err := m.conn().QueryContext(ctx, stmt, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+func (m *PostgresDBRepo) OneGenre(ctx context.Context, id int) (*models.Genre, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `select id, genre, created_at, updated_at from genres where id = $1`
+
+	var g models.Genre
+	err := m.conn().QueryRowContext(ctx, query, id).Scan(&g.ID, &g.Genre, &g.CreatedAt, &g.UpdateAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &g, nil
+}
+
+func (m *PostgresDBRepo) InsertGenre(ctx context.Context, genre models.Genre) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `insert into genres (genre, created_at, updated_at)
+		values ($1, $2, $3)
+		returning id`
+
+	var newID int
+	err := m.conn().QueryRowContext(ctx, stmt, genre.Genre, genre.CreatedAt, genre.UpdateAt).Scan(&newID)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return 0, repository.ErrDuplicate
+		}
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+func (m *PostgresDBRepo) UpdateGenre(ctx context.Context, genre models.Genre) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update genres set genre = $1, updated_at = $2 where id = $3`
+
+	res, err := m.conn().ExecContext(ctx, stmt, genre.Genre, genre.UpdateAt, genre.ID)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return repository.ErrDuplicate
+		}
+		return err
+	}
+
+	return expectRows(res)
+}
+
+// MergeGenres moves every movie of the fromID genre to the intoID one, then
+// deletes fromID.
+func (m *PostgresDBRepo) MergeGenres(ctx context.Context, fromID, intoID int) error {
+	if fromID == intoID {
+		return errors.New("cannot merge a genre into itself")
+	}
+
+	return m.inTx(ctx, func(tx *PostgresDBRepo) error {
+		ctx, cancel := tx.withTimeout(ctx)
+		defer cancel()
+
+		// Both genres must exist, lock them for the rest of the transaction
+		var n int
+		err := tx.conn().QueryRowContext(ctx,
+			`select count(*) from (select id from genres where id in ($1, $2) for update) g`,
+			fromID, intoID,
+		).Scan(&n)
+		if err != nil {
+			return err
+		}
+		if n != 2 {
+			return sql.ErrNoRows
+		}
+
+		stmt := `insert into movies_genres (movie_id, genre_id)
+			select movie_id, $2 from movies_genres
+			where genre_id = $1
+			and movie_id not in (select movie_id from movies_genres where genre_id = $2)`
+
+		_, err = tx.conn().ExecContext(ctx, stmt, fromID, intoID)
+		if err != nil {
+			return err
+		}
+
+		// The remaining links are removed by the foreign key cascade
+		_, err = tx.conn().ExecContext(ctx, `delete from genres where id = $1`, fromID)
+		return err
+	})
+}
+
+// DeleteGenre deletes a genre. If movies still use it, their links are moved
+// to reassignTo when set, dropped when force is set, and ErrGenreInUse is
+// returned otherwise.
+func (m *PostgresDBRepo) DeleteGenre(ctx context.Context, id int, reassignTo int, force bool) error {
+	if reassignTo > 0 {
+		return m.MergeGenres(ctx, id, reassignTo)
+	}
+
+	return m.inTx(ctx, func(tx *PostgresDBRepo) error {
+		ctx, cancel := tx.withTimeout(ctx)
+		defer cancel()
+
+		if !force {
+			var used bool
+			err := tx.conn().QueryRowContext(ctx,
+				`select exists (select 1 from movies_genres where genre_id = $1)`, id,
+			).Scan(&used)
+			if err != nil {
+				return err
+			}
+			if used {
+				return repository.ErrGenreInUse
+			}
+		}
+
+		res, err := tx.conn().ExecContext(ctx, `delete from genres where id = $1`, id)
+		if err != nil {
+			return err
+		}
+
+		return expectRows(res)
+	})
+}
+
+// expectRows returns sql.ErrNoRows when a statement didn't touch any row.
+func expectRows(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// isUniqueViolation reports whether err is a Postgres unique constraint error.
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == uniqueViolation
+}
+
+func (m *PostgresDBRepo) InsertRefreshToken(ctx context.Context, token models.RefreshToken) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `insert into refresh_tokens (id, family_id, user_id, expires_at, created_at)
+		values ($1, $2, $3, $4, $5)`
+
+	_, err := m.conn().ExecContext(ctx, stmt,
+		token.ID, token.FamilyID, token.UserID, token.ExpiresAt, token.CreatedAt,
+	)
+	return err
+}
+
+func (m *PostgresDBRepo) RefreshTokenByID(ctx context.Context, id string) (*models.RefreshToken, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `select id, family_id, user_id, expires_at, created_at, revoked_at,
+		coalesce(replaced_by, '')
+		from refresh_tokens where id = $1`
+
+	var t models.RefreshToken
+	var revokedAt sql.NullTime
+	err := m.conn().QueryRowContext(ctx, query, id).Scan(
+		&t.ID,
+		&t.FamilyID,
+		&t.UserID,
+		&t.ExpiresAt,
+		&t.CreatedAt,
+		&revokedAt,
+		&t.ReplacedBy,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if revokedAt.Valid {
+		t.RevokedAt = &revokedAt.Time
+	}
+
+	return &t, nil
+}
+
+// RotateRefreshToken revokes oldID in favour of next. It fails with
+// ErrTokenReused if oldID was already revoked, so that concurrent uses of the
+// same token can't both succeed.
+func (m *PostgresDBRepo) RotateRefreshToken(ctx context.Context, oldID string, next models.RefreshToken) error {
+	return m.inTx(ctx, func(tx *PostgresDBRepo) error {
+		ctx, cancel := tx.withTimeout(ctx)
+		defer cancel()
+
+		stmt := `update refresh_tokens set revoked_at = $1, replaced_by = $2
+			where id = $3 and revoked_at is null`
+
+		res, err := tx.conn().ExecContext(ctx, stmt, time.Now(), next.ID, oldID)
+		if err != nil {
+			return err
+		}
+		if err := expectRows(res); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return repository.ErrTokenReused
+			}
+			return err
+		}
+
+		return tx.InsertRefreshToken(ctx, next)
+	})
+}
+
+func (m *PostgresDBRepo) RevokeRefreshTokenFamily(ctx context.Context, familyID string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update refresh_tokens set revoked_at = $1
+		where family_id = $2 and revoked_at is null`
+
+	_, err := m.conn().ExecContext(ctx, stmt, time.Now(), familyID)
+	return err
+}
+
+func (m *PostgresDBRepo) RevokeUserRefreshTokens(ctx context.Context, userID int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update refresh_tokens set revoked_at = $1
+		where user_id = $2 and revoked_at is null`
+
+	_, err := m.conn().ExecContext(ctx, stmt, time.Now(), userID)
+	return err
+}
+
+// RevokeOtherRefreshTokens revokes the sessions of a user, except the one of
+// the keepFamilyID refresh token family.
+func (m *PostgresDBRepo) RevokeOtherRefreshTokens(ctx context.Context, userID int, keepFamilyID string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update refresh_tokens set revoked_at = $1
+		where user_id = $2 and family_id <> $3 and revoked_at is null`
+
+	_, err := m.conn().ExecContext(ctx, stmt, time.Now(), userID, keepFamilyID)
+	return err
+}
+
+func (m *PostgresDBRepo) InsertAPIKey(ctx context.Context, key models.APIKey) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `insert into api_keys (user_id, name, prefix, key_hash, scopes, created_at)
+		values ($1, $2, $3, $4, $5, $6)
+		returning id`
+
+	var newID int
+	err := m.conn().QueryRowContext(ctx, stmt,
+		key.UserID, key.Name, key.Prefix, key.Hash, strings.Join(key.Scopes, ","), key.CreatedAt,
+	).Scan(&newID)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return 0, repository.ErrDuplicate
+		}
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+const apiKeyColumns = `id, user_id, name, prefix, key_hash, scopes, created_at, last_used_at, revoked_at`
+
+// scanAPIKey scans a row of apiKeyColumns.
+func scanAPIKey(row interface{ Scan(...any) error }) (*models.APIKey, error) {
+	var k models.APIKey
+	var scopes string
+	var lastUsedAt, revokedAt sql.NullTime
+	err := row.Scan(
+		&k.ID,
+		&k.UserID,
+		&k.Name,
+		&k.Prefix,
+		&k.Hash,
+		&scopes,
+		&k.CreatedAt,
+		&lastUsedAt,
+		&revokedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if scopes != "" {
+		k.Scopes = strings.Split(scopes, ",")
+	}
+	if lastUsedAt.Valid {
+		k.LastUsedAt = &lastUsedAt.Time
+	}
+	if revokedAt.Valid {
+		k.RevokedAt = &revokedAt.Time
+	}
+
+	return &k, nil
+}
+
+func (m *PostgresDBRepo) APIKeyByHash(ctx context.Context, hash string) (*models.APIKey, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `select ` + apiKeyColumns + ` from api_keys where key_hash = $1`
+
+	return scanAPIKey(m.conn().QueryRowContext(ctx, query, hash))
+}
+
+// UserAPIKeys returns the keys of a user, revoked ones included, newest
+// first.
+func (m *PostgresDBRepo) UserAPIKeys(ctx context.Context, userID int) ([]*models.APIKey, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `select ` + apiKeyColumns + ` from api_keys where user_id = $1 order by created_at desc, id desc`
+
+	rows, err := m.conn().QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*models.APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey revokes a key of a user. It returns sql.ErrNoRows if the user
+// has no such active key.
+func (m *PostgresDBRepo) RevokeAPIKey(ctx context.Context, userID, id int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update api_keys set revoked_at = $1
+		where id = $2 and user_id = $3 and revoked_at is null`
+
+	res, err := m.conn().ExecContext(ctx, stmt, time.Now(), id, userID)
+	if err != nil {
+		return err
+	}
+
+	return expectRows(res)
+}
+
+// TouchAPIKey records when a key was last used.
+func (m *PostgresDBRepo) TouchAPIKey(ctx context.Context, id int, at time.Time) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	_, err := m.conn().ExecContext(ctx, `update api_keys set last_used_at = $1 where id = $2`, at, id)
+	return err
+}
+
+func (m *PostgresDBRepo) InsertPasswordReset(ctx context.Context, reset models.PasswordReset) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `insert into password_resets (token_hash, user_id, expires_at, created_at)
+		values ($1, $2, $3, $4)`
+
+	_, err := m.conn().ExecContext(ctx, stmt,
+		reset.TokenHash, reset.UserID, reset.ExpiresAt, reset.CreatedAt,
+	)
+	return err
+}
+
+// ConsumePasswordReset marks a reset token as used and returns the id of its
+// user. It returns sql.ErrNoRows if the token is unknown, expired at the given
+// time or already used.
+func (m *PostgresDBRepo) ConsumePasswordReset(ctx context.Context, tokenHash string, at time.Time) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update password_resets set used_at = $1
+		where token_hash = $2 and used_at is null and expires_at > $1
+		returning user_id`
+
+	var userID int
+	err := m.conn().QueryRowContext(ctx, stmt, at, tokenHash).Scan(&userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return userID, nil
+}
+
+// DeleteUserPasswordResets invalidates every reset token of a user.
+func (m *PostgresDBRepo) DeleteUserPasswordResets(ctx context.Context, userID int) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	_, err := m.conn().ExecContext(ctx, `delete from password_resets where user_id = $1`, userID)
+	return err
+}
+
+func (m *PostgresDBRepo) LoginAttempts(ctx context.Context, key string) (*models.LoginAttempts, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `select key, failures, last_failure_at, locked_until
+		from login_attempts where key = $1`
+
+	return scanLoginAttempts(m.conn().QueryRowContext(ctx, query, key))
+}
+
+// RecordLoginFailure counts a failed login for key at the given time. The
+// count starts over when the previous failure is older than window.
+func (m *PostgresDBRepo) RecordLoginFailure(ctx context.Context, key string, at time.Time, window time.Duration) (*models.LoginAttempts, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `insert into login_attempts (key, failures, last_failure_at)
+		values ($1, 1, $2)
+		on conflict (key) do update set
+			failures = case
+				when login_attempts.last_failure_at < $3 then 1
+				else login_attempts.failures + 1
+			end,
+			last_failure_at = excluded.last_failure_at
+		returning key, failures, last_failure_at, locked_until`
+
+	return scanLoginAttempts(m.conn().QueryRowContext(ctx, stmt, key, at, at.Add(-window)))
+}
+
+func (m *PostgresDBRepo) LockLogin(ctx context.Context, key string, until time.Time) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `update login_attempts set locked_until = $1 where key = $2`
+
+	res, err := m.conn().ExecContext(ctx, stmt, until, key)
+	if err != nil {
+		return err
+	}
+	return expectRows(res)
+}
+
+func (m *PostgresDBRepo) ClearLoginAttempts(ctx context.Context, keys ...string) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	ph := make([]string, len(keys))
+	args := make([]any, len(keys))
+	for i, key := range keys {
+		ph[i] = fmt.Sprintf("$%d", i+1)
+		args[i] = key
+	}
+
+	stmt := fmt.Sprintf(`delete from login_attempts where key in (%s)`, strings.Join(ph, ", "))
+
+	_, err := m.conn().ExecContext(ctx, stmt, args...)
+	return err
+}
+
+// scanLoginAttempts scans a login_attempts row.
+func scanLoginAttempts(row *sql.Row) (*models.LoginAttempts, error) {
+	var a models.LoginAttempts
+	var lockedUntil sql.NullTime
+	err := row.Scan(&a.Key, &a.Failures, &a.LastFailureAt, &lockedUntil)
+	if err != nil {
+		return nil, err
+	}
+	a.LockedUntil = lockedUntil.Time
+
+	return &a, nil
+}
+
+func (m *PostgresDBRepo) InsertAuditEntry(ctx context.Context, entry models.AuditEntry) error {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	stmt := `insert into audit_log (user_id, action, entity, entity_id, changes, ip, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7)`
+
+	var changes any
+	if len(entry.Changes) > 0 {
+		changes = string(entry.Changes)
+	}
+
+	_, err := m.conn().ExecContext(ctx, stmt,
+		entry.UserID, entry.Action, entry.Entity, entry.EntityID, changes, entry.IP, entry.CreatedAt,
+	)
+	return err
+}
+
+// AuditEntries returns the entries matching filter, newest first.
+func (m *PostgresDBRepo) AuditEntries(ctx context.Context, filter repository.AuditFilter) ([]*models.AuditEntry, repository.Metadata, error) {
+	var meta repository.Metadata
+
+	if err := filter.Validate(); err != nil {
+		return nil, meta, err
+	}
+
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	var (
+		conds []string
+		args  []any
+	)
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if filter.UserID > 0 {
+		conds = append(conds, "user_id = "+arg(filter.UserID))
+	}
+	if filter.Entity != "" {
+		conds = append(conds, "entity = "+arg(filter.Entity))
+	}
+	if filter.EntityID != "" {
+		conds = append(conds, "entity_id = "+arg(filter.EntityID))
+	}
+	if filter.Action != "" {
+		conds = append(conds, "action = "+arg(filter.Action))
+	}
+	if !filter.From.IsZero() {
+		conds = append(conds, "created_at >= "+arg(filter.From))
+	}
+	if !filter.To.IsZero() {
+		conds = append(conds, "created_at < "+arg(filter.To))
+	}
+
+	where := ""
+	if len(conds) > 0 {
+		where = "where " + strings.Join(conds, " and ")
+	}
+
+	err := m.conn().QueryRowContext(ctx, "select count(*) from audit_log "+where, args...).Scan(&meta.TotalRecords)
+	if err != nil {
+		return nil, meta, err
+	}
+
+	limit := ""
+	if filter.PerPage > 0 {
+		meta.PerPage = filter.PerPage
+		meta.CurrentPage = 1
+		if filter.Page > 1 {
+			meta.CurrentPage = filter.Page
+		}
+		limit = fmt.Sprintf("limit %s offset %s", arg(filter.PerPage), arg(filter.Offset()))
+	}
+
+	query := fmt.Sprintf(`
+		select
+			id, user_id, action, entity, entity_id, changes, ip, created_at
+		from
+			audit_log %s
+		order by
+			created_at desc, id desc
+		%s`, where, limit)
+
+	rows, err := m.conn().QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, meta, err
+	}
+	defer rows.Close()
+
+	entries := []*models.AuditEntry{}
+	for rows.Next() {
+		var e models.AuditEntry
+		var userID sql.NullInt64
+		var changes []byte
+		err := rows.Scan(
+			&e.ID,
+			&userID,
+			&e.Action,
+			&e.Entity,
+			&e.EntityID,
+			&changes,
+			&e.IP,
+			&e.CreatedAt,
+		)
+		if err != nil {
+			return nil, meta, err
+		}
+
+		if userID.Valid {
+			id := int(userID.Int64)
+			e.UserID = &id
+		}
+		if len(changes) > 0 {
+			e.Changes = changes
+		}
+		entries = append(entries, &e)
+	}
+
+	return entries, meta, rows.Err()
+}
+
+// InsertMovieRevision saves rev as the next revision of its movie and
+// returns its number. Callers update the movie first in the same
+// transaction, which locks its row and keeps the numbering free of gaps and
+// duplicates.
+func (m *PostgresDBRepo) InsertMovieRevision(ctx context.Context, rev models.MovieRevision) (int, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	snapshot, err := json.Marshal(rev.Movie)
+	if err != nil {
+		return 0, err
+	}
+
+	var restoredFrom any
+	if rev.RestoredFrom > 0 {
+		restoredFrom = rev.RestoredFrom
+	}
+
+	stmt := `insert into movie_revisions (movie_id, revision, snapshot, user_id, restored_from, created_at)
+		select $1, coalesce(max(revision), 0) + 1, $2, $3, $4, $5
+		from movie_revisions where movie_id = $1
+		returning revision`
+
+	var revision int
+	err = m.conn().QueryRowContext(ctx, stmt,
+		rev.MovieID, string(snapshot), rev.UserID, restoredFrom, rev.CreatedAt,
+	).Scan(&revision)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return 0, repository.ErrDuplicate
+		}
+		return 0, err
+	}
+
+	return revision, nil
+}
+
+const movieRevisionColumns = `movie_id, revision, snapshot, user_id, restored_from, created_at`
+
+// scanMovieRevision scans a row of movieRevisionColumns.
+func scanMovieRevision(row interface{ Scan(...any) error }) (*models.MovieRevision, error) {
+	var rev models.MovieRevision
+	var snapshot []byte
+	var userID, restoredFrom sql.NullInt64
+	err := row.Scan(
+		&rev.MovieID,
+		&rev.Revision,
+		&snapshot,
+		&userID,
+		&restoredFrom,
+		&rev.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(snapshot, &rev.Movie); err != nil {
+		return nil, err
+	}
+	if userID.Valid {
+		id := int(userID.Int64)
+		rev.UserID = &id
+	}
+	rev.RestoredFrom = int(restoredFrom.Int64)
+
+	return &rev, nil
+}
+
+// MovieRevisions returns the revisions of a movie, newest first.
+func (m *PostgresDBRepo) MovieRevisions(ctx context.Context, movieID int) ([]*models.MovieRevision, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `select ` + movieRevisionColumns + ` from movie_revisions where movie_id = $1 order by revision desc`
+
+	rows, err := m.conn().QueryContext(ctx, query, movieID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revs := []*models.MovieRevision{}
+	for rows.Next() {
+		rev, err := scanMovieRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+		revs = append(revs, rev)
+	}
+
+	return revs, rows.Err()
+}
+
+func (m *PostgresDBRepo) MovieRevision(ctx context.Context, movieID, revision int) (*models.MovieRevision, error) {
+	ctx, cancel := m.withTimeout(ctx)
+	defer cancel()
+
+	query := `select ` + movieRevisionColumns + ` from movie_revisions where movie_id = $1 and revision = $2`
+
+	return scanMovieRevision(m.conn().QueryRowContext(ctx, query, movieID, revision))
 }
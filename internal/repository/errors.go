@@ -0,0 +1,23 @@
+package repository
+
+import "errors"
+
+var (
+	// ErrDuplicate is returned when a write would break a uniqueness rule.
+	ErrDuplicate = errors.New("duplicate record")
+
+	// ErrGenreInUse is returned when deleting a genre still attached to
+	// movies, without asking to reassign or drop them.
+	ErrGenreInUse = errors.New("genre is used by movies")
+
+	// ErrTokenReused is returned when rotating a refresh token that has
+	// already been revoked or rotated.
+	ErrTokenReused = errors.New("refresh token already used")
+
+	// ErrCodeReused is returned when a one-time password is presented again.
+	ErrCodeReused = errors.New("code already used")
+
+	// ErrEditConflict is returned when updating a record whose version has
+	// changed since it was read.
+	ErrEditConflict = errors.New("edit conflict")
+)
@@ -0,0 +1,198 @@
+package repository
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/snirkop89/go-movies/internal/models"
+)
+
+// ErrInvalidCursor is returned when a pagination cursor can't be decoded or
+// doesn't match the requested sort order.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// MovieSortColumns lists the columns movies can be sorted by.
+var MovieSortColumns = []string{"title", "release_date", "runtime", "created_at"}
+
+// MovieFilter narrows, sorts and paginates a list of movies.
+// The zero value returns every movie ordered by title.
+type MovieFilter struct {
+	Page    int    // 1-based page number, ignored when After is set
+	PerPage int    // 0 means no limit
+	After   string // cursor taken from Metadata.NextCursor
+	Sort    string // one of MovieSortColumns, prefixed with "-" for descending
+
+	MPAARatings []string
+	YearFrom    int
+	YearTo      int
+	RuntimeMin  int
+	RuntimeMax  int
+	Genres      []int // movies in any of these genres
+	Genre       int   // movies in this genre as well, ignored when 0
+}
+
+// Metadata describes the page of results returned for a MovieFilter.
+type Metadata struct {
+	CurrentPage  int    `json:"current_page,omitempty"`
+	PerPage      int    `json:"per_page,omitempty"`
+	TotalRecords int    `json:"total_records"`
+	NextCursor   string `json:"next_cursor,omitempty"`
+}
+
+// MoviePage is a page of movies and its metadata.
+type MoviePage struct {
+	Movies   []*models.Movie
+	Metadata Metadata
+}
+
+// Validate checks that the filter values are usable.
+func (f MovieFilter) Validate() error {
+	if f.Page < 0 {
+		return errors.New("page must be greater than zero")
+	}
+	if f.PerPage < 0 {
+		return errors.New("per_page must be greater than zero")
+	}
+
+	col := f.SortColumn()
+	valid := false
+	for _, c := range MovieSortColumns {
+		if c == col {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return fmt.Errorf("invalid sort value %q", f.Sort)
+	}
+
+	if f.YearFrom > 0 && f.YearTo > 0 && f.YearFrom > f.YearTo {
+		return errors.New("year_from must not be after year_to")
+	}
+	if f.RuntimeMin > 0 && f.RuntimeMax > 0 && f.RuntimeMin > f.RuntimeMax {
+		return errors.New("runtime_min must not be greater than runtime_max")
+	}
+
+	if f.After != "" {
+		if _, err := f.Cursor(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SortColumn returns the column to sort by, title by default.
+func (f MovieFilter) SortColumn() string {
+	col := strings.TrimPrefix(f.Sort, "-")
+	if col == "" {
+		return "title"
+	}
+	return col
+}
+
+// Descending reports whether the sort order is descending.
+func (f MovieFilter) Descending() bool {
+	return strings.HasPrefix(f.Sort, "-")
+}
+
+// Offset returns the number of rows to skip for page based pagination.
+func (f MovieFilter) Offset() int {
+	if f.After != "" || f.Page <= 1 || f.PerPage <= 0 {
+		return 0
+	}
+	return (f.Page - 1) * f.PerPage
+}
+
+// Cursor is the position of the last movie of a page.
+type Cursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    int    `json:"id"`
+}
+
+// Cursor decodes the After cursor and checks it was issued for the same
+// sort order.
+func (f MovieFilter) Cursor() (Cursor, error) {
+	var c Cursor
+
+	b, err := base64.RawURLEncoding.DecodeString(f.After)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, ErrInvalidCursor
+	}
+	if c.Sort != f.Sort {
+		return c, ErrInvalidCursor
+	}
+
+	return c, nil
+}
+
+// NextCursor returns the cursor pointing after movie.
+func (f MovieFilter) NextCursor(movie *models.Movie) string {
+	c := Cursor{
+		Sort:  f.Sort,
+		Value: SortValue(movie, f.SortColumn()),
+		ID:    movie.ID,
+	}
+
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// SortValue returns the value of a sort column of movie, as stored in cursors.
+func SortValue(movie *models.Movie, column string) string {
+	switch column {
+	case "release_date":
+		return movie.ReleaseDate.Format("2006-01-02")
+	case "runtime":
+		return strconv.Itoa(movie.Runtime)
+	case "created_at":
+		return movie.CreatedAt.UTC().Format(time.RFC3339Nano)
+	default:
+		return movie.Title
+	}
+}
+
+// AuditFilter narrows and paginates the audit log, newest entries first.
+// Zero fields don't filter.
+type AuditFilter struct {
+	Page    int // 1-based page number
+	PerPage int // 0 means no limit
+
+	UserID   int
+	Entity   string
+	EntityID string
+	Action   string
+	From     time.Time // inclusive
+	To       time.Time // exclusive
+}
+
+// Validate checks that the filter values are usable.
+func (f AuditFilter) Validate() error {
+	if f.Page < 0 {
+		return errors.New("page must be greater than zero")
+	}
+	if f.PerPage < 0 {
+		return errors.New("per_page must be greater than zero")
+	}
+	if !f.From.IsZero() && !f.To.IsZero() && !f.From.Before(f.To) {
+		return errors.New("from must be before to")
+	}
+	return nil
+}
+
+// Offset returns the number of entries to skip.
+func (f AuditFilter) Offset() int {
+	if f.Page <= 1 || f.PerPage <= 0 {
+		return 0
+	}
+	return (f.Page - 1) * f.PerPage
+}
@@ -1,7 +1,9 @@
 package repository
 
 import (
+	"context"
 	"database/sql"
+	"time"
 
 	"github.com/snirkop89/go-movies/internal/models"
 )
@@ -9,18 +11,94 @@ import (
 type DatabaseRepo interface {
 	Connection() *sql.DB
 
+	// WithTx runs fn with a repository bound to a single transaction.
+	// All writes made through repo are committed if fn returns nil and
+	// discarded otherwise.
+	WithTx(ctx context.Context, fn func(repo DatabaseRepo) error) error
+
 	// Movies models
-	AllMovies(genre ...int) ([]*models.Movie, error)
-	OneMovie(id int) (*models.Movie, error)
-	EditMovie(id int) (*models.Movie, []*models.Genre, error)
-	InsertMovie(movie models.Movie) (int, error)
-	UpdateMovie(movie models.Movie) error
-	UpdateMovieGenres(id int, genresIDs []int) error
-	DeleteMovie(id int) error
+	AllMovies(ctx context.Context, filter MovieFilter) ([]*models.Movie, Metadata, error)
+	// GenresMovies returns a page of movies of several genres at once, by
+	// genre id.
+	GenresMovies(ctx context.Context, genreIDs []int, filter MovieFilter) (map[int]MoviePage, error)
+	SearchMovies(ctx context.Context, query string, limit int) ([]*models.MovieSearchResult, error)
+	OneMovie(ctx context.Context, id int) (*models.Movie, error)
+	EditMovie(ctx context.Context, id int) (*models.Movie, []*models.Genre, error)
+	InsertMovie(ctx context.Context, movie models.Movie) (int, error)
+	// UpdateMovie saves movie if its stored version is still movie.Version
+	// and bumps the version, or returns ErrEditConflict.
+	UpdateMovie(ctx context.Context, movie models.Movie) error
+	UpdateMovieGenres(ctx context.Context, id int, genresIDs []int) error
+	// MovieGenres returns the genres of several movies at once, by movie id.
+	MovieGenres(ctx context.Context, movieIDs []int) (map[int][]*models.Genre, error)
+
+	// Trash. Trashed movies are left out of every other movie method until
+	// they are restored or purged for good.
+	TrashMovie(ctx context.Context, id int, at time.Time) error
+	TrashedMovies(ctx context.Context) ([]*models.Movie, error)
+	RestoreMovie(ctx context.Context, id int) error
+	PurgeMovie(ctx context.Context, id int) error
+	PurgeTrash(ctx context.Context, before time.Time) ([]int, error)
+
+	// Movie revisions
+	InsertMovieRevision(ctx context.Context, rev models.MovieRevision) (int, error)
+	MovieRevisions(ctx context.Context, movieID int) ([]*models.MovieRevision, error)
+	MovieRevision(ctx context.Context, movieID, revision int) (*models.MovieRevision, error)
 
-	AllGenres() ([]*models.Genre, error)
+	// Genres models
+	AllGenres(ctx context.Context) ([]*models.Genre, error)
+	OneGenre(ctx context.Context, id int) (*models.Genre, error)
+	InsertGenre(ctx context.Context, genre models.Genre) (int, error)
+	UpdateGenre(ctx context.Context, genre models.Genre) error
+	MergeGenres(ctx context.Context, fromID, intoID int) error
+	DeleteGenre(ctx context.Context, id int, reassignTo int, force bool) error
 
 	// User models
-	UserByEmail(email string) (*models.User, error)
-	UserByID(id int) (*models.User, error)
+	UserByEmail(ctx context.Context, email string) (*models.User, error)
+	UserByID(ctx context.Context, id int) (*models.User, error)
+	InsertUser(ctx context.Context, user models.User) (int, error)
+	UpdateUser(ctx context.Context, user models.User) error
+	UpdateUserPassword(ctx context.Context, id int, hash string) error
+	UpdateUserRole(ctx context.Context, id int, role string) error
+	DeleteUser(ctx context.Context, id int) error
+
+	// External identities
+	UserByIdentity(ctx context.Context, issuer, subject string) (*models.User, error)
+	InsertUserIdentity(ctx context.Context, identity models.UserIdentity) error
+
+	// Two-factor authentication
+	UpdateUserTOTP(ctx context.Context, id int, secret string, enabled bool) error
+	UseTOTPStep(ctx context.Context, id int, step int64) error
+	ReplaceRecoveryCodes(ctx context.Context, userID int, hashes []string) error
+	UseRecoveryCode(ctx context.Context, userID int, hash string) error
+
+	// Refresh tokens
+	InsertRefreshToken(ctx context.Context, token models.RefreshToken) error
+	RefreshTokenByID(ctx context.Context, id string) (*models.RefreshToken, error)
+	RotateRefreshToken(ctx context.Context, oldID string, next models.RefreshToken) error
+	RevokeRefreshTokenFamily(ctx context.Context, familyID string) error
+	RevokeUserRefreshTokens(ctx context.Context, userID int) error
+	RevokeOtherRefreshTokens(ctx context.Context, userID int, keepFamilyID string) error
+
+	// API keys
+	InsertAPIKey(ctx context.Context, key models.APIKey) (int, error)
+	APIKeyByHash(ctx context.Context, hash string) (*models.APIKey, error)
+	UserAPIKeys(ctx context.Context, userID int) ([]*models.APIKey, error)
+	RevokeAPIKey(ctx context.Context, userID, id int) error
+	TouchAPIKey(ctx context.Context, id int, at time.Time) error
+
+	// Password resets
+	InsertPasswordReset(ctx context.Context, reset models.PasswordReset) error
+	ConsumePasswordReset(ctx context.Context, tokenHash string, at time.Time) (int, error)
+	DeleteUserPasswordResets(ctx context.Context, userID int) error
+
+	// Login throttling
+	LoginAttempts(ctx context.Context, key string) (*models.LoginAttempts, error)
+	RecordLoginFailure(ctx context.Context, key string, at time.Time, window time.Duration) (*models.LoginAttempts, error)
+	LockLogin(ctx context.Context, key string, until time.Time) error
+	ClearLoginAttempts(ctx context.Context, keys ...string) error
+
+	// Audit log
+	InsertAuditEntry(ctx context.Context, entry models.AuditEntry) error
+	AuditEntries(ctx context.Context, filter AuditFilter) ([]*models.AuditEntry, Metadata, error)
 }
@@ -0,0 +1,164 @@
+package totp
+
+import (
+	"encoding/base32"
+	"errors"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 seed of the RFC 6238 test vectors, base32 encoded.
+var rfcSecret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestCodeRFC6238(t *testing.T) {
+	// RFC 6238 appendix B, SHA1. The RFC codes have 8 digits, ours are their
+	// last 6.
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		got, err := Code(rfcSecret, Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatalf("Code at %d: %v", tt.unix, err)
+		}
+		if got != tt.want {
+			t.Errorf("Code at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestCodeInvalidSecret(t *testing.T) {
+	for _, secret := range []string{"", "not base32!"} {
+		if _, err := Code(secret, 1); err == nil {
+			t.Errorf("Code(%q) succeeded, want an error", secret)
+		}
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step := Step(now)
+
+	tests := []struct {
+		name    string
+		offset  int64 // steps between the code and now
+		skew    int
+		wantErr bool
+	}{
+		{name: "current step", offset: 0, skew: 1},
+		{name: "previous step", offset: -1, skew: 1},
+		{name: "next step", offset: 1, skew: 1},
+		{name: "two steps late", offset: -2, skew: 1, wantErr: true},
+		{name: "two steps early", offset: 2, skew: 1, wantErr: true},
+		{name: "previous step without skew", offset: -1, skew: 0, wantErr: true},
+		{name: "two steps late with a skew of 2", offset: -2, skew: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, err := Code(rfcSecret, step+tt.offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := Validate(rfcSecret, code, now, tt.skew)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidCode) {
+					t.Fatalf("Validate error = %v, want ErrInvalidCode", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Validate: %v", err)
+			}
+			if got != step+tt.offset {
+				t.Errorf("Validate step = %d, want %d", got, step+tt.offset)
+			}
+		})
+	}
+}
+
+func TestValidateCodeFormat(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	code, err := Code(rfcSecret, Step(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		code    string
+		wantErr bool
+	}{
+		{name: "spaces are ignored", code: code[:3] + " " + code[3:]},
+		{name: "too short", code: code[:5], wantErr: true},
+		{name: "too long", code: code + "0", wantErr: true},
+		{name: "wrong code", code: "000000", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Validate(rfcSecret, tt.code, now, 1)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate(%q) error = %v, wantErr %v", tt.code, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestValidateStepReuse checks that Validate reports the step a code belongs
+// to, whichever step of the window it is validated at, so that callers
+// recording the last used step refuse a code twice.
+func TestValidateStepReuse(t *testing.T) {
+	start := time.Unix(1234567890, 0)
+	code, err := Code(rfcSecret, Step(start))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lastStep int64
+	use := func(at time.Time, code string) bool {
+		step, err := Validate(rfcSecret, code, at, 1)
+		if err != nil || step <= lastStep {
+			return false
+		}
+		lastStep = step
+		return true
+	}
+
+	if !use(start, code) {
+		t.Fatal("first use of the code refused")
+	}
+	if use(start, code) {
+		t.Error("code accepted twice in the same step")
+	}
+	if use(start.Add(Period), code) {
+		t.Error("code accepted again in the next step")
+	}
+
+	// A code of an earlier step, still in the window, comes too late
+	earlier, err := Code(rfcSecret, Step(start)-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if use(start, earlier) {
+		t.Error("code of an earlier step accepted after a later one")
+	}
+
+	next, err := Code(rfcSecret, Step(start)+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !use(start.Add(Period), next) {
+		t.Error("code of the next step refused")
+	}
+}